@@ -0,0 +1,135 @@
+package metrics
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mtbox/mtlog"
+)
+
+// checkpoint is the on disk format, only counters are saved as gauges
+// and histograms describe the current run.
+type checkpoint struct {
+	Saved  time.Time
+	Series map[string]*restoredSeries
+}
+
+// Save writes the counters of the registry to file. The file is
+// replaced atomically so a crash never leaves a partial checkpoint.
+// Only the counters of struct fields are saved, the samples of
+// Collectors, nested or not, are never restored.
+func (r *Registry) Save(file string) error {
+	r.mu.RLock()
+	fields := make(map[string]bool)
+	for name, v := range r.sources {
+		walkRestorable(name, v, func(field string, c counter) {
+			fields[field] = true
+		})
+	}
+	r.mu.RUnlock()
+
+	cp := checkpoint{Saved: time.Now(), Series: make(map[string]*restoredSeries)}
+	for _, s := range r.Gather() {
+		if s.Kind != KindCounter || !fields[s.Field] {
+			continue
+		}
+		if v, ok := counterValue(s.Value); ok {
+			cp.Series[s.Field] = &restoredSeries{Value: v, Created: s.Created}
+		}
+	}
+
+	// keep the series whose source did not register in this run
+	r.mu.RLock()
+	for key, rs := range r.restored {
+		if _, ok := cp.Series[key]; ok || rs.applied {
+			continue
+		}
+		if dot := strings.Index(key, "."); dot >= 0 {
+			if _, ok := r.sources[key[:dot]]; ok {
+				continue
+			}
+		}
+		cp.Series[key] = rs
+	}
+	body, err := json.Marshal(cp)
+	r.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, body, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// Restore loads the counters saved in file, they are added to the
+// sources already registered and to the ones registered later.
+// A missing file is not an error, it is the first start.
+func (r *Registry) Restore(file string) error {
+	body, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	cp := checkpoint{}
+	if err := json.Unmarshal(body, &cp); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for key, rs := range cp.Series {
+		if rs != nil {
+			r.restored[key] = rs
+		}
+	}
+	for name, v := range r.sources {
+		r.applyRestoredLocked(name, v)
+	}
+	mtlog.Infof("Restored %d metric series saved at %v from %s", len(cp.Series), cp.Saved, file)
+	return nil
+}
+
+// Checkpoint saves the registry to file every interval, and one last
+// time when the returned ticker is stopped.
+func (r *Registry) Checkpoint(file string, interval time.Duration) *CounterTicker {
+	if interval <= 0 {
+		interval = DefaultReportInterval
+	}
+	save := func() {
+		if err := r.Save(file); err != nil {
+			mtlog.Errorf("Failed to checkpoint metrics to %s: %v", file, err)
+		}
+	}
+	return runTicker(interval, save, save)
+}
+
+// the value of a counter sample, negative and non integer values are
+// not saved.
+func counterValue(v interface{}) (uint64, bool) {
+	switch t := v.(type) {
+	case uint64:
+		return t, true
+	case uint32:
+		return uint64(t), true
+	case uint:
+		return uint64(t), true
+	case int64:
+		return uint64(t), t >= 0
+	case int32:
+		return uint64(t), t >= 0
+	case int:
+		return uint64(t), t >= 0
+	}
+	return 0, false
+}
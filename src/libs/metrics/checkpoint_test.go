@@ -0,0 +1,119 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testTransport struct {
+	TotalTx  Zcounter
+	Inflight Zgauge
+}
+
+func TestCheckpointRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metrics")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "ckpt", "helloworld.metrics.json")
+
+	// nothing saved yet
+	reg := NewRegistry()
+	assert.Nil(t, reg.Restore(file))
+
+	tr := &testTransport{}
+	tr.TotalTx.Add(40)
+	tr.Inflight.Set(3)
+	reg.Register("kafka", tr)
+	first := reg.Gather()
+	assert.False(t, first[0].Restored)
+
+	ct := reg.Checkpoint(file, 0)
+	tr.TotalTx.Add(2)
+	ct.Stop()
+
+	// a restart
+	reg = NewRegistry()
+	assert.Nil(t, reg.Restore(file))
+	tr = &testTransport{}
+	tr.TotalTx.Inc()
+	reg.Register("kafka", tr)
+	assert.Equal(t, uint64(43), tr.TotalTx.Value())
+	assert.Equal(t, int64(0), tr.Inflight.Value())
+
+	samples := reg.Gather()
+	assert.Equal(t, "kafka.TotalTx", samples[0].Field)
+	assert.True(t, samples[0].Restored)
+	assert.True(t, samples[0].Created.Equal(first[0].Created))
+	assert.False(t, samples[1].Restored)
+
+	// registering again does not add the saved value twice
+	reg.Register("kafka", tr)
+	assert.Equal(t, uint64(43), tr.TotalTx.Value())
+}
+
+func TestRuntimeCollector(t *testing.T) {
+	reg := NewRegistry()
+	reg.Register("go", RuntimeCollector{})
+	samples := reg.Gather()
+	assert.Equal(t, "go.Goroutines", samples[0].Field)
+	assert.Equal(t, "go_goroutines", samples[0].Label)
+	assert.True(t, samples[0].Value.(int64) > 0)
+}
+
+type int64Collector struct{}
+
+func (int64Collector) Collect() []Sample {
+	return []Sample{{Field: "Restarts", Label: "restarts_total", Kind: KindCounter, Value: int64(7)}}
+}
+
+func TestCheckpointSkipsCollectors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metrics")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "helloworld.metrics.json")
+
+	reg := NewRegistry()
+	reg.Register("sched", int64Collector{})
+	tr := &testTransport{}
+	tr.TotalTx.Add(5)
+	reg.Register("kafka", tr)
+	assert.Nil(t, reg.Save(file))
+
+	body, err := ioutil.ReadFile(file)
+	assert.Nil(t, err)
+	assert.Contains(t, string(body), "kafka.TotalTx")
+	assert.NotContains(t, string(body), "sched.Restarts")
+
+	// nor the collectors nested in a source, even saved by an older run
+	nested := &struct {
+		Http  OpSet
+		Sched int64Collector
+		Errs  Zcounter
+	}{}
+	nested.Http.Start("GET /").End(nil)
+	nested.Errs.Inc()
+	reg = NewRegistry()
+	reg.restored["api.Sched.Restarts"] = &restoredSeries{Value: 7}
+	assert.Nil(t, reg.Register("api", nested))
+	assert.Nil(t, reg.Save(file))
+	body, err = ioutil.ReadFile(file)
+	assert.Nil(t, err)
+	assert.Contains(t, string(body), "api.Errs")
+	assert.NotContains(t, string(body), "GET /")
+	assert.NotContains(t, string(body), "api.Sched")
+
+	// a copy would be restored
+	assert.NotNil(t, reg.Register("copy", testTransport{}))
+	assert.NotNil(t, reg.Register("nil", (*testTransport)(nil)))
+	assert.Equal(t, []string{"api"}, reg.Names())
+
+	v, ok := counterValue(int64(-1))
+	assert.False(t, ok)
+	v, ok = counterValue(int64(9))
+	assert.Equal(t, uint64(9), v)
+	assert.True(t, ok)
+}
@@ -14,9 +14,34 @@ type counter interface {
 	Value() interface{}
 }
 
+type gauge interface {
+	Inc()
+	Dec()
+	Add(int64)
+	Set(int64)
+	Label(string)
+	Name() string
+	Value() interface{}
+}
+
+// label is shared by all metric types, it can be renamed while
+// the metric is being read by a reporter.
+type label struct {
+	v atomic.Value
+}
+
+func (l *label) set(s string) {
+	l.v.Store(s)
+}
+
+func (l *label) get() string {
+	s, _ := l.v.Load().(string)
+	return s
+}
+
 //
 type Zcounter struct {
-	label string
+	label label
 	x     uint64
 }
 
@@ -27,8 +52,8 @@ type zcounterJson struct {
 
 func (a Zcounter) MarshalJSON() ([]byte, error) {
 	b := zcounterJson{}
-	b.Label = a.label
-	b.X = a.x
+	b.Label = a.label.get()
+	b.X = atomic.LoadUint64(&a.x)
 	return json.Marshal(b)
 }
 
@@ -49,16 +74,70 @@ func (zc *Zcounter) Reset() {
 }
 
 func (zc *Zcounter) Value() interface{} {
+	return zc.get()
+}
+
+func (zc *Zcounter) get() uint64 {
 	return atomic.LoadUint64(&zc.x)
 }
 
-// fixme: Ideally would like to have write/read lock
 func (zc *Zcounter) Label(l string) {
-	zc.label = l
+	zc.label.set(l)
 }
 
 func (zc *Zcounter) Name() string {
-	return zc.label
+	return zc.label.get()
+}
+
+// Zgauge is a value that can go up and down, like number of
+// inflight requests or open connections.
+type Zgauge struct {
+	label label
+	x     int64
+}
+
+type zgaugeJson struct {
+	Label string `json:",omitempty"`
+	X     int64
+}
+
+func (zg *Zgauge) MarshalJSON() ([]byte, error) {
+	b := zgaugeJson{}
+	b.Label = zg.label.get()
+	b.X = atomic.LoadInt64(&zg.x)
+	return json.Marshal(b)
+}
+
+func (zg *Zgauge) Inc() {
+	atomic.AddInt64(&zg.x, 1)
+}
+
+func (zg *Zgauge) Dec() {
+	atomic.AddInt64(&zg.x, -1)
+}
+
+func (zg *Zgauge) Add(deltaX int64) {
+	atomic.AddInt64(&zg.x, deltaX)
+}
+
+func (zg *Zgauge) Set(baseV int64) {
+	atomic.StoreInt64(&zg.x, baseV)
+}
+
+func (zg *Zgauge) Reset() {
+	atomic.StoreInt64(&zg.x, 0)
+}
+
+func (zg *Zgauge) Value() interface{} {
+	return atomic.LoadInt64(&zg.x)
+}
+
+func (zg *Zgauge) Label(l string) {
+	zg.label.set(l)
+}
+
+func (zg *Zgauge) Name() string {
+	return zg.label.get()
 }
 
 //
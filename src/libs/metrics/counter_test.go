@@ -1,11 +1,13 @@
 package metrics
 
 import (
+	"encoding/json"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/mtbox/mtlog"
 	"github.com/stretchr/testify/assert"
-	"github.com/zededa/zedcloud/libs/zlog"
 )
 
 type testMetrics struct {
@@ -29,7 +31,7 @@ func (tc testMetrics) Log() {
 }
 
 func TestGetCounter(t *testing.T) {
-	cfg := zlog.LogConfig{
+	cfg := mtlog.LogConfig{
 		Level:      0,
 		Path:       "/tmp/",
 		File:       "metrics.log",
@@ -38,8 +40,8 @@ func TestGetCounter(t *testing.T) {
 		MaxAge:     7,
 		Compress:   true,
 	}
-	zlog.InitLogging(cfg)
-	zlog.Tracef("Starting the test")
+	mtlog.InitLogging(cfg)
+	mtlog.Tracef("Starting the test")
 	itm1 = testMetrics{Name: "counter1"}
 	LogCounters(&itm1, time.Second)
 	itm1.Zctr1.Label("ctr1")
@@ -54,11 +56,16 @@ func TestMetricSet(t *testing.T) {
 }
 
 func TestMetricCount(t *testing.T) {
-	t.Skip("Has a data race. skipping until we can fix it")
-	for i := 0; i < 60; i++ {
-		time.Sleep(time.Second)
-		itm1.Zctr2.Add(10)
-	}
+	var ticks int32
+	ct := runTicker(time.Millisecond, func() {
+		if atomic.AddInt32(&ticks, 1) <= 60 {
+			itm1.Zctr2.Add(10)
+		}
+	}, nil)
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&ticks) >= 60
+	}, 5*time.Second, time.Millisecond)
+	ct.Stop()
 	assert.Equal(t, itm1.Zctr2.Value(), uint64(10600))
 }
 
@@ -66,3 +73,38 @@ func TestMetricName(t *testing.T) {
 	assert.Equal(t, itm1.Zctr2.Name(), "ctr2")
 	assert.Equal(t, itm1.Zctr1.Name(), "ctr1")
 }
+
+type testLatency struct {
+	Inflight Zgauge
+	Latency  Zhistogram
+	Nested   struct {
+		Errs Zcounter
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	tl := &testLatency{}
+	tl.Inflight.Inc()
+	tl.Latency.Buckets([]float64{1, 10})
+	tl.Latency.Observe(0.5)
+	tl.Latency.Observe(5)
+	tl.Nested.Errs.Label("errs")
+	tl.Nested.Errs.Inc()
+
+	samples := Snapshot(tl)
+	assert.Equal(t, 3, len(samples))
+	assert.Equal(t, Sample{Field: "Inflight", Label: "Inflight", Kind: KindGauge, Value: int64(1)}, samples[0])
+	hs := samples[1].Value.(HistogramSnapshot)
+	assert.Equal(t, uint64(2), hs.Count)
+	assert.Equal(t, []Bucket{{1, 1}, {10, 2}}, hs.Buckets)
+	assert.Equal(t, Sample{Field: "Nested.Errs", Label: "errs", Kind: KindCounter, Value: uint64(1)}, samples[2])
+
+	body, err := json.Marshal(tl)
+	assert.Nil(t, err)
+	assert.Contains(t, string(body), `"Inflight":{"X":1}`)
+
+	ct := LogCounters(tl, 10*time.Millisecond)
+	time.Sleep(30 * time.Millisecond)
+	ct.Stop()
+	ct.Stop()
+}
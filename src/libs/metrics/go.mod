@@ -1,3 +1,12 @@
 module libs/metrics
 
 go 1.15
+
+require (
+	github.com/BurntSushi/toml v1.2.1 // indirect
+	github.com/mtbox/mtlog v0.0.0
+	github.com/stretchr/testify v1.7.0
+	gopkg.in/yaml.v2 v2.4.0 // indirect
+)
+
+replace github.com/mtbox/mtlog => ./../mtlog
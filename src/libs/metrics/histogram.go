@@ -0,0 +1,136 @@
+package metrics
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+)
+
+// DefaultBuckets are the upper bounds used by a Zhistogram which was
+// not given any. They are tuned for latencies measured in seconds.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type histogram interface {
+	Observe(float64)
+	Label(string)
+	Name() string
+	Value() interface{}
+}
+
+// Zhistogram counts observations into cumulative buckets. The zero
+// value is ready to use with DefaultBuckets.
+type Zhistogram struct {
+	mu     sync.Mutex
+	label  label
+	bounds []float64
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// Bucket is the number of observations less or equal to UpperBound.
+type Bucket struct {
+	UpperBound float64
+	Count      uint64
+}
+
+// HistogramSnapshot is a consistent copy of a Zhistogram.
+type HistogramSnapshot struct {
+	Label   string `json:",omitempty"`
+	Count   uint64
+	Sum     float64
+	Buckets []Bucket
+}
+
+// NewZhistogram returns a histogram with the given bucket upper
+// bounds, they are sorted before use.
+func NewZhistogram(label string, bounds []float64) *Zhistogram {
+	zh := &Zhistogram{}
+	zh.Label(label)
+	zh.Buckets(bounds)
+	return zh
+}
+
+// Buckets replaces the bucket layout and drops all observations.
+func (zh *Zhistogram) Buckets(bounds []float64) {
+	b := append([]float64(nil), bounds...)
+	sort.Float64s(b)
+
+	zh.mu.Lock()
+	defer zh.mu.Unlock()
+	zh.bounds = b
+	zh.counts = make([]uint64, len(b))
+	zh.count = 0
+	zh.sum = 0
+}
+
+func (zh *Zhistogram) Observe(v float64) {
+	zh.mu.Lock()
+	defer zh.mu.Unlock()
+	if zh.bounds == nil {
+		zh.bounds = DefaultBuckets
+		zh.counts = make([]uint64, len(zh.bounds))
+	}
+	for i, ub := range zh.bounds {
+		if v <= ub {
+			zh.counts[i]++
+		}
+	}
+	zh.count++
+	zh.sum += v
+}
+
+func (zh *Zhistogram) Reset() {
+	zh.mu.Lock()
+	defer zh.mu.Unlock()
+	for i := range zh.counts {
+		zh.counts[i] = 0
+	}
+	zh.count = 0
+	zh.sum = 0
+}
+
+// Snapshot returns a copy of the histogram taken under its lock.
+func (zh *Zhistogram) Snapshot() HistogramSnapshot {
+	zh.mu.Lock()
+	defer zh.mu.Unlock()
+	return zh.snapshotLocked()
+}
+
+// SnapshotAndReset returns a copy of the histogram and clears it
+// in the same critical section, so no observation is lost.
+func (zh *Zhistogram) SnapshotAndReset() HistogramSnapshot {
+	zh.mu.Lock()
+	defer zh.mu.Unlock()
+	hs := zh.snapshotLocked()
+	for i := range zh.counts {
+		zh.counts[i] = 0
+	}
+	zh.count = 0
+	zh.sum = 0
+	return hs
+}
+
+func (zh *Zhistogram) snapshotLocked() HistogramSnapshot {
+	hs := HistogramSnapshot{Label: zh.label.get(), Count: zh.count, Sum: zh.sum}
+	for i, ub := range zh.bounds {
+		hs.Buckets = append(hs.Buckets, Bucket{UpperBound: ub, Count: zh.counts[i]})
+	}
+	return hs
+}
+
+func (zh *Zhistogram) Value() interface{} {
+	return zh.Snapshot()
+}
+
+func (zh *Zhistogram) MarshalJSON() ([]byte, error) {
+	return json.Marshal(zh.Snapshot())
+}
+
+func (zh *Zhistogram) Label(l string) {
+	zh.label.set(l)
+}
+
+func (zh *Zhistogram) Name() string {
+	return zh.label.get()
+}
@@ -1,6 +1,7 @@
 package metrics
 
 import (
+	"sync"
 	"time"
 )
 
@@ -11,18 +12,42 @@ const (
 )
 
 //database health stat.
+//Operations are recorded with ObserveRead/ObserveWrite, they can run
+//concurrently with each other. Snapshot, SnapshotAndReset and ResetStat
+//hold the stat exclusively so all the fields are read together.
 type DatabaseHealthStat struct {
+	DatabaseName             string
+	MicroserviceName         string
+	TotalReadOp              Zcounter
+	TotalWriteOp             Zcounter
+	TotalUnsuccessfulReadOp  Zcounter
+	TotalUnsuccessfulWriteOp Zcounter
+	TotalLatencyReadOp       Zcounter // nanoseconds
+	TotalLatencyWriteOp      Zcounter // nanoseconds
+	ReadLatency              Zhistogram
+	WriteLatency             Zhistogram
+	InitializationTime       time.Time
+	Status                   int
+	UpTime                   string
+	IsConnected              bool
+	Error                    error
+
+	mu sync.RWMutex
+}
+
+//point in time copy of DatabaseHealthStat.
+type DatabaseStatSnapshot struct {
 	DatabaseName             string
 	MicroserviceName         string
 	TotalReadOp              uint64
 	TotalWriteOp             uint64
 	TotalUnsuccessfulReadOp  uint64
 	TotalUnsuccessfulWriteOp uint64
-	TotalLatencyReadOp       int64
-	TotalLatencyWriteOp      int64
+	TotalLatencyReadOp       time.Duration
+	TotalLatencyWriteOp      time.Duration
+	ReadLatency              HistogramSnapshot
+	WriteLatency             HistogramSnapshot
 	InitializationTime       time.Time
-	Status                   int
-	UpTime                   string
 	IsConnected              bool
 	Error                    error
 }
@@ -34,17 +59,95 @@ func (s *DatabaseHealthStat) GetStat() *DatabaseHealthStat {
 
 //reset cassandra initialization time.
 func (s *DatabaseHealthStat) ResetInitTime() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.InitializationTime = time.Now()
 }
 
+//record the connection state of the database client.
+func (s *DatabaseHealthStat) SetConnected(connected bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.IsConnected = connected
+	s.Error = err
+}
+
+//record one read operation which started at start, call it once
+//the operation has returned.
+func (s *DatabaseHealthStat) ObserveRead(start time.Time, err error) {
+	s.observe(start, err, &s.TotalReadOp, &s.TotalUnsuccessfulReadOp,
+		&s.TotalLatencyReadOp, &s.ReadLatency)
+}
+
+//record one write operation which started at start.
+func (s *DatabaseHealthStat) ObserveWrite(start time.Time, err error) {
+	s.observe(start, err, &s.TotalWriteOp, &s.TotalUnsuccessfulWriteOp,
+		&s.TotalLatencyWriteOp, &s.WriteLatency)
+}
+
+func (s *DatabaseHealthStat) observe(start time.Time, err error, total, failed, latency *Zcounter, hist *Zhistogram) {
+	elapsed := time.Since(start)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	total.Inc()
+	if err != nil {
+		failed.Inc()
+	}
+	latency.Add(uint64(elapsed))
+	hist.Observe(elapsed.Seconds())
+}
+
+//consistent copy of all the stats.
+func (s *DatabaseHealthStat) Snapshot() DatabaseStatSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.snapshotLocked(false)
+}
+
+//consistent copy of all the stats, the operation stats are reset
+//to zero before any other operation is recorded.
+func (s *DatabaseHealthStat) SnapshotAndReset() DatabaseStatSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.snapshotLocked(true)
+}
+
 //reset cassandra stats to zero.
 func (s *DatabaseHealthStat) ResetStat() {
-	s.TotalReadOp = 0
-	s.TotalWriteOp = 0
-	s.TotalUnsuccessfulReadOp = 0
-	s.TotalUnsuccessfulWriteOp = 0
-	s.TotalLatencyReadOp = 0
-	s.TotalLatencyWriteOp = 0
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.snapshotLocked(true)
+}
+
+func (s *DatabaseHealthStat) snapshotLocked(reset bool) DatabaseStatSnapshot {
+	snap := DatabaseStatSnapshot{
+		DatabaseName:             s.DatabaseName,
+		MicroserviceName:         s.MicroserviceName,
+		TotalReadOp:              s.TotalReadOp.get(),
+		TotalWriteOp:             s.TotalWriteOp.get(),
+		TotalUnsuccessfulReadOp:  s.TotalUnsuccessfulReadOp.get(),
+		TotalUnsuccessfulWriteOp: s.TotalUnsuccessfulWriteOp.get(),
+		TotalLatencyReadOp:       time.Duration(s.TotalLatencyReadOp.get()),
+		TotalLatencyWriteOp:      time.Duration(s.TotalLatencyWriteOp.get()),
+		InitializationTime:       s.InitializationTime,
+		IsConnected:              s.IsConnected,
+		Error:                    s.Error,
+	}
+	if reset {
+		s.TotalReadOp.Reset()
+		s.TotalWriteOp.Reset()
+		s.TotalUnsuccessfulReadOp.Reset()
+		s.TotalUnsuccessfulWriteOp.Reset()
+		s.TotalLatencyReadOp.Reset()
+		s.TotalLatencyWriteOp.Reset()
+		snap.ReadLatency = s.ReadLatency.SnapshotAndReset()
+		snap.WriteLatency = s.WriteLatency.SnapshotAndReset()
+	} else {
+		snap.ReadLatency = s.ReadLatency.Snapshot()
+		snap.WriteLatency = s.WriteLatency.Snapshot()
+	}
+	return snap
 }
 
 //kafka health stat.
@@ -0,0 +1,54 @@
+package metrics
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDatabaseStatSnapshotAndReset(t *testing.T) {
+	stat := &DatabaseHealthStat{DatabaseName: "cassandra"}
+	stat.SetConnected(true, nil)
+
+	var wg sync.WaitGroup
+	var total uint64
+	var mu sync.Mutex
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			snap := stat.SnapshotAndReset()
+			assert.Equal(t, snap.TotalReadOp, snap.ReadLatency.Count)
+			mu.Lock()
+			total += snap.TotalReadOp
+			mu.Unlock()
+		}
+	}()
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 250; i++ {
+				stat.ObserveRead(time.Now(), nil)
+			}
+		}()
+	}
+	wg.Wait()
+	<-done
+
+	snap := stat.SnapshotAndReset()
+	assert.Equal(t, uint64(1000), total+snap.TotalReadOp)
+
+	stat.ObserveWrite(time.Now(), errors.New("timeout"))
+	snap = stat.Snapshot()
+	assert.Equal(t, uint64(1), snap.TotalWriteOp)
+	assert.Equal(t, uint64(1), snap.TotalUnsuccessfulWriteOp)
+	assert.Equal(t, "cassandra", snap.DatabaseName)
+	assert.True(t, snap.IsConnected)
+
+	stat.ResetStat()
+	assert.Equal(t, uint64(0), stat.Snapshot().TotalWriteOp)
+}
@@ -0,0 +1,143 @@
+package metrics
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Registry is the set of metric sources of a service. A source is a
+// pointer to a struct of metric fields (see Snapshot) or a Collector.
+// Samples gathered from a registry are keyed "<source>.<field>".
+type Registry struct {
+	mu       sync.RWMutex
+	sources  map[string]interface{}
+	created  map[string]time.Time
+	restored map[string]*restoredSeries
+}
+
+type restoredSeries struct {
+	Value   uint64
+	Created time.Time
+	applied bool
+}
+
+// DefaultRegistry is used by services which do not need their own.
+var DefaultRegistry = NewRegistry()
+
+func NewRegistry() *Registry {
+	return &Registry{
+		sources:  make(map[string]interface{}),
+		created:  make(map[string]time.Time),
+		restored: make(map[string]*restoredSeries),
+	}
+}
+
+// Register adds the source v under name, replacing any source with
+// the same name. Counters restored from a checkpoint are added to v,
+// which must be a pointer unless it is a Collector.
+func (r *Registry) Register(name string, v interface{}) error {
+	if _, ok := v.(Collector); !ok {
+		if rv := reflect.ValueOf(v); rv.Kind() != reflect.Ptr || rv.IsNil() {
+			return fmt.Errorf("metric source %s is %T, not a pointer", name, v)
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sources[name] = v
+	r.applyRestoredLocked(name, v)
+	return nil
+}
+
+func (r *Registry) Unregister(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.sources, name)
+}
+
+// Names returns the registered source names, sorted.
+func (r *Registry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	names := make([]string, 0, len(r.sources))
+	for name := range r.sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Gather snapshots every source, sorted by source name.
+func (r *Registry) Gather() []Sample {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	names := make([]string, 0, len(r.sources))
+	for name := range r.sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	now := time.Now()
+	var samples []Sample
+	for _, name := range names {
+		for _, s := range sourceSamples(r.sources[name]) {
+			s.Field = name + "." + s.Field
+			if rs, ok := r.restored[s.Field]; ok && rs.applied {
+				s.Created = rs.Created
+				s.Restored = true
+			} else {
+				created, ok := r.created[s.Field]
+				if !ok {
+					created = now
+					r.created[s.Field] = created
+				}
+				s.Created = created
+			}
+			samples = append(samples, s)
+		}
+	}
+	return samples
+}
+
+func sourceSamples(v interface{}) []Sample {
+	if c, ok := v.(Collector); ok {
+		return c.Collect()
+	}
+	return Snapshot(v)
+}
+
+// applyRestoredLocked adds the checkpointed counter values of source
+// name to the counters of v. Each value is only applied once.
+func (r *Registry) applyRestoredLocked(name string, v interface{}) {
+	if len(r.restored) == 0 {
+		return
+	}
+	walkRestorable(name, v, func(field string, c counter) {
+		rs, ok := r.restored[field]
+		if !ok || rs.applied {
+			return
+		}
+		c.Add(rs.Value)
+		rs.applied = true
+	})
+}
+
+// walkRestorable visits the counters of source name that are struct
+// fields, the ones of Collectors are skipped at any depth.
+func walkRestorable(name string, v interface{}, visit func(string, counter)) {
+	if _, ok := v.(Collector); ok {
+		return
+	}
+	rv, ok := metricValue(v)
+	if !ok {
+		return
+	}
+	walkMetrics(rv, "", func(field string, m interface{}) {
+		if c, ok := m.(counter); ok {
+			visit(name+"."+field, c)
+		}
+	})
+}
@@ -0,0 +1,272 @@
+package metrics
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mtbox/mtlog"
+)
+
+// DefaultReportInterval is used when LogCounters is given no interval.
+const DefaultReportInterval = time.Minute
+
+type MetricKind int
+
+const (
+	KindCounter   MetricKind = 1
+	KindGauge     MetricKind = 2
+	KindHistogram MetricKind = 3
+)
+
+func (k MetricKind) String() string {
+	switch k {
+	case KindCounter:
+		return "counter"
+	case KindGauge:
+		return "gauge"
+	case KindHistogram:
+		return "histogram"
+	default:
+		return fmt.Sprintf("MetricKind(%d)", int(k))
+	}
+}
+
+// Sample is the value of one metric field at the time of the snapshot.
+// Value is uint64 for counters, int64 (float64 for ratios) for gauges and
+// HistogramSnapshot for histograms. Created and Restored are only filled
+// in by a Registry, Restored counters carry on from a checkpoint so
+// exporters must not treat the value as a reset, Created is when the
+// series first started.
+type Sample struct {
+	Field    string
+	Label    string
+	Kind     MetricKind
+	Value    interface{}
+	Created  time.Time
+	Restored bool
+}
+
+// Collector is implemented by metric sets whose members are not
+// plain struct fields, like OpSet.
+type Collector interface {
+	Collect() []Sample
+}
+
+// CounterReporter receives every periodic snapshot of a metric struct.
+type CounterReporter func(name string, samples []Sample)
+
+// CounterTicker is the handle of a periodic reporter, Stop ends it.
+type CounterTicker struct {
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+// Stop the reporter and wait for the last report to finish.
+// It is safe to call Stop more than once.
+func (ct *CounterTicker) Stop() {
+	if ct == nil {
+		return
+	}
+	ct.once.Do(func() {
+		close(ct.stop)
+	})
+	<-ct.done
+}
+
+var (
+	counterType   = reflect.TypeOf((*counter)(nil)).Elem()
+	gaugeType     = reflect.TypeOf((*gauge)(nil)).Elem()
+	histogramType = reflect.TypeOf((*histogram)(nil)).Elem()
+	collectorType = reflect.TypeOf((*Collector)(nil)).Elem()
+)
+
+// Snapshot walks the struct (or pointer to struct) v, including
+// nested structs, and returns a sample for every exported counter,
+// gauge, histogram and Collector field. Pass a pointer when the metrics
+// are updated concurrently, all reads then go through the accessors.
+func Snapshot(v interface{}) []Sample {
+	rv, ok := metricValue(v)
+	if !ok {
+		return nil
+	}
+
+	var samples []Sample
+	walkMetrics(rv, "", func(name string, m interface{}) {
+		switch mt := m.(type) {
+		case counter:
+			samples = append(samples, Sample{Field: name, Label: sampleLabel(mt.Name(), name),
+				Kind: KindCounter, Value: mt.Value()})
+		case gauge:
+			samples = append(samples, Sample{Field: name, Label: sampleLabel(mt.Name(), name),
+				Kind: KindGauge, Value: mt.Value()})
+		case histogram:
+			samples = append(samples, Sample{Field: name, Label: sampleLabel(mt.Name(), name),
+				Kind: KindHistogram, Value: mt.Value()})
+		case Collector:
+			for _, s := range mt.Collect() {
+				s.Field = name + "." + s.Field
+				samples = append(samples, s)
+			}
+		}
+	})
+	return samples
+}
+
+// metricValue returns an addressable value of the struct behind v.
+func metricValue(v interface{}) (reflect.Value, bool) {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr || rv.Kind() == reflect.Interface {
+		if rv.IsNil() {
+			return rv, false
+		}
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return rv, false
+	}
+	if !rv.CanAddr() {
+		// metric methods have pointer receivers, work on a copy
+		cp := reflect.New(rv.Type()).Elem()
+		cp.Set(rv)
+		rv = cp
+	}
+	return rv, true
+}
+
+// walkMetrics calls visit with the field path and a pointer to every
+// counter, gauge, histogram and Collector found in rv.
+func walkMetrics(rv reflect.Value, prefix string, visit func(string, interface{})) {
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		sf := rt.Field(i)
+		if sf.PkgPath != "" {
+			continue
+		}
+		fv := rv.Field(i)
+		name := prefix + sf.Name
+
+		if fv.Kind() == reflect.Ptr {
+			if fv.IsNil() {
+				continue
+			}
+			fv = fv.Elem()
+		}
+		if !fv.CanAddr() {
+			continue
+		}
+
+		ptr := fv.Addr()
+		switch {
+		case ptr.Type().Implements(counterType),
+			ptr.Type().Implements(gaugeType),
+			ptr.Type().Implements(histogramType),
+			ptr.Type().Implements(collectorType):
+			visit(name, ptr.Interface())
+		case fv.Kind() == reflect.Struct:
+			walkMetrics(fv, name+".", visit)
+		}
+	}
+}
+
+func sampleLabel(l, field string) string {
+	if l != "" {
+		return l
+	}
+	return field
+}
+
+// metricsName is GetName() when implemented, else the type name.
+func metricsName(v interface{}) string {
+	if n, ok := v.(interface{ GetName() string }); ok {
+		return n.GetName()
+	}
+	rt := reflect.TypeOf(v)
+	for rt != nil && rt.Kind() == reflect.Ptr {
+		rt = rt.Elem()
+	}
+	if rt == nil {
+		return ""
+	}
+	return rt.Name()
+}
+
+func formatSamples(samples []Sample) string {
+	parts := make([]string, 0, len(samples))
+	for _, s := range samples {
+		if hs, ok := s.Value.(HistogramSnapshot); ok {
+			parts = append(parts, fmt.Sprintf("%s=count:%v,sum:%v", s.Label, hs.Count, hs.Sum))
+			continue
+		}
+		parts = append(parts, fmt.Sprintf("%s=%v", s.Label, s.Value))
+	}
+	return strings.Join(parts, " ")
+}
+
+func logSamples(name string, samples []Sample) {
+	mtlog.Infof("%s %s", name, formatSamples(samples))
+}
+
+func printSamples(name string, samples []Sample) {
+	fmt.Printf("%v %s %s\n", time.Now().Format(time.RFC3339), name, formatSamples(samples))
+}
+
+// DefaultLogger writes all the metrics of v to mtlog in one line.
+func DefaultLogger(v interface{}) {
+	logSamples(metricsName(v), Snapshot(v))
+}
+
+// DefaultPrint writes all the metrics of v to stdout in one line.
+func DefaultPrint(v interface{}) {
+	printSamples(metricsName(v), Snapshot(v))
+}
+
+// LogCounters logs the metrics of v through mtlog every interval
+// until the returned ticker is stopped. v should be a pointer.
+func LogCounters(v interface{}, interval time.Duration) *CounterTicker {
+	return ReportCounters(v, interval, logSamples)
+}
+
+// PrintCounters is LogCounters writing to stdout.
+func PrintCounters(v interface{}, interval time.Duration) *CounterTicker {
+	return ReportCounters(v, interval, printSamples)
+}
+
+// ReportCounters snapshots v every interval and hands the samples
+// to report. The name is resolved once, here, so that a value receiver
+// GetName does not copy the struct while it is being updated.
+func ReportCounters(v interface{}, interval time.Duration, report CounterReporter) *CounterTicker {
+	if interval <= 0 {
+		interval = DefaultReportInterval
+	}
+	name := metricsName(v)
+	return runTicker(interval, func() {
+		report(name, Snapshot(v))
+	}, nil)
+}
+
+// runTicker calls tick every interval, and final once after Stop.
+func runTicker(interval time.Duration, tick func(), final func()) *CounterTicker {
+	ct := &CounterTicker{stop: make(chan struct{}), done: make(chan struct{})}
+
+	go func() {
+		defer close(ct.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				tick()
+			case <-ct.stop:
+				if final != nil {
+					final()
+				}
+				return
+			}
+		}
+	}()
+	return ct
+}
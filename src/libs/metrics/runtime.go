@@ -0,0 +1,50 @@
+package metrics
+
+import (
+	"runtime"
+)
+
+// CounterSample is a counter sample built by a Collector.
+func CounterSample(field, label string, v uint64) Sample {
+	return Sample{Field: field, Label: label, Kind: KindCounter, Value: v}
+}
+
+// SecondsCounterSample is a counter of seconds built by a Collector,
+// durations are always exported in seconds.
+func SecondsCounterSample(field, label string, seconds float64) Sample {
+	return Sample{Field: field, Label: label, Kind: KindCounter, Value: seconds}
+}
+
+// GaugeSample is a gauge sample built by a Collector, v is an int64
+// or, for ratios, a float64.
+func GaugeSample(field, label string, v interface{}) Sample {
+	return Sample{Field: field, Label: label, Kind: KindGauge, Value: v}
+}
+
+// RuntimeCollector reports the Go runtime metrics (go_*), they are
+// read from the runtime every time the registry is gathered.
+type RuntimeCollector struct{}
+
+func (RuntimeCollector) Collect() []Sample {
+	ms := runtime.MemStats{}
+	runtime.ReadMemStats(&ms)
+
+	return []Sample{
+		GaugeSample("Goroutines", "go_goroutines", int64(runtime.NumGoroutine())),
+		GaugeSample("NumCpu", "go_cpus", int64(runtime.NumCPU())),
+		GaugeSample("GoMaxProcs", "go_gomaxprocs", int64(runtime.GOMAXPROCS(0))),
+		GaugeSample("Alloc", "go_memstats_alloc_bytes", int64(ms.Alloc)),
+		CounterSample("TotalAlloc", "go_memstats_alloc_bytes_total", ms.TotalAlloc),
+		GaugeSample("Sys", "go_memstats_sys_bytes", int64(ms.Sys)),
+		CounterSample("Mallocs", "go_memstats_mallocs_total", ms.Mallocs),
+		CounterSample("Frees", "go_memstats_frees_total", ms.Frees),
+		GaugeSample("HeapSys", "go_memstats_heap_sys_bytes", int64(ms.HeapSys)),
+		GaugeSample("HeapIdle", "go_memstats_heap_idle_bytes", int64(ms.HeapIdle)),
+		GaugeSample("HeapInuse", "go_memstats_heap_inuse_bytes", int64(ms.HeapInuse)),
+		GaugeSample("HeapObjects", "go_memstats_heap_objects", int64(ms.HeapObjects)),
+		GaugeSample("NextGC", "go_memstats_next_gc_bytes", int64(ms.NextGC)),
+		GaugeSample("LastGC", "go_memstats_last_gc_time_seconds", int64(ms.LastGC/1e9)),
+		CounterSample("NumGC", "go_gc_cycles_total", uint64(ms.NumGC)),
+		SecondsCounterSample("PauseTotal", "go_gc_pause_seconds_total", float64(ms.PauseTotalNs)/1e9),
+	}
+}
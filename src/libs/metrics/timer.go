@@ -0,0 +1,144 @@
+package metrics
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Observer is anything that takes a measurement, like Zhistogram.
+type Observer interface {
+	Observe(float64)
+}
+
+// Timer measures the time since StartTimer, usually with
+//	t := metrics.StartTimer(&stat.Latency)
+//	defer t.ObserveDuration()
+type Timer struct {
+	obs   Observer
+	start time.Time
+}
+
+// StartTimer starts a timer which reports to obs in seconds,
+// obs can be nil when only the duration is needed.
+func StartTimer(obs Observer) *Timer {
+	return &Timer{obs: obs, start: time.Now()}
+}
+
+// ObserveDuration records the time since start and returns it.
+func (t *Timer) ObserveDuration() time.Duration {
+	d := time.Since(t.start)
+	if t.obs != nil {
+		t.obs.Observe(d.Seconds())
+	}
+	return d
+}
+
+// OpStats are the metrics kept for one operation.
+type OpStats struct {
+	Total    Zcounter
+	Failed   Zcounter
+	Inflight Zgauge
+	Latency  Zhistogram
+}
+
+// Span is one running operation, started with OpStats.Start.
+type Span struct {
+	op    *OpStats
+	timer *Timer
+}
+
+// Start marks the operation inflight until End is called.
+func (op *OpStats) Start() *Span {
+	op.Inflight.Inc()
+	return &Span{op: op, timer: StartTimer(&op.Latency)}
+}
+
+// End the span, err decides if the operation counts as failed.
+func (sp *Span) End(err error) time.Duration {
+	d := sp.timer.ObserveDuration()
+	sp.op.Inflight.Dec()
+	sp.op.Total.Inc()
+	if err != nil {
+		sp.op.Failed.Inc()
+	}
+	return d
+}
+
+// Do runs fn as one operation. A panic in fn is recorded as a
+// failure and then carried on to the caller.
+func (op *OpStats) Do(fn func() error) (err error) {
+	sp := op.Start()
+	defer func() {
+		if r := recover(); r != nil {
+			sp.End(fmt.Errorf("panic: %v", r))
+			panic(r)
+		}
+		sp.End(err)
+	}()
+	return fn()
+}
+
+// OpSet keeps OpStats per operation label, e.g. "kafka.send",
+// "cassandra.read" or "vault.login". The zero value is ready to use.
+type OpSet struct {
+	mu  sync.RWMutex
+	ops map[string]*OpStats
+}
+
+// Op returns the stats for label, creating them on first use.
+func (set *OpSet) Op(label string) *OpStats {
+	set.mu.RLock()
+	op, ok := set.ops[label]
+	set.mu.RUnlock()
+	if ok {
+		return op
+	}
+
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	if op, ok = set.ops[label]; ok {
+		return op
+	}
+	if set.ops == nil {
+		set.ops = make(map[string]*OpStats)
+	}
+	op = &OpStats{}
+	op.Total.Label(label + ".Total")
+	op.Failed.Label(label + ".Failed")
+	op.Inflight.Label(label + ".Inflight")
+	op.Latency.Label(label + ".Latency")
+	set.ops[label] = op
+	return op
+}
+
+// Start a span of the operation label.
+func (set *OpSet) Start(label string) *Span {
+	return set.Op(label).Start()
+}
+
+// Do runs fn as one operation of label.
+func (set *OpSet) Do(label string, fn func() error) error {
+	return set.Op(label).Do(fn)
+}
+
+// Collect returns the samples of all the operations sorted by label.
+func (set *OpSet) Collect() []Sample {
+	set.mu.RLock()
+	labels := make([]string, 0, len(set.ops))
+	for l := range set.ops {
+		labels = append(labels, l)
+	}
+	set.mu.RUnlock()
+	sort.Strings(labels)
+
+	var samples []Sample
+	for _, l := range labels {
+		for _, s := range Snapshot(set.Op(l)) {
+			s.Field = l + "." + s.Field
+			samples = append(samples, s)
+		}
+	}
+	return samples
+}
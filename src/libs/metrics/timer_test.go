@@ -0,0 +1,47 @@
+package metrics
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStartTimer(t *testing.T) {
+	var hist Zhistogram
+	tm := StartTimer(&hist)
+	time.Sleep(time.Millisecond)
+	d := tm.ObserveDuration()
+	assert.True(t, d >= time.Millisecond)
+
+	hs := hist.Snapshot()
+	assert.Equal(t, uint64(1), hs.Count)
+	assert.Equal(t, d.Seconds(), hs.Sum)
+}
+
+func TestOpSet(t *testing.T) {
+	var ops OpSet
+	assert.Nil(t, ops.Do("kafka.send", func() error { return nil }))
+	assert.NotNil(t, ops.Do("kafka.send", func() error { return errors.New("broker down") }))
+	assert.Panics(t, func() {
+		ops.Do("vault.login", func() error { panic("boom") })
+	})
+
+	sp := ops.Start("cassandra.read")
+	assert.Equal(t, int64(1), ops.Op("cassandra.read").Inflight.Value())
+	sp.End(nil)
+
+	send := ops.Op("kafka.send")
+	assert.Equal(t, uint64(2), send.Total.Value())
+	assert.Equal(t, uint64(1), send.Failed.Value())
+	assert.Equal(t, int64(0), send.Inflight.Value())
+	assert.Equal(t, uint64(1), ops.Op("vault.login").Failed.Value())
+
+	samples := Snapshot(&struct{ Ops OpSet }{})
+	assert.Equal(t, 0, len(samples))
+	samples = ops.Collect()
+	assert.Equal(t, 12, len(samples))
+	assert.Equal(t, "cassandra.read.Total", samples[0].Field)
+	assert.Equal(t, "cassandra.read.Total", samples[0].Label)
+}
@@ -6,6 +6,8 @@ import (
 	"log"
 	"os"
 	"path"
+	"sort"
+	"strings"
 	"sync"
 
 	lumberjack "gopkg.in/natefinch/lumberjack.v2"
@@ -202,7 +204,7 @@ func (mtlog *logfmtLogger) log(lvl LogLevel, keyvals ...interface{}) {
 	n := len(keyvals) + 2
 	kvs := make([]interface{}, 0, n)
 	kvs = append(append(kvs, "", lvl.String()), keyvals...)
-	mtlog.lh.Printf("%v", kvs)
+	mtlog.lh.Print(redact(fmt.Sprintf("%v", kvs)))
 }
 
 func (mtlog *logfmtLogger) Tracef(format string, args ...interface{}) {
@@ -229,7 +231,7 @@ func (mtlog *logfmtLogger) logf(lvl LogLevel, format string, args ...interface{}
 	n := len(args) + 1
 	kvs := make([]interface{}, 0, n)
 	kvs = append(append(kvs, lvl.String()), args...)
-	mtlog.lh.Printf("%s "+format, kvs...)
+	mtlog.lh.Print(redact(fmt.Sprintf("%s "+format, kvs...)))
 }
 
 func Debug(keyvals ...interface{}) {
@@ -283,15 +285,25 @@ func Infof(format string, args ...interface{}) {
 func Errorf(format string, args ...interface{}) {
 	if LocalZLog != nil {
 		LocalZLog.Errorf(format, args...)
+	} else {
+		earlyf(ErrorLevel, format, args...)
 	}
 }
 
 func Warnf(format string, args ...interface{}) {
 	if LocalZLog != nil {
 		LocalZLog.Warnf(format, args...)
+	} else {
+		earlyf(WarnLevel, format, args...)
 	}
 }
 
+// warnings and errors logged before InitLogging, e.g. while the
+// configuration is loaded, go to the standard logger.
+func earlyf(lvl LogLevel, format string, args ...interface{}) {
+	log.Print(redact(lvl.String() + " " + fmt.Sprintf(format, args...)))
+}
+
 func SetLevel(lvl LogLevel) {
 	if LocalZLog != nil {
 		LocalZLog.SetLevel(lvl)
@@ -306,6 +318,77 @@ func GetLevel() LogLevel {
 	return lvl
 }
 
+// values replaced in every log line, see Redact
+var redacted struct {
+	sync.RWMutex
+	values   map[string]bool
+	replacer *strings.Replacer
+}
+
+const (
+	redactedValue = "*****"
+	minRedacted   = 4
+)
+
+// Redact keeps value, typically a secret, out of the logs, it is
+// replaced by ***** wherever it shows up. Values shorter than 4
+// characters would mangle the logs and are ignored.
+func Redact(value string) {
+	if len(value) < minRedacted {
+		return
+	}
+	redacted.Lock()
+	defer redacted.Unlock()
+	if redacted.values[value] {
+		return
+	}
+	if redacted.values == nil {
+		redacted.values = make(map[string]bool)
+	}
+	redacted.values[value] = true
+	redacted.replacer = newRedacter(redacted.values)
+}
+
+// SetRedacted replaces the values Redact keeps out of the logs, e.g.
+// with the secrets of a reloaded configuration.
+func SetRedacted(values []string) {
+	redacted.Lock()
+	defer redacted.Unlock()
+	redacted.values = make(map[string]bool, len(values))
+	for _, v := range values {
+		if len(v) >= minRedacted {
+			redacted.values[v] = true
+		}
+	}
+	redacted.replacer = newRedacter(redacted.values)
+}
+
+func newRedacter(set map[string]bool) *strings.Replacer {
+	if len(set) == 0 {
+		return nil
+	}
+	values := make([]string, 0, len(set))
+	for v := range set {
+		values = append(values, v)
+	}
+	// the longest first, when a secret contains another
+	sort.Slice(values, func(a, b int) bool { return len(values[a]) > len(values[b]) })
+	oldnew := make([]string, 0, 2*len(values))
+	for _, v := range values {
+		oldnew = append(oldnew, v, redactedValue)
+	}
+	return strings.NewReplacer(oldnew...)
+}
+
+func redact(line string) string {
+	redacted.RLock()
+	defer redacted.RUnlock()
+	if redacted.replacer == nil {
+		return line
+	}
+	return redacted.replacer.Replace(line)
+}
+
 func JsonStringify(structStr interface{}) string {
 	jsonStr, _ := json.Marshal(structStr)
 	return string(jsonStr)
@@ -3,12 +3,15 @@ module libs/mtsrv
 go 1.15
 
 require (
-        github.com/mtbox/metrics v0.0.0
-        github.com/mtbox/mtlog v0.0.0
-
+	github.com/BurntSushi/toml v1.2.1
+	github.com/mtbox/metrics v0.0.0
+	github.com/mtbox/mtlog v0.0.0
 	github.com/shirou/gopsutil v3.20.12+incompatible
+	github.com/stretchr/testify v1.7.0
 	google.golang.org/grpc v1.34.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 replace github.com/mtbox/metrics => ./../metrics
+
 replace github.com/mtbox/mtlog => ./../mtlog
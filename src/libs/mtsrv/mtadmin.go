@@ -0,0 +1,265 @@
+package mtsrv
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/mtbox/mtlog"
+)
+
+// The admin listener serves the operational endpoints of the service on
+// Admin.HttpAddr:
+//
+//	/healthz       liveness, 503 when RED, see Server.Liveness
+//	/readyz        readiness, 503 when RED, see Server.Readiness
+//	/metrics       the metrics report, see MetricsHandler
+//	/debug/pprof/  the net/http/pprof profiles
+//	/config        the configuration, secrets and passwords redacted
+//	/loglevel      the log level, changed with PUT or POST ?level=debug
+//	/version       the service name and version given to InitFlags
+//	/fleet         the instances of the fleet, see SetFleet
+//
+// The endpoints are not authenticated and /loglevel and /debug/pprof
+// change or slow down the service, they must not be exposed: an address
+// without a host, e.g. ":8081", is served on the loopback interface.
+// Another host, e.g. "0.0.0.0:8081", is served as is with a warning.
+type AdminConfig struct {
+	HttpAddr string `json:"HttpAddr"`
+}
+
+// name and version given to InitFlags, for /version
+var serviceVersion struct {
+	name    string
+	version string
+}
+
+// configuration keys whose values /config hides
+var redactedConfigKeys = []string{"password", "secret", "token"}
+
+// AdminHandler serves the admin endpoints.
+func (s *Server) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", s.serveHealthz)
+	mux.HandleFunc("/readyz", s.serveReadyz)
+	mux.Handle("/metrics", s.MetricsHandler())
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/config", s.serveConfig)
+	mux.HandleFunc("/loglevel", s.serveLogLevel)
+	mux.HandleFunc("/version", s.serveVersion)
+	mux.HandleFunc("/fleet", s.serveFleet)
+	return mux
+}
+
+// serve AdminHandler on Admin.HttpAddr.
+func (s *Server) startAdminListener(addr string) {
+	addr = adminListenAddr(addr)
+	httpSrv := &http.Server{Addr: addr, Handler: s.AdminHandler()}
+	s.OnShutdown("admin listener", func(ctx context.Context) error {
+		return httpSrv.Shutdown(ctx)
+	})
+
+	go func() {
+		mtlog.Infof("Serving admin endpoints on %v", addr)
+		if err := httpSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			mtlog.Errorf("Admin listener on %v failed: %v", addr, err)
+		}
+	}()
+}
+
+// adminListenAddr binds an address without a host to loopback.
+func adminListenAddr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if host == "" {
+		return net.JoinHostPort("127.0.0.1", port)
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		mtlog.Warnf("Admin endpoints on %v are not authenticated, do not expose them", addr)
+	}
+	return addr
+}
+
+func writeAdminJson(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		mtlog.Errorf("Failed to write admin response: %v", err)
+	}
+}
+
+func adminGetOnly(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
+
+// Status is the number of the health reports, StatusName its name.
+type probeReport struct {
+	Status     SrvHealthStatusType
+	StatusName string
+	Reasons    []CheckReason  `json:",omitempty"`
+	Process    *ProcessDetail `json:",omitempty"`
+}
+
+// serve a probe state, 503 when it is RED.
+func writeProbe(w http.ResponseWriter, state ProbeResult, process *ProcessDetail) {
+	code := http.StatusOK
+	if state.Status != ServiceHealthStatus_HEALTH_GREEN && state.Status != ServiceHealthStatus_HEALTH_YELLOW {
+		code = http.StatusServiceUnavailable
+	}
+	writeAdminJson(w, code, probeReport{Status: state.Status, StatusName: state.Status.String(),
+		Reasons: state.Reasons, Process: process})
+}
+
+// the liveness, with the process detail when the health service runs.
+func (s *Server) serveHealthz(w http.ResponseWriter, r *http.Request) {
+	if !adminGetOnly(w, r) {
+		return
+	}
+	var process *ProcessDetail
+	if hCtx := s.healthCtx(); hCtx != nil {
+		if pd, err := hCtx.ProcessDetail(); err == nil {
+			process = pd
+		}
+	}
+	writeProbe(w, s.Liveness(), process)
+}
+
+// the readiness, a degraded service is still ready.
+func (s *Server) serveReadyz(w http.ResponseWriter, r *http.Request) {
+	if !adminGetOnly(w, r) {
+		return
+	}
+	writeProbe(w, s.Readiness(), nil)
+}
+
+// the configuration WatchConfig holds, or the common configuration.
+func (s *Server) serveConfig(w http.ResponseWriter, r *http.Request) {
+	if !adminGetOnly(w, r) {
+		return
+	}
+	s.Lock()
+	var srvCfg interface{} = s.cfg
+	watch := s.watch
+	s.Unlock()
+	if watch != nil {
+		watch.Lock()
+		srvCfg = watch.current
+		watch.Unlock()
+	}
+
+	configJson, err := hideSecrets(srvCfg)
+	var v interface{}
+	if err == nil {
+		err = json.Unmarshal(configJson, &v)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeAdminJson(w, http.StatusOK, redactConfig(v))
+}
+
+// redactConfig hides the values of the password, secret and token keys,
+// secret references are kept.
+func redactConfig(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, e := range t {
+			if str, ok := e.(string); ok && str != "" && !isSecretRef(str) && redactedConfigKey(k) {
+				t[k] = "*****"
+				continue
+			}
+			t[k] = redactConfig(e)
+		}
+	case []interface{}:
+		for i, e := range t {
+			t[i] = redactConfig(e)
+		}
+	}
+	return v
+}
+
+func redactedConfigKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, k := range redactedConfigKeys {
+		if strings.Contains(key, k) {
+			return true
+		}
+	}
+	return false
+}
+
+type logLevelReport struct {
+	Level string
+}
+
+// GET the log level, PUT or POST level=<name or number> to change it.
+func (s *Server) serveLogLevel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPut, http.MethodPost:
+		lvl, ok := parseLogLevel(r.FormValue("level"))
+		if !ok {
+			http.Error(w, "unknown level "+strconv.Quote(r.FormValue("level")), http.StatusBadRequest)
+			return
+		}
+		mtlog.Infof("Log level set to %v from %v", lvl, r.RemoteAddr)
+		mtlog.SetLevel(lvl)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	writeAdminJson(w, http.StatusOK, logLevelReport{Level: mtlog.GetLevel().String()})
+}
+
+// parse a level name like debug, or its number.
+func parseLogLevel(s string) (mtlog.LogLevel, bool) {
+	for lvl := mtlog.DebugLevel; lvl <= mtlog.FatalLevel; lvl++ {
+		if strings.EqualFold(s, lvl.String()) || s == strconv.Itoa(int(lvl)) {
+			return lvl, true
+		}
+	}
+	return 0, false
+}
+
+type versionReport struct {
+	Service   string
+	Instance  uint8
+	Version   string
+	GoVersion string
+}
+
+func (s *Server) serveVersion(w http.ResponseWriter, r *http.Request) {
+	if !adminGetOnly(w, r) {
+		return
+	}
+	report := versionReport{
+		Service:   serviceVersion.name,
+		Version:   serviceVersion.version,
+		GoVersion: runtime.Version(),
+	}
+	if s.cfg != nil {
+		if report.Service == "" {
+			report.Service = s.cfg.ServiceName
+		}
+		report.Instance = s.cfg.ServiceInst
+	}
+	writeAdminJson(w, http.StatusOK, report)
+}
@@ -0,0 +1,402 @@
+package mtsrv
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mtbox/metrics"
+	"github.com/mtbox/mtlog"
+)
+
+const (
+	ALERT_THRESHOLD = "threshold"
+	ALERT_RATE      = "rate"
+
+	ALERT_WARNING  = "warning"
+	ALERT_CRITICAL = "critical"
+
+	ALERT_FIRING   = "firing"
+	ALERT_RESOLVED = "resolved"
+
+	alertWebHookTimeout = 5 * time.Second
+)
+
+// AlertRule is evaluated against one registry metric, Metric is
+// either the registry key ("kafka.TotalTxErr") or the label
+// ("go_goroutines"). A label exported by more than one source is an
+// error of the rule, the key must be used. A "threshold" rule
+// compares the value, a "rate" rule compares the increase per RatePer
+// seconds (60 by default). The alert fires after For consecutive
+// breached evaluations.
+//
+//	{"Name": "TxErrors", "Metric": "kafka.TotalTxErr", "Type": "rate",
+//	 "Op": ">", "Value": 5, "For": 3, "Severity": "critical"}
+type AlertRule struct {
+	Name     string  `json:"Name" validate:"required"`
+	Metric   string  `json:"Metric" validate:"required"`
+	Type     string  `json:"Type"`
+	Op       string  `json:"Op"`
+	Value    float64 `json:"Value"`
+	RatePer  uint64  `json:"RatePer"`
+	For      int     `json:"For"`
+	Severity string  `json:"Severity"`
+}
+
+// Alert rules are evaluated every Interval seconds (60 by default),
+// every transition is posted as an AlertEvent to the WebHooks.
+type AlertConfig struct {
+	Interval uint64      `json:"Interval"`
+	Rules    []AlertRule `json:"Rules"`
+	WebHooks []string    `json:"WebHooks"`
+}
+
+// AlertStatus is the state of one rule after the last evaluation.
+type AlertStatus struct {
+	Rule     string
+	Metric   string
+	Severity string
+	Value    float64
+	Firing   bool
+	Since    time.Time
+	Breaches int
+	Error    string
+}
+
+// AlertEvent is posted to the web hooks when an alert fires or
+// resolves.
+type AlertEvent struct {
+	ServiceName string
+	ServiceInst uint8
+	Rule        string
+	Metric      string
+	Severity    string
+	State       string
+	Value       float64
+	Threshold   float64
+	Time        time.Time
+}
+
+type alertState struct {
+	rule      AlertRule
+	status    AlertStatus
+	last      float64
+	lastTime  time.Time
+	haveValue bool
+}
+
+// AlertEvaluator runs the alert rules over a metrics registry.
+type AlertEvaluator struct {
+	sync.Mutex
+	reg      *metrics.Registry
+	cfg      *ServiceCommonConfig
+	rules    []*alertState
+	webHooks *WebHooksList
+	client   *http.Client
+}
+
+func validateAlertRule(r *AlertRule) error {
+	if r.Name == "" || r.Metric == "" {
+		return fmt.Errorf("alert rule needs a Name and a Metric")
+	}
+	switch r.Type {
+	case "":
+		r.Type = ALERT_THRESHOLD
+	case ALERT_THRESHOLD, ALERT_RATE:
+	default:
+		return fmt.Errorf("alert rule %v: unknown Type %v", r.Name, r.Type)
+	}
+	if _, err := compareAlert(r.Op, 0, 0); err != nil {
+		return fmt.Errorf("alert rule %v: %v", r.Name, err)
+	}
+	switch r.Severity {
+	case "":
+		r.Severity = ALERT_WARNING
+	case ALERT_WARNING, ALERT_CRITICAL:
+	default:
+		return fmt.Errorf("alert rule %v: unknown Severity %v", r.Name, r.Severity)
+	}
+	if r.For <= 0 {
+		r.For = 1
+	}
+	if r.RatePer == 0 {
+		r.RatePer = 60
+	}
+	return nil
+}
+
+// validateAlertRules reports the invalid rules of the configuration.
+func validateAlertRules(rules []AlertRule, path string, errs *ConfigErrors) {
+	for i, r := range rules {
+		if err := validateAlertRule(&r); err != nil {
+			errs.add(fmt.Sprintf("%s[%d]", path, i), "%v", err)
+		}
+	}
+}
+
+func compareAlert(op string, v, threshold float64) (bool, error) {
+	switch op {
+	case ">":
+		return v > threshold, nil
+	case ">=":
+		return v >= threshold, nil
+	case "<":
+		return v < threshold, nil
+	case "<=":
+		return v <= threshold, nil
+	case "==":
+		return v == threshold, nil
+	case "!=":
+		return v != threshold, nil
+	}
+	return false, fmt.Errorf("unknown Op %q", op)
+}
+
+// NewAlertEvaluator checks the rules of cfg.Alerts and returns an
+// evaluator over reg. The invalid rules are left out and returned as
+// the error, the evaluator runs the others.
+func NewAlertEvaluator(reg *metrics.Registry, cfg *ServiceCommonConfig) (*AlertEvaluator, error) {
+	ev := &AlertEvaluator{
+		reg:      reg,
+		cfg:      cfg,
+		webHooks: &WebHooksList{},
+		client:   &http.Client{Timeout: alertWebHookTimeout},
+	}
+	var errs []string
+	for _, r := range cfg.Alerts.Rules {
+		if err := validateAlertRule(&r); err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		ev.rules = append(ev.rules, &alertState{rule: r, status: AlertStatus{Rule: r.Name,
+			Metric: r.Metric, Severity: r.Severity}})
+	}
+	for _, url := range cfg.Alerts.WebHooks {
+		ev.webHooks.Hooks = append(ev.webHooks.Hooks, &WebHookDetail{Url: url})
+	}
+	if len(errs) != 0 {
+		return ev, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return ev, nil
+}
+
+func sampleFloat(s metrics.Sample) (float64, bool) {
+	switch v := s.Value.(type) {
+	case uint64:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	case metrics.HistogramSnapshot:
+		return float64(v.Count), true
+	}
+	return 0, false
+}
+
+// Evaluate runs every rule once against a fresh registry snapshot.
+func (ev *AlertEvaluator) Evaluate(ctx context.Context) error {
+	if ev == nil {
+		return nil
+	}
+	values := make(map[string]float64)
+	labels := make(map[string]string)
+	ambiguous := make(map[string]bool)
+	for _, s := range ev.reg.Gather() {
+		v, ok := sampleFloat(s)
+		if !ok {
+			continue
+		}
+		values[s.Field] = v
+		if s.Label == "" {
+			continue
+		}
+		// a label exported by two sources selects neither
+		if field, seen := labels[s.Label]; seen && field != s.Field {
+			ambiguous[s.Label] = true
+			continue
+		}
+		labels[s.Label] = s.Field
+	}
+	for label, field := range labels {
+		if _, isField := values[label]; !isField && !ambiguous[label] {
+			values[label] = values[field]
+		}
+	}
+
+	now := time.Now()
+	var events []AlertEvent
+	ev.Lock()
+	for _, st := range ev.rules {
+		if e := ev.evaluateRule(st, values, ambiguous, now); e != nil {
+			events = append(events, *e)
+		}
+	}
+	ev.Unlock()
+
+	for _, e := range events {
+		ev.postWebHooks(ctx, e)
+	}
+	return nil
+}
+
+func (ev *AlertEvaluator) evaluateRule(st *alertState, values map[string]float64, ambiguous map[string]bool,
+	now time.Time) *AlertEvent {
+	r := st.rule
+	v, ok := values[r.Metric]
+	if !ok {
+		st.status.Error = fmt.Sprintf("metric %v not found", r.Metric)
+		if ambiguous[r.Metric] {
+			st.status.Error = fmt.Sprintf("label %v is exported by more than one source, use the source.Field name", r.Metric)
+		}
+		return nil
+	}
+	st.status.Error = ""
+
+	value := v
+	if r.Type == ALERT_RATE {
+		prev, prevTime, havePrev := st.last, st.lastTime, st.haveValue
+		st.last, st.lastTime, st.haveValue = v, now, true
+		elapsed := now.Sub(prevTime).Seconds()
+		if !havePrev || elapsed <= 0 {
+			return nil
+		}
+		// a counter going down was reset, the rate starts again
+		if v < prev {
+			prev = 0
+		}
+		value = (v - prev) / elapsed * float64(r.RatePer)
+	}
+	st.status.Value = value
+
+	breached, _ := compareAlert(r.Op, value, r.Value)
+	if !breached {
+		st.status.Breaches = 0
+		if st.status.Firing {
+			st.status.Firing = false
+			st.status.Since = now
+			mtlog.Infof("Alert %v resolved, %v is %v", r.Name, r.Metric, value)
+			return ev.event(r, ALERT_RESOLVED, value, now)
+		}
+		return nil
+	}
+
+	st.status.Breaches++
+	if st.status.Firing || st.status.Breaches < r.For {
+		return nil
+	}
+	st.status.Firing = true
+	st.status.Since = now
+	mtlog.Errorf("Alert %v (%v) firing, %v is %v %v %v for %d intervals", r.Name, r.Severity,
+		r.Metric, value, r.Op, r.Value, st.status.Breaches)
+	return ev.event(r, ALERT_FIRING, value, now)
+}
+
+func (ev *AlertEvaluator) event(r AlertRule, state string, value float64, now time.Time) *AlertEvent {
+	return &AlertEvent{ServiceName: ev.cfg.ServiceName, ServiceInst: ev.cfg.ServiceInst,
+		Rule: r.Name, Metric: r.Metric, Severity: r.Severity, State: state,
+		Value: value, Threshold: r.Value, Time: now}
+}
+
+func (ev *AlertEvaluator) postWebHooks(ctx context.Context, e AlertEvent) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		mtlog.Errorf("Failed to marshal alert event: %v", err)
+		return
+	}
+	for _, hook := range ev.webHooks.Hooks {
+		err := ev.post(ctx, hook.Url, body)
+
+		ev.Lock()
+		hook.LastSent = e.Time
+		if err != nil {
+			hook.TotalFailed++
+			hook.Error = err.Error()
+			mtlog.Errorf("Failed to post alert %v to %v: %v", e.Rule, hook.Url, err)
+		} else {
+			hook.TotalSent++
+			hook.Error = ""
+		}
+		ev.Unlock()
+	}
+}
+
+func (ev *AlertEvaluator) post(ctx context.Context, url string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := ev.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("web hook returned %v", resp.Status)
+	}
+	return nil
+}
+
+// Alerts returns the status of every rule, sorted by rule name.
+func (ev *AlertEvaluator) Alerts() []AlertStatus {
+	if ev == nil {
+		return nil
+	}
+	ev.Lock()
+	defer ev.Unlock()
+	alerts := make([]AlertStatus, 0, len(ev.rules))
+	for _, st := range ev.rules {
+		alerts = append(alerts, st.status)
+	}
+	sort.Slice(alerts, func(a, b int) bool { return alerts[a].Rule < alerts[b].Rule })
+	return alerts
+}
+
+// WebHooks returns a copy of the web hook delivery status.
+func (ev *AlertEvaluator) WebHooks() *WebHooksList {
+	if ev == nil {
+		return nil
+	}
+	ev.Lock()
+	defer ev.Unlock()
+	list := &WebHooksList{}
+	for _, hook := range ev.webHooks.Hooks {
+		h := *hook
+		list.Hooks = append(list.Hooks, &h)
+	}
+	return list
+}
+
+// schedule the evaluation on the server scheduler.
+func (s *Server) startAlerts(scCfg *ServiceCommonConfig) {
+	if s.alerts == nil {
+		return
+	}
+	interval := time.Minute
+	if scCfg.Alerts.Interval != 0 {
+		interval = time.Duration(scCfg.Alerts.Interval) * time.Second
+	}
+	err := s.sched.Register(JobSpec{
+		Name:     "alerts",
+		Interval: interval,
+		Timeout:  interval,
+		Overlap:  OverlapSkip,
+		Fn:       s.alerts.Evaluate,
+	})
+	if err != nil {
+		mtlog.Errorf("Failed to schedule alert evaluation: %v", err)
+	}
+}
+
+// Alerts returns the alert evaluator, nil when no rule is configured.
+func (s *Server) Alerts() *AlertEvaluator {
+	return s.alerts
+}
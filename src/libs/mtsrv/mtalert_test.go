@@ -0,0 +1,117 @@
+package mtsrv
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mtbox/metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+type testTransportStat struct {
+	TotalTxErr metrics.Zcounter
+	Queue      metrics.Zgauge
+}
+
+func TestAlertEvaluator(t *testing.T) {
+	var mu sync.Mutex
+	var events []AlertEvent
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e := AlertEvent{}
+		json.NewDecoder(r.Body).Decode(&e)
+		mu.Lock()
+		events = append(events, e)
+		mu.Unlock()
+	}))
+	defer hook.Close()
+
+	stat := &testTransportStat{}
+	reg := metrics.NewRegistry()
+	reg.Register("kafka", stat)
+	cfg := &ServiceCommonConfig{ServiceName: "helloworld", Alerts: AlertConfig{
+		Rules: []AlertRule{
+			{Name: "TxErrors", Metric: "kafka.TotalTxErr", Type: ALERT_RATE, Op: ">", Value: 5,
+				RatePer: 1, For: 2, Severity: ALERT_CRITICAL},
+			{Name: "Queue", Metric: "kafka.Queue", Op: ">=", Value: 10},
+		},
+		WebHooks: []string{hook.URL},
+	}}
+	ev, err := NewAlertEvaluator(reg, cfg)
+	assert.Nil(t, err)
+
+	ctx := context.Background()
+	ev.Evaluate(ctx)
+	for i := 0; i < 2; i++ {
+		time.Sleep(20 * time.Millisecond)
+		stat.TotalTxErr.Add(100)
+		ev.Evaluate(ctx)
+	}
+	stat.Queue.Set(3)
+	alerts := ev.Alerts()
+	assert.Equal(t, "Queue", alerts[0].Rule)
+	assert.False(t, alerts[0].Firing)
+	assert.True(t, alerts[1].Firing)
+	assert.Equal(t, ALERT_CRITICAL, alerts[1].Severity)
+
+	hCtx := &Health{name: "helloworld", alerts: ev}
+	brief, err := hCtx.BriefSrvsStatus(&MtsrvStatus{DetailedStatus: &DetailedStatusSummary{Alerts: alerts}})
+	assert.Nil(t, err)
+	assert.Equal(t, ServiceHealthStatus_HEALTH_RED, brief.Status)
+
+	// no more errors, the rate drops to 0
+	time.Sleep(20 * time.Millisecond)
+	ev.Evaluate(ctx)
+	assert.False(t, ev.Alerts()[1].Firing)
+
+	mu.Lock()
+	assert.Equal(t, 2, len(events))
+	assert.Equal(t, ALERT_FIRING, events[0].State)
+	assert.Equal(t, ALERT_RESOLVED, events[1].State)
+	assert.Equal(t, "helloworld", events[0].ServiceName)
+	mu.Unlock()
+	assert.Equal(t, uint64(2), ev.WebHooks().Hooks[0].TotalSent)
+
+	// only the bad rule is left out
+	badCfg := &ServiceCommonConfig{Alerts: AlertConfig{Rules: []AlertRule{
+		{Name: "bad", Metric: "go_goroutines", Op: "~"},
+		{Name: "good", Metric: "go_goroutines", Op: ">"},
+	}}}
+	ev, err = NewAlertEvaluator(reg, badCfg)
+	assert.Equal(t, `alert rule bad: unknown Op "~"`, err.Error())
+	assert.Equal(t, 1, len(ev.Alerts()))
+	assert.Equal(t, "good", ev.Alerts()[0].Rule)
+
+	// and rejected by the configuration checks
+	err = ValidateConfig(badCfg)
+	assert.Equal(t, ConfigErrors{{Path: "$.Alerts.Rules[0]", Msg: `alert rule bad: unknown Op "~"`}}, err)
+}
+
+func TestAlertAmbiguousLabel(t *testing.T) {
+	reg := metrics.NewRegistry()
+	kafka, nats := &testTransportStat{}, &testTransportStat{}
+	reg.Register("kafka", kafka)
+	reg.Register("nats", nats)
+	label := reg.Gather()[0].Label
+	assert.NotEqual(t, "", label)
+
+	cfg := &ServiceCommonConfig{ServiceName: "helloworld", Alerts: AlertConfig{
+		Rules: []AlertRule{
+			{Name: "ByLabel", Metric: label, Op: ">", Value: 5},
+			{Name: "ByField", Metric: "nats.TotalTxErr", Op: ">", Value: 5},
+		}}}
+	ev, err := NewAlertEvaluator(reg, cfg)
+	assert.Nil(t, err)
+	nats.TotalTxErr.Add(10)
+	ev.Evaluate(context.Background())
+
+	alerts := ev.Alerts()
+	assert.Equal(t, "ByField", alerts[0].Rule)
+	assert.True(t, alerts[0].Firing)
+	assert.False(t, alerts[1].Firing)
+	assert.Contains(t, alerts[1].Error, "more than one source")
+}
@@ -0,0 +1,325 @@
+package mtsrv
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mtbox/mtlog"
+	"github.com/shirou/gopsutil/disk"
+)
+
+// A HealthChecker checks one thing the service depends on, a disk, a
+// peer or an endpoint. Checkers registered with Health run with a
+// timeout once when registered, then every interval as jobs of the
+// Scheduler given to RunCheckers, the one of the Server the Health is
+// registered with. The health report and the probes only read the last
+// result, they never wait for what is checked. Each checker is also a
+// StatusCheck of the liveness and readiness states.
+
+const (
+	defaultCheckTimeout  = 5 * time.Second
+	defaultCheckInterval = 15 * time.Second
+)
+
+// Kinds of the checkers of mtsrv.
+const (
+	CHECKER_DISK = "disk"
+	CHECKER_TCP  = "tcp"
+	CHECKER_HTTP = "http"
+)
+
+// HealthChecker checks the health of a dependency. Check returns the
+// status, details shown in the health report and, when the status is
+// not GREEN, the error.
+type HealthChecker interface {
+	Name() string
+	Kind() string
+	Check(ctx context.Context) (SrvHealthStatusType, map[string]interface{}, error)
+}
+
+// CheckerOptions says how a checker is run.
+type CheckerOptions struct {
+	Timeout     time.Duration // 5s when not set
+	Interval    time.Duration // time between two checks, 15s when not set
+	Probe       string        // PROBE_LIVENESS or PROBE_READINESS (the default)
+	Criticality string        // CHECK_CRITICAL (the default) or CHECK_DEGRADED
+}
+
+// CheckerStatus is the last result of a checker, in the detailed status.
+type CheckerStatus struct {
+	Name      string
+	Kind      string
+	Status    SrvHealthStatusType
+	Details   map[string]interface{} `json:",omitempty"`
+	Error     string                 `json:",omitempty"`
+	CheckedAt time.Time
+	Duration  string
+}
+
+// a registered checker and its last result.
+type cachedChecker struct {
+	sync.Mutex
+	checker HealthChecker
+	opts    CheckerOptions
+	last    CheckerStatus
+}
+
+// RegisterChecker adds or replaces the checker of the same name, it
+// returns once the checker ran a first time.
+func (hCtx *Health) RegisterChecker(checker HealthChecker, opts CheckerOptions) {
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultCheckTimeout
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = defaultCheckInterval
+	}
+	cc := &cachedChecker{checker: checker, opts: opts}
+	cc.refresh(context.Background())
+
+	hCtx.Lock()
+	if hCtx.checkers == nil {
+		hCtx.checkers = make(map[string]*cachedChecker)
+	}
+	hCtx.checkers[checker.Name()] = cc
+	sched := hCtx.sched
+	hCtx.Unlock()
+	if sched != nil {
+		cc.schedule(sched)
+	}
+
+	hCtx.RegisterCheck(StatusCheck{
+		Name:        checker.Name(),
+		Probe:       opts.Probe,
+		Criticality: opts.Criticality,
+		Check: func() (SrvHealthStatusType, string) {
+			st := cc.status()
+			return st.Status, st.Error
+		},
+	})
+}
+
+// UnregisterChecker removes the checker name.
+func (hCtx *Health) UnregisterChecker(name string) {
+	hCtx.Lock()
+	delete(hCtx.checkers, name)
+	sched := hCtx.sched
+	hCtx.Unlock()
+	if sched != nil {
+		sched.Unregister(checkerJob(name))
+	}
+	hCtx.UnregisterCheck(name)
+}
+
+// RunCheckers runs the checkers every interval as jobs of sched, the
+// ones registered later too. It replaces the jobs of the checkers of the
+// same name, those of a previous Health.
+func (hCtx *Health) RunCheckers(sched *Scheduler) {
+	hCtx.Lock()
+	hCtx.sched = sched
+	checkers := make([]*cachedChecker, 0, len(hCtx.checkers))
+	for _, cc := range hCtx.checkers {
+		checkers = append(checkers, cc)
+	}
+	hCtx.Unlock()
+	for _, cc := range checkers {
+		cc.schedule(sched)
+	}
+}
+
+func checkerJob(name string) string {
+	return "checker " + name
+}
+
+// run the checker every interval.
+func (cc *cachedChecker) schedule(sched *Scheduler) {
+	name := checkerJob(cc.checker.Name())
+	sched.Unregister(name)
+	err := sched.Register(JobSpec{
+		Name:     name,
+		Interval: cc.opts.Interval,
+		Overlap:  OverlapSkip,
+		Fn: func(ctx context.Context) error {
+			// a failed check is a status, not a failed job
+			cc.refresh(ctx)
+			return nil
+		},
+	})
+	if err != nil {
+		mtlog.Errorf("Checker %v is not run anymore: %v", cc.checker.Name(), err)
+	}
+}
+
+// CheckerStatus returns the last results of the checkers, sorted by
+// name.
+func (hCtx *Health) CheckerStatus() []CheckerStatus {
+	hCtx.Lock()
+	checkers := make([]*cachedChecker, 0, len(hCtx.checkers))
+	for _, cc := range hCtx.checkers {
+		checkers = append(checkers, cc)
+	}
+	hCtx.Unlock()
+
+	status := make([]CheckerStatus, 0, len(checkers))
+	for _, cc := range checkers {
+		status = append(status, cc.status())
+	}
+	sort.Slice(status, func(a, b int) bool { return status[a].Name < status[b].Name })
+	return status
+}
+
+// the last result.
+func (cc *cachedChecker) status() CheckerStatus {
+	cc.Lock()
+	defer cc.Unlock()
+	return cc.last
+}
+
+// run the checker and keep its result, the lock is not held meanwhile.
+func (cc *cachedChecker) refresh(ctx context.Context) {
+	st := runChecker(ctx, cc.checker, cc.opts.Timeout)
+	cc.Lock()
+	cc.last = st
+	cc.Unlock()
+}
+
+// run the checker, RED when it fails or does not return in time.
+func runChecker(ctx context.Context, checker HealthChecker, timeout time.Duration) CheckerStatus {
+	st := CheckerStatus{Name: checker.Name(), Kind: checker.Kind(), CheckedAt: time.Now()}
+
+	type result struct {
+		status  SrvHealthStatusType
+		details map[string]interface{}
+		err     error
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	done := make(chan result, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- result{ServiceHealthStatus_HEALTH_RED, nil, fmt.Errorf("check panicked: %v", r)}
+			}
+		}()
+		status, details, err := checker.Check(ctx)
+		done <- result{status, details, err}
+	}()
+
+	select {
+	case r := <-done:
+		st.Status, st.Details = r.status, r.details
+		if r.err != nil {
+			st.Error = r.err.Error()
+			if r.status == ServiceHealthStatus_HEALTH_GREEN {
+				st.Status = ServiceHealthStatus_HEALTH_RED
+			}
+		}
+	case <-ctx.Done():
+		st.Status = ServiceHealthStatus_HEALTH_RED
+		st.Error = fmt.Sprintf("timed out after %v", timeout)
+	}
+	st.Duration = time.Since(st.CheckedAt).String()
+	return st
+}
+
+type diskChecker struct {
+	name           string
+	path           string
+	minFreePercent float64
+}
+
+// NewDiskChecker checks the free space of the file system of path, RED
+// below minFreePercent and YELLOW below twice that.
+func NewDiskChecker(name, path string, minFreePercent float64) HealthChecker {
+	return &diskChecker{name: name, path: path, minFreePercent: minFreePercent}
+}
+
+func (dc *diskChecker) Name() string { return dc.name }
+func (dc *diskChecker) Kind() string { return CHECKER_DISK }
+
+func (dc *diskChecker) Check(ctx context.Context) (SrvHealthStatusType, map[string]interface{}, error) {
+	usage, err := disk.UsageWithContext(ctx, dc.path)
+	if err != nil {
+		return ServiceHealthStatus_HEALTH_RED, nil, err
+	}
+	freePercent := 100 - usage.UsedPercent
+	details := map[string]interface{}{
+		"Path":        dc.path,
+		"Total":       usage.Total,
+		"Free":        usage.Free,
+		"FreePercent": freePercent,
+	}
+	switch {
+	case freePercent < dc.minFreePercent:
+		return ServiceHealthStatus_HEALTH_RED, details,
+			fmt.Errorf("%.1f%% free on %v, below %v%%", freePercent, dc.path, dc.minFreePercent)
+	case freePercent < 2*dc.minFreePercent:
+		return ServiceHealthStatus_HEALTH_YELLOW, details,
+			fmt.Errorf("%.1f%% free on %v", freePercent, dc.path)
+	}
+	return ServiceHealthStatus_HEALTH_GREEN, details, nil
+}
+
+type tcpChecker struct {
+	name string
+	addr string
+}
+
+// NewTCPChecker checks that addr accepts connections.
+func NewTCPChecker(name, addr string) HealthChecker {
+	return &tcpChecker{name: name, addr: addr}
+}
+
+func (tc *tcpChecker) Name() string { return tc.name }
+func (tc *tcpChecker) Kind() string { return CHECKER_TCP }
+
+func (tc *tcpChecker) Check(ctx context.Context) (SrvHealthStatusType, map[string]interface{}, error) {
+	start := time.Now()
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", tc.addr)
+	details := map[string]interface{}{"Addr": tc.addr}
+	if err != nil {
+		return ServiceHealthStatus_HEALTH_RED, details, err
+	}
+	conn.Close()
+	details["Latency"] = time.Since(start).String()
+	return ServiceHealthStatus_HEALTH_GREEN, details, nil
+}
+
+type httpChecker struct {
+	name   string
+	url    string
+	client *http.Client
+}
+
+// NewHTTPChecker checks that a GET of url answers with a 2xx or 3xx
+// status.
+func NewHTTPChecker(name, url string) HealthChecker {
+	return &httpChecker{name: name, url: url, client: &http.Client{}}
+}
+
+func (hc *httpChecker) Name() string { return hc.name }
+func (hc *httpChecker) Kind() string { return CHECKER_HTTP }
+
+func (hc *httpChecker) Check(ctx context.Context) (SrvHealthStatusType, map[string]interface{}, error) {
+	details := map[string]interface{}{"URL": hc.url}
+	req, err := http.NewRequest(http.MethodGet, hc.url, nil)
+	if err != nil {
+		return ServiceHealthStatus_HEALTH_RED, details, err
+	}
+	start := time.Now()
+	resp, err := hc.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return ServiceHealthStatus_HEALTH_RED, details, err
+	}
+	resp.Body.Close()
+	details["StatusCode"] = resp.StatusCode
+	details["Latency"] = time.Since(start).String()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return ServiceHealthStatus_HEALTH_RED, details, fmt.Errorf("%v answered %v", hc.url, resp.Status)
+	}
+	return ServiceHealthStatus_HEALTH_GREEN, details, nil
+}
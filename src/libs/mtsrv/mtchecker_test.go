@@ -0,0 +1,125 @@
+package mtsrv
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type countingChecker struct {
+	sync.Mutex
+	runs  int32
+	delay time.Duration
+	err   error
+}
+
+func (cc *countingChecker) Name() string { return "counting" }
+func (cc *countingChecker) Kind() string { return "test" }
+
+func (cc *countingChecker) set(delay time.Duration, err error) {
+	cc.Lock()
+	defer cc.Unlock()
+	cc.delay, cc.err = delay, err
+}
+
+func (cc *countingChecker) Check(ctx context.Context) (SrvHealthStatusType, map[string]interface{}, error) {
+	runs := atomic.AddInt32(&cc.runs, 1)
+	cc.Lock()
+	delay, err := cc.delay, cc.err
+	cc.Unlock()
+	select {
+	case <-time.After(delay):
+	case <-ctx.Done():
+		return ServiceHealthStatus_HEALTH_RED, nil, ctx.Err()
+	}
+	return ServiceHealthStatus_HEALTH_GREEN, map[string]interface{}{"Runs": runs}, err
+}
+
+func TestCheckerCacheAndTimeout(t *testing.T) {
+	hCtx := &Health{name: "helloworld"}
+	checker := &countingChecker{}
+	hCtx.RegisterChecker(checker, CheckerOptions{Interval: 50 * time.Millisecond})
+
+	status := hCtx.CheckerStatus()
+	assert.Equal(t, 1, len(status))
+	assert.Equal(t, ServiceHealthStatus_HEALTH_GREEN, status[0].Status)
+	assert.Equal(t, "test", status[0].Kind)
+	assert.Equal(t, ProbeResult{Status: ServiceHealthStatus_HEALTH_GREEN}, hCtx.Readiness())
+	// the probes and reports read the result of the registration
+	assert.Equal(t, int32(1), atomic.LoadInt32(&checker.runs))
+
+	// run again every interval by the scheduler
+	sched := NewScheduler()
+	hCtx.RunCheckers(sched)
+	sched.Start()
+	defer sched.Stop()
+	checker.set(0, fmt.Errorf("disk gone"))
+	assert.Eventually(t, func() bool {
+		return hCtx.CheckerStatus()[0].Status == ServiceHealthStatus_HEALTH_RED
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.True(t, atomic.LoadInt32(&checker.runs) >= 2)
+	assert.Equal(t, "disk gone", hCtx.CheckerStatus()[0].Error)
+	assert.Equal(t, []CheckReason{{"counting", ServiceHealthStatus_HEALTH_RED, "disk gone"}}, hCtx.Readiness().Reasons)
+
+	// a slow checker does not slow the probes down
+	checker.set(time.Second, nil)
+	hCtx.RegisterChecker(checker, CheckerOptions{Timeout: 20 * time.Millisecond, Interval: 10 * time.Millisecond,
+		Criticality: CHECK_DEGRADED})
+	start := time.Now()
+	assert.Equal(t, ProbeResult{Status: ServiceHealthStatus_HEALTH_YELLOW, Reasons: []CheckReason{
+		{"counting", ServiceHealthStatus_HEALTH_YELLOW, "timed out after 20ms"},
+	}}, hCtx.Readiness())
+	assert.True(t, time.Since(start) < 20*time.Millisecond)
+	assert.Equal(t, 1, len(sched.Status()))
+
+	hCtx.UnregisterChecker("counting")
+	assert.Equal(t, 0, len(hCtx.CheckerStatus()))
+	assert.Equal(t, ProbeResult{Status: ServiceHealthStatus_HEALTH_GREEN}, hCtx.Readiness())
+	assert.Equal(t, 0, len(sched.Status()))
+}
+
+func TestBuiltinCheckers(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/down" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer ts.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	addr := ln.Addr().String()
+
+	hCtx := &Health{name: "helloworld"}
+	hCtx.RegisterChecker(NewHTTPChecker("http up", ts.URL+"/up"), CheckerOptions{})
+	hCtx.RegisterChecker(NewHTTPChecker("http down", ts.URL+"/down"), CheckerOptions{})
+	hCtx.RegisterChecker(NewTCPChecker("tcp", addr), CheckerOptions{})
+	hCtx.RegisterChecker(NewDiskChecker("disk", t.TempDir(), 0), CheckerOptions{})
+
+	srvsStatus, err := hCtx.CompleteSrvsStatus(&SrvsComponentComposition{})
+	assert.Nil(t, err)
+	checks := srvsStatus.DetailedStatus.Checks
+	assert.Equal(t, []string{"disk", "http down", "http up", "tcp"},
+		[]string{checks[0].Name, checks[1].Name, checks[2].Name, checks[3].Name})
+	assert.Equal(t, ServiceHealthStatus_HEALTH_GREEN, checks[0].Status)
+	assert.Equal(t, CHECKER_DISK, checks[0].Kind)
+	assert.Equal(t, ServiceHealthStatus_HEALTH_RED, checks[1].Status)
+	assert.Equal(t, http.StatusServiceUnavailable, checks[1].Details["StatusCode"])
+	assert.Equal(t, ServiceHealthStatus_HEALTH_GREEN, checks[2].Status)
+	assert.Equal(t, ServiceHealthStatus_HEALTH_GREEN, checks[3].Status)
+	assert.Equal(t, ServiceHealthStatus_HEALTH_RED, srvsStatus.BriefStatus.Status)
+	assert.Contains(t, srvsStatus.BriefStatus.Readiness.Reasons, CheckReason{"http down", ServiceHealthStatus_HEALTH_RED,
+		fmt.Sprintf("%v/down answered 503 Service Unavailable", ts.URL)})
+
+	ln.Close()
+	status, _, err := NewTCPChecker("tcp", addr).Check(context.Background())
+	assert.Equal(t, ServiceHealthStatus_HEALTH_RED, status)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,286 @@
+package mtsrv
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// The format of a configuration file is picked by its extension, the
+// one before .mustache for templates: .json (the default), .yaml or
+// .yml, and .toml. Every format is converted to JSON before it is
+// parsed, so the json struct tags are the names in all of them.
+//
+// The Include key at the root of a configuration names base files,
+// relative to the including file, merged under it in order:
+//
+//   Include: [base.yaml, services.toml]
+//
+// Objects are merged key by key and lists of objects with a Name by
+// Name, e.g. a Services entry only overrides the entry of the same
+// name. Other values and lists are replaced.
+const configIncludeKey = "Include"
+
+// ConfigCodec converts a configuration format from and to the generic
+// values of encoding/json.
+type ConfigCodec interface {
+	Decode(body []byte) (interface{}, error)
+	Encode(v interface{}) ([]byte, error)
+}
+
+var configCodecs = map[string]ConfigCodec{
+	".json": jsonCodec{},
+	".yaml": yamlCodec{},
+	".yml":  yamlCodec{},
+	".toml": tomlCodec{},
+}
+
+// configCodec returns the codec of the file, JSON when the extension
+// is unknown.
+func configCodec(file string) ConfigCodec {
+	if codec, ok := configCodecs[strings.ToLower(filepath.Ext(strings.TrimSuffix(file, templateSuffix)))]; ok {
+		return codec
+	}
+	return jsonCodec{}
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Decode(body []byte) (interface{}, error) {
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func (jsonCodec) Encode(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+type yamlCodec struct{}
+
+func (yamlCodec) Decode(body []byte) (interface{}, error) {
+	var v interface{}
+	if err := yaml.Unmarshal(body, &v); err != nil {
+		return nil, err
+	}
+	return normalizeConfig(v)
+}
+
+func (yamlCodec) Encode(v interface{}) ([]byte, error) {
+	return yaml.Marshal(v)
+}
+
+type tomlCodec struct{}
+
+func (tomlCodec) Decode(body []byte) (interface{}, error) {
+	v := make(map[string]interface{})
+	if err := toml.Unmarshal(body, &v); err != nil {
+		return nil, err
+	}
+	return normalizeConfig(v)
+}
+
+func (tomlCodec) Encode(v interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	if err := toml.NewEncoder(&b).Encode(dropNulls(v)); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// normalizeConfig turns what a decoder returned into the values of the
+// JSON codec.
+func normalizeConfig(v interface{}) (interface{}, error) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return jsonCodec{}.Decode(body)
+}
+
+// readConfig decodes the (rendered) body of file and merges its
+// includes, the result is JSON. A JSON file without includes is
+// returned as is so that errors point to its lines.
+func (cl *ConfigLoader) readConfig(file string, body []byte, seen []string) ([]byte, error) {
+	codec := configCodec(file)
+	v, err := codec.Decode(body)
+	if err != nil {
+		if _, ok := codec.(jsonCodec); ok && len(seen) == 0 {
+			return body, nil
+		}
+		return nil, fmt.Errorf("failed to parse configuration [%v]: %v", file, err)
+	}
+	obj, ok := v.(map[string]interface{})
+	include, hasInclude := obj[configIncludeKey]
+	if !ok || !hasInclude {
+		if _, isJson := codec.(jsonCodec); isJson && len(seen) == 0 {
+			return body, nil
+		}
+		return json.Marshal(v)
+	}
+	delete(obj, configIncludeKey)
+
+	var bases []string
+	switch inc := include.(type) {
+	case string:
+		bases = []string{inc}
+	case []interface{}:
+		for _, b := range inc {
+			s, ok := b.(string)
+			if !ok {
+				return nil, fmt.Errorf("%v: %v must be a file name or a list of file names", file, configIncludeKey)
+			}
+			bases = append(bases, s)
+		}
+	default:
+		return nil, fmt.Errorf("%v: %v must be a file name or a list of file names", file, configIncludeKey)
+	}
+
+	seen = append(seen, file)
+	var merged interface{} = map[string]interface{}{}
+	for _, base := range bases {
+		if !filepath.IsAbs(base) {
+			base = filepath.Join(filepath.Dir(file), base)
+		}
+		for _, s := range seen {
+			if s == base {
+				return nil, fmt.Errorf("%v: %v includes itself", base, configIncludeKey)
+			}
+		}
+		bbody, err := cl.Render(base)
+		if err != nil {
+			return nil, err
+		}
+		bjson, err := cl.readConfig(base, bbody, seen)
+		if err != nil {
+			return nil, err
+		}
+		bv, err := jsonCodec{}.Decode(bjson)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse configuration [%v]: %v", base, err)
+		}
+		merged = mergeConfig(merged, bv)
+	}
+	return json.Marshal(mergeConfig(merged, obj))
+}
+
+// mergeConfig merges over on top of base.
+func mergeConfig(base, over interface{}) interface{} {
+	switch ov := over.(type) {
+	case map[string]interface{}:
+		bm, ok := base.(map[string]interface{})
+		if !ok {
+			return over
+		}
+		out := make(map[string]interface{}, len(bm)+len(ov))
+		for k, v := range bm {
+			out[k] = v
+		}
+		for k, v := range ov {
+			if bv, ok := out[k]; ok {
+				out[k] = mergeConfig(bv, v)
+			} else {
+				out[k] = v
+			}
+		}
+		return out
+
+	case []interface{}:
+		bl, ok := base.([]interface{})
+		if !ok || !namedList(bl) || !namedList(ov) {
+			return over
+		}
+		out := append([]interface{}(nil), bl...)
+		index := make(map[string]int)
+		for i, e := range out {
+			index[e.(map[string]interface{})["Name"].(string)] = i
+		}
+		for _, e := range ov {
+			name := e.(map[string]interface{})["Name"].(string)
+			if i, ok := index[name]; ok {
+				out[i] = mergeConfig(out[i], e)
+			} else {
+				index[name] = len(out)
+				out = append(out, e)
+			}
+		}
+		return out
+	}
+	return over
+}
+
+// namedList tells whether every element is an object with a Name.
+func namedList(l []interface{}) bool {
+	for _, e := range l {
+		m, ok := e.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		if _, ok := m["Name"].(string); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// encodeConfig writes the JSON configuration in the format of file.
+func encodeConfig(file string, configJson []byte) ([]byte, error) {
+	codec := configCodec(file)
+	if _, ok := codec.(jsonCodec); ok {
+		return configJson, nil
+	}
+	v, err := jsonCodec{}.Decode(configJson)
+	if err != nil {
+		return nil, err
+	}
+	return codec.Encode(plainNumbers(v))
+}
+
+// plainNumbers replaces the json.Number values by int64 or float64.
+func plainNumbers(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, e := range t {
+			t[k] = plainNumbers(e)
+		}
+	case []interface{}:
+		for i, e := range t {
+			t[i] = plainNumbers(e)
+		}
+	case json.Number:
+		if n, err := t.Int64(); err == nil {
+			return n
+		}
+		f, _ := t.Float64()
+		return f
+	}
+	return v
+}
+
+// dropNulls removes the null values TOML cannot write.
+func dropNulls(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, e := range t {
+			if e == nil {
+				delete(t, k)
+				continue
+			}
+			t[k] = dropNulls(e)
+		}
+	case []interface{}:
+		for i, e := range t {
+			t[i] = dropNulls(e)
+		}
+	}
+	return v
+}
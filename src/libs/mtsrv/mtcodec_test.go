@@ -0,0 +1,115 @@
+package mtsrv
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testConfigYaml = `
+# shared by every helloworld instance
+ServiceCommonConfig:
+  ServiceName: helloworld
+  LogCfg:
+    Level: 1
+  Services:
+    - Name: cassandra
+      Port: 9042
+      Server: localhost
+    - Name: kafka
+      Port: 9092
+      Server: localhost
+      Topics: [TutorialTopic]
+`
+
+const testConfigToml = `
+[ServiceCommonConfig]
+ServiceName = "helloworld"
+
+[ServiceCommonConfig.LogCfg]
+Level = 1
+
+[[ServiceCommonConfig.Services]]
+Name = "cassandra"
+Port = 9042
+Server = "localhost"
+
+[[ServiceCommonConfig.Services]]
+Name = "kafka"
+Port = 9092
+Server = "localhost"
+Topics = ["TutorialTopic"]
+`
+
+func TestConfigCodecs(t *testing.T) {
+	for name, body := range map[string]string{
+		"helloworld.json": testConfigJson,
+		"helloworld.yaml": testConfigYaml,
+		"helloworld.toml": testConfigToml,
+	} {
+		file := writeTestConfig(t, name, body)
+		cfg := testServiceConfig{}
+		assert.Nil(t, (&ConfigLoader{}).Load(file, &cfg), name)
+		assert.Equal(t, "helloworld", cfg.ScCfg.ServiceName, name)
+		assert.Equal(t, 1, int(cfg.ScCfg.LogCfg.Level), name)
+		assert.Equal(t, "localhost:9092", cfg.ScCfg.Services[1].ServiceAddr(), name)
+		assert.Equal(t, []string{"TutorialTopic"}, cfg.ScCfg.Services[1].Topics, name)
+
+		// stored in the same format and loaded back
+		stored := filepath.Join(filepath.Dir(file), "stored"+filepath.Ext(name))
+		assert.Nil(t, StoreConfig(stored, &cfg), name)
+		again := testServiceConfig{}
+		assert.Nil(t, (&ConfigLoader{}).Load(stored, &again), name)
+		assert.Equal(t, cfg, again, name)
+	}
+
+	file := writeTestConfig(t, "helloworld.yaml", "ServiceCommonConfig:\n  Threads: [1]\n  Logging: 0\n")
+	err := (&ConfigLoader{}).Load(file, &testServiceConfig{})
+	assert.Equal(t, ConfigErrors{
+		{"$.ServiceCommonConfig.Logging", "unknown field"},
+		{"$.ServiceCommonConfig.Threads", "expected an integer, got a list"},
+	}, err)
+
+	file = writeTestConfig(t, "helloworld.toml", "[ServiceCommonConfig\n")
+	err = (&ConfigLoader{}).Load(file, &testServiceConfig{})
+	assert.Contains(t, err.Error(), "toml: line")
+}
+
+func TestConfigInclude(t *testing.T) {
+	base := writeTestConfig(t, "base.yaml", testConfigYaml)
+	dir := filepath.Dir(base)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "debug.toml"), []byte(`
+Include = "base.yaml"
+[ServiceCommonConfig]
+DebugMode = true
+`), 0644))
+	file := filepath.Join(dir, "helloworld.json")
+	assert.Nil(t, ioutil.WriteFile(file, []byte(`{
+    "Include": ["debug.toml"],
+    "ServiceCommonConfig": {
+        "LogCfg": {"Level": 0},
+        "Services": [
+            {"Name": "kafka", "Topics": ["SrvsHealthTopic"]},
+            {"Name": "health", "Frequency": 60}
+        ]
+    }
+}`), 0644))
+
+	cfg := testServiceConfig{}
+	assert.Nil(t, (&ConfigLoader{}).Load(file, &cfg))
+	sc := cfg.ScCfg
+	assert.Equal(t, "helloworld", sc.ServiceName)
+	assert.True(t, sc.DebugMode)
+	assert.Equal(t, 0, int(sc.LogCfg.Level))
+	assert.Equal(t, 3, len(sc.Services))
+	assert.Equal(t, "localhost:9042", sc.Services[0].ServiceAddr())
+	assert.Equal(t, "localhost:9092", sc.Services[1].ServiceAddr())
+	assert.Equal(t, []string{"SrvsHealthTopic"}, sc.Services[1].Topics)
+	assert.Equal(t, uint64(60), sc.Services[2].Frequency)
+
+	assert.Nil(t, ioutil.WriteFile(base, []byte("Include: helloworld.json\n"), 0644))
+	err := (&ConfigLoader{}).Load(file, &testServiceConfig{})
+	assert.Contains(t, err.Error(), "includes itself")
+}
@@ -0,0 +1,58 @@
+package mtsrv
+
+import (
+	"time"
+
+	"github.com/mtbox/metrics"
+)
+
+// Collect reports the process metrics (process_*) of the health
+// service, they are read from the OS every time the registry is
+// gathered. Values the OS does not provide are left out.
+func (hCtx *Health) Collect() []metrics.Sample {
+	if hCtx == nil || hCtx.processCtx == nil {
+		return nil
+	}
+	pCtx := hCtx.processCtx
+
+	samples := []metrics.Sample{
+		metrics.GaugeSample("UpTime", "process_uptime_seconds", int64(time.Since(hCtx.startTime).Seconds())),
+	}
+	if ct, err := pCtx.CreateTime(); err == nil {
+		samples = append(samples, metrics.GaugeSample("StartTime", "process_start_time_seconds", ct/1000))
+	}
+	if n, err := pCtx.NumThreads(); err == nil {
+		samples = append(samples, metrics.GaugeSample("NumThreads", "process_threads", int64(n)))
+	}
+	if n, err := pCtx.NumFDs(); err == nil {
+		samples = append(samples, metrics.GaugeSample("OpenFds", "process_open_fds", int64(n)))
+	}
+	if cpuTime, err := pCtx.Times(); err == nil {
+		samples = append(samples, metrics.SecondsCounterSample("Cpu", "process_cpu_seconds_total",
+			cpuTime.User+cpuTime.System))
+	}
+	if cpuPercent, err := pCtx.CPUPercent(); err == nil {
+		samples = append(samples, metrics.GaugeSample("CpuPercent", "process_cpu_percent", cpuPercent))
+	}
+	if memInfo, err := pCtx.MemoryInfo(); err == nil {
+		samples = append(samples,
+			metrics.GaugeSample("ResidentMemory", "process_resident_memory_bytes", int64(memInfo.RSS)),
+			metrics.GaugeSample("VirtualMemory", "process_virtual_memory_bytes", int64(memInfo.VMS)))
+	}
+	if memPercent, err := pCtx.MemoryPercent(); err == nil {
+		samples = append(samples, metrics.GaugeSample("MemPercent", "process_memory_percent", float64(memPercent)))
+	}
+	if faults, err := pCtx.PageFaults(); err == nil {
+		samples = append(samples,
+			metrics.CounterSample("MinorFaults", "process_minor_faults_total", faults.MinorFaults),
+			metrics.CounterSample("MajorFaults", "process_major_faults_total", faults.MajorFaults))
+	}
+	if io, err := pCtx.IOCounters(); err == nil {
+		samples = append(samples,
+			metrics.CounterSample("ReadCount", "process_io_read_count_total", io.ReadCount),
+			metrics.CounterSample("WriteCount", "process_io_write_count_total", io.WriteCount),
+			metrics.CounterSample("ReadBytes", "process_io_read_bytes_total", io.ReadBytes),
+			metrics.CounterSample("WriteBytes", "process_io_write_bytes_total", io.WriteBytes))
+	}
+	return samples
+}
@@ -0,0 +1,450 @@
+package mtsrv
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mtbox/mtlog"
+)
+
+// Configuration is loaded in layers, each one overriding the previous:
+//
+//   1) default: the zero value, or what the caller set before loading
+//   2) file:    the JSON configuration file
+//   3) env:     MT_<PATH> environment variables, e.g. MT_LOGCFG_LEVEL=0
+//   4) flag:    -set <path>=<value> command-line flags, e.g.
+//               -set LogCfg.Level=0 -set Services.kafka.Port=9093
+//
+// A path is the list of JSON names from the configuration root, the
+// ServiceCommonConfig level can be left out. Elements of Services (and
+// of any list of structs) are selected by their Name or by index, so
+// MT_SERVICES_KAFKA_PORT and MT_SERVICES_1_PORT both work. Lists of
+// strings are given comma separated. Names are case insensitive.
+const (
+	CONFIG_DEFAULT = "default"
+	CONFIG_FILE    = "file"
+	CONFIG_ENV     = "env"
+	CONFIG_FLAG    = "flag"
+
+	ConfigEnvPrefix = "MT_"
+)
+
+// ConfigSource tells where the value at Path comes from, Origin is
+// the file name, the variable name or the flag.
+type ConfigSource struct {
+	Path   string
+	Source string
+	Origin string
+}
+
+// ConfigLoader loads a configuration through all the layers.
+type ConfigLoader struct {
+	EnvPrefix string
+	Environ   []string
+	Overrides []string
+	// Values is the JSON values file of a template configuration
+	Values string
+
+	sources map[string]ConfigSource
+	leaves  []string
+	// the files of the last Read
+	files []string
+}
+
+// overrides given with -set, the template values file of -cfg-values,
+// and whether -cfg-sources, -check-cfg and -render-config were given.
+var (
+	cfgOverrides   overrideFlags
+	cfgValues      string
+	cfgDumpSources bool
+	cfgCheck       bool
+	cfgRender      bool
+)
+
+type overrideFlags []string
+
+func (of *overrideFlags) String() string {
+	return strings.Join(*of, ",")
+}
+
+func (of *overrideFlags) Set(v string) error {
+	*of = append(*of, v)
+	return nil
+}
+
+// NewConfigLoader uses the process environment and the -set flags.
+func NewConfigLoader() *ConfigLoader {
+	return &ConfigLoader{
+		EnvPrefix: ConfigEnvPrefix,
+		Environ:   os.Environ(),
+		Overrides: cfgOverrides,
+		Values:    cfgValues,
+	}
+}
+
+// Load fills srvCfg, a pointer to the configuration struct, and
+// validates it. All the violations are returned at once as ConfigErrors.
+func (cl *ConfigLoader) Load(configFile string, srvCfg interface{}) error {
+	rv := reflect.ValueOf(srvCfg)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("configuration must be a pointer to a struct")
+	}
+	rv = rv.Elem()
+	cl.sources = make(map[string]ConfigSource)
+
+	body, err := cl.Read(configFile)
+	if err != nil {
+		return err
+	}
+	var generic interface{}
+	if err := json.Unmarshal(body, &generic); err != nil {
+		if se, ok := err.(*json.SyntaxError); ok {
+			line := 1 + bytes.Count(body[:se.Offset], []byte("\n"))
+			return fmt.Errorf("failed to parse configuration [%v]: line %d: %v", configFile, line, err)
+		}
+		return fmt.Errorf("failed to parse configuration [%v]: %v", configFile, err)
+	}
+	// type errors are reported with the others by checkConfigFields
+	if err := json.Unmarshal(body, srvCfg); err != nil {
+		if _, ok := err.(*json.UnmarshalTypeError); !ok {
+			return fmt.Errorf("failed to parse configuration [%v]: %v", configFile, err)
+		}
+	}
+	var errs ConfigErrors
+	checkConfigFields(rv.Type(), generic, "$", &errs)
+	cl.markFile(rv, generic, "", configFile)
+
+	for _, kv := range cl.Environ {
+		i := strings.Index(kv, "=")
+		if i < 0 || !strings.HasPrefix(kv, cl.EnvPrefix) {
+			continue
+		}
+		name, val := kv[:i], kv[i+1:]
+		tokens := strings.Split(strings.TrimPrefix(name, cl.EnvPrefix), "_")
+		fv, path, err := resolveConfigPath(rv, tokens, true)
+		if err != nil {
+			// the prefix is shared with other tools, just warn
+			mtlog.Warnf("Ignoring environment variable %v: %v", name, err)
+			continue
+		}
+		if err := setConfigValue(fv, val); err != nil {
+			return fmt.Errorf("environment variable %v: %v", name, err)
+		}
+		cl.sources[path] = ConfigSource{Path: path, Source: CONFIG_ENV, Origin: name}
+	}
+
+	for _, ov := range cl.Overrides {
+		i := strings.Index(ov, "=")
+		if i <= 0 {
+			return fmt.Errorf("-set %v: expected <path>=<value>", ov)
+		}
+		fv, path, err := resolveConfigPath(rv, strings.Split(ov[:i], "."), false)
+		if err != nil {
+			return fmt.Errorf("-set %v: %v", ov, err)
+		}
+		if err := setConfigValue(fv, ov[i+1:]); err != nil {
+			return fmt.Errorf("-set %v: %v", ov, err)
+		}
+		cl.sources[path] = ConfigSource{Path: path, Source: CONFIG_FLAG, Origin: "-set " + ov}
+	}
+
+	cl.leaves = nil
+	configLeaves(rv, "", &cl.leaves)
+
+	refs, secretErrs := resolveSecrets(srvCfg)
+	errs = append(errs, secretErrs...)
+	validateConfigValue(rv, "$", &errs)
+	if len(errs) != 0 {
+		return errs.sorted()
+	}
+	keepSecrets(refs)
+	return nil
+}
+
+// Read returns the configuration file as JSON: rendered when it is a
+// template, converted from its format and with its includes merged.
+func (cl *ConfigLoader) Read(configFile string) ([]byte, error) {
+	cl.files = nil
+	body, err := cl.Render(configFile)
+	if err != nil {
+		return nil, err
+	}
+	return cl.readConfig(configFile, body, nil)
+}
+
+// Render returns the configuration file, rendered when it is a template.
+func (cl *ConfigLoader) Render(configFile string) ([]byte, error) {
+	cl.files = append(cl.files, configFile)
+	if strings.HasSuffix(configFile, templateSuffix) {
+		if cl.Values != "" {
+			cl.files = append(cl.files, cl.Values)
+		}
+		return RenderConfig(configFile, cl.Values, cl.Environ)
+	}
+	body, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read configuration [%v]: %v", configFile, err)
+	}
+	return body, nil
+}
+
+// Files returns the files the last Read went through: the configuration,
+// the files it includes and the values file of the templates.
+func (cl *ConfigLoader) Files() []string {
+	var files []string
+	seen := make(map[string]bool)
+	for _, f := range cl.files {
+		if !seen[f] {
+			seen[f] = true
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+// Sources returns where every configuration value comes from,
+// sorted by path.
+func (cl *ConfigLoader) Sources() []ConfigSource {
+	srcs := make([]ConfigSource, 0, len(cl.leaves))
+	for _, path := range cl.leaves {
+		src, ok := cl.sources[path]
+		if !ok {
+			src = ConfigSource{Path: path, Source: CONFIG_DEFAULT}
+		}
+		srcs = append(srcs, src)
+	}
+	sort.Slice(srcs, func(a, b int) bool { return srcs[a].Path < srcs[b].Path })
+	return srcs
+}
+
+// Dump writes one "path source origin" line per configuration value.
+func (cl *ConfigLoader) Dump(w io.Writer) {
+	for _, src := range cl.Sources() {
+		fmt.Fprintf(w, "%-60s %-8s %s\n", src.Path, src.Source, src.Origin)
+	}
+}
+
+func joinConfigPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// configFieldName is the JSON name of the field, "" when not in JSON.
+func configFieldName(sf reflect.StructField) string {
+	if sf.PkgPath != "" {
+		return ""
+	}
+	tag := strings.Split(sf.Tag.Get("json"), ",")[0]
+	if tag == "-" {
+		return ""
+	}
+	if tag != "" {
+		return tag
+	}
+	return sf.Name
+}
+
+var commonConfigType = reflect.TypeOf(ServiceCommonConfig{})
+
+// resolveConfigPath walks tokens down rv, multi lets a field name
+// span several tokens as environment variables are split on '_'.
+func resolveConfigPath(rv reflect.Value, tokens []string, multi bool) (reflect.Value, string, error) {
+	path := ""
+	for len(tokens) != 0 {
+		switch {
+		case rv.Kind() == reflect.Struct:
+			fv, name, rest, ok := matchConfigField(rv, tokens, multi)
+			if !ok {
+				return rv, "", fmt.Errorf("no configuration field %v under %q", tokens[0], path)
+			}
+			rv, path, tokens = fv, joinConfigPath(path, name), rest
+
+		case rv.Kind() == reflect.Slice && rv.Type().Elem().Kind() == reflect.Struct:
+			idx := configElement(rv, tokens[0])
+			if idx < 0 {
+				return rv, "", fmt.Errorf("no element %v in %q", tokens[0], path)
+			}
+			rv, path, tokens = rv.Index(idx), joinConfigPath(path, strconv.Itoa(idx)), tokens[1:]
+
+		default:
+			return rv, "", fmt.Errorf("%q has no field %v", path, tokens[0])
+		}
+	}
+	if rv.Kind() == reflect.Struct || (rv.Kind() == reflect.Slice && rv.Type().Elem().Kind() == reflect.Struct) {
+		return rv, "", fmt.Errorf("%q is not a value", path)
+	}
+	return rv, path, nil
+}
+
+func matchConfigField(rv reflect.Value, tokens []string, multi bool) (reflect.Value, string, []string, bool) {
+	rt := rv.Type()
+	maxTokens := 1
+	if multi {
+		maxTokens = len(tokens)
+	}
+	for i := 0; i < rt.NumField(); i++ {
+		name := configFieldName(rt.Field(i))
+		if name == "" {
+			continue
+		}
+		for k := 1; k <= maxTokens; k++ {
+			if strings.EqualFold(strings.Join(tokens[:k], ""), name) {
+				return rv.Field(i), name, tokens[k:], true
+			}
+		}
+	}
+	// the ServiceCommonConfig level can be left out
+	for i := 0; i < rt.NumField(); i++ {
+		if name := configFieldName(rt.Field(i)); name != "" && rt.Field(i).Type == commonConfigType {
+			fv, sub, rest, ok := matchConfigField(rv.Field(i), tokens, multi)
+			if ok {
+				return fv, name + "." + sub, rest, true
+			}
+		}
+	}
+	return rv, "", tokens, false
+}
+
+// configElement finds a list element by index or by its Name field.
+func configElement(rv reflect.Value, token string) int {
+	if idx, err := strconv.Atoi(token); err == nil {
+		if idx >= 0 && idx < rv.Len() {
+			return idx
+		}
+		return -1
+	}
+	for i := 0; i < rv.Len(); i++ {
+		nf := rv.Index(i).FieldByName("Name")
+		if nf.IsValid() && nf.Kind() == reflect.String && strings.EqualFold(configEnvName(nf.String()), token) {
+			return i
+		}
+	}
+	return -1
+}
+
+// configEnvName maps a service name to what it looks like in an
+// environment variable, "zvault-1" is ZVAULT1.
+func configEnvName(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+func setConfigValue(fv reflect.Value, s string) error {
+	switch fv.Kind() {
+	case reflect.String:
+		fv.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		fv.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 0, fv.Type().Bits())
+		if err != nil {
+			return err
+		}
+		fv.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 0, fv.Type().Bits())
+		if err != nil {
+			return err
+		}
+		fv.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(s, fv.Type().Bits())
+		if err != nil {
+			return err
+		}
+		fv.SetFloat(n)
+	case reflect.Slice:
+		if fv.Type().Elem().Kind() == reflect.Struct {
+			return fmt.Errorf("cannot set a list of %v", fv.Type().Elem())
+		}
+		var parts []string
+		if s != "" {
+			parts = strings.Split(s, ",")
+		}
+		sl := reflect.MakeSlice(fv.Type(), len(parts), len(parts))
+		for i, p := range parts {
+			if err := setConfigValue(sl.Index(i), strings.TrimSpace(p)); err != nil {
+				return err
+			}
+		}
+		fv.Set(sl)
+	default:
+		return fmt.Errorf("unsupported type %v", fv.Type())
+	}
+	return nil
+}
+
+// markFile records the values present in the JSON file, keys are
+// matched the way encoding/json does.
+func (cl *ConfigLoader) markFile(rv reflect.Value, generic interface{}, path, file string) {
+	switch rv.Kind() {
+	case reflect.Struct:
+		obj, ok := generic.(map[string]interface{})
+		if !ok {
+			return
+		}
+		rt := rv.Type()
+		for key, gv := range obj {
+			for i := 0; i < rt.NumField(); i++ {
+				name := configFieldName(rt.Field(i))
+				if name != "" && strings.EqualFold(name, key) {
+					cl.markFile(rv.Field(i), gv, joinConfigPath(path, name), file)
+					break
+				}
+			}
+		}
+	case reflect.Slice:
+		if rv.Type().Elem().Kind() == reflect.Struct {
+			list, ok := generic.([]interface{})
+			if !ok {
+				return
+			}
+			for i := 0; i < len(list) && i < rv.Len(); i++ {
+				cl.markFile(rv.Index(i), list[i], joinConfigPath(path, strconv.Itoa(i)), file)
+			}
+			return
+		}
+		cl.sources[path] = ConfigSource{Path: path, Source: CONFIG_FILE, Origin: file}
+	default:
+		cl.sources[path] = ConfigSource{Path: path, Source: CONFIG_FILE, Origin: file}
+	}
+}
+
+// configLeaves lists the path of every value of the configuration.
+func configLeaves(rv reflect.Value, path string, leaves *[]string) {
+	switch {
+	case rv.Kind() == reflect.Struct:
+		rt := rv.Type()
+		for i := 0; i < rt.NumField(); i++ {
+			if name := configFieldName(rt.Field(i)); name != "" {
+				configLeaves(rv.Field(i), joinConfigPath(path, name), leaves)
+			}
+		}
+	case rv.Kind() == reflect.Slice && rv.Type().Elem().Kind() == reflect.Struct:
+		for i := 0; i < rv.Len(); i++ {
+			configLeaves(rv.Index(i), joinConfigPath(path, strconv.Itoa(i)), leaves)
+		}
+	case rv.Kind() == reflect.Interface, rv.Kind() == reflect.Func, rv.Kind() == reflect.Chan:
+	default:
+		*leaves = append(*leaves, path)
+	}
+}
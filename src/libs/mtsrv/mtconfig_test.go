@@ -0,0 +1,98 @@
+package mtsrv
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testServiceConfig struct {
+	ScCfg ServiceCommonConfig `json:"ServiceCommonConfig"`
+	SpCfg struct {
+		Simulate bool
+	} `json:"ServiceSpecificConfig"`
+}
+
+const testConfigJson = `{
+    "ServiceCommonConfig": {
+        "ServiceName": "helloworld",
+        "LogCfg": {"Level": 1},
+        "Services": [
+            {"Name": "cassandra", "Port": 9042, "Server": "localhost"},
+            {"Name": "kafka", "Port": 9092, "Server": "localhost", "Topics": ["TutorialTopic"]}
+        ]
+    }
+}`
+
+func writeTestConfig(t *testing.T, name, body string) string {
+	dir, err := ioutil.TempDir("", "mtsrv")
+	assert.Nil(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	file := filepath.Join(dir, name)
+	assert.Nil(t, ioutil.WriteFile(file, []byte(body), 0644))
+	return file
+}
+
+func TestConfigLoaderLayers(t *testing.T) {
+	file := writeTestConfig(t, "helloworld.json", testConfigJson)
+	cl := &ConfigLoader{
+		EnvPrefix: ConfigEnvPrefix,
+		Environ: []string{
+			"MT_LOGCFG_LEVEL=0",
+			"MT_SERVICES_KAFKA_PORT=9093",
+			"MT_SERVICES_KAFKA_TOPICS=a, b",
+			"MT_SERVICESPECIFICCONFIG_SIMULATE=true",
+			"MT_UNRELATED=1",
+			"PATH=/bin",
+		},
+		Overrides: []string{"Services.kafka.Port=9094", "ServiceCommonConfig.Services.0.Server=cass01"},
+	}
+	cfg := testServiceConfig{}
+	assert.Nil(t, cl.Load(file, &cfg))
+
+	assert.Equal(t, "helloworld", cfg.ScCfg.ServiceName)
+	assert.Equal(t, 0, int(cfg.ScCfg.LogCfg.Level))
+	assert.Equal(t, uint32(9094), cfg.ScCfg.Services[1].Port)
+	assert.Equal(t, []string{"a", "b"}, cfg.ScCfg.Services[1].Topics)
+	assert.Equal(t, "cass01", cfg.ScCfg.Services[0].Host)
+	assert.True(t, cfg.SpCfg.Simulate)
+
+	srcs := map[string]ConfigSource{}
+	for _, src := range cl.Sources() {
+		srcs[src.Path] = src
+	}
+	assert.Equal(t, CONFIG_FILE, srcs["ServiceCommonConfig.ServiceName"].Source)
+	assert.Equal(t, ConfigSource{Path: "ServiceCommonConfig.LogCfg.Level", Source: CONFIG_ENV,
+		Origin: "MT_LOGCFG_LEVEL"}, srcs["ServiceCommonConfig.LogCfg.Level"])
+	assert.Equal(t, CONFIG_FLAG, srcs["ServiceCommonConfig.Services.1.Port"].Source)
+	assert.Equal(t, CONFIG_DEFAULT, srcs["ServiceCommonConfig.Threads"].Source)
+
+	var out bytes.Buffer
+	cl.Dump(&out)
+	assert.Contains(t, out.String(), "MT_SERVICES_KAFKA_TOPICS")
+
+	cl.Environ = nil
+	cl.Overrides = []string{"Services.redis.Port=1"}
+	assert.NotNil(t, cl.Load(file, &testServiceConfig{}))
+	cl.Overrides = []string{"LogCfg.Level=high"}
+	assert.NotNil(t, cl.Load(file, &testServiceConfig{}))
+}
+
+func TestParseConfigCheckAndRender(t *testing.T) {
+	defer func() { cfgCheck, cfgRender = false, false }()
+	valid := writeTestConfig(t, "helloworld.json", `{"ServiceCommonConfig": {"ServiceName": "helloworld"}}`)
+	invalid := writeTestConfig(t, "invalid.json", `{"ServiceCommonConfig": {"Threads": -1}}`)
+
+	cfgCheck = true
+	assert.Equal(t, ErrConfigHandled, ParseConfig(valid, &testServiceConfig{}))
+	_, ok := ParseConfig(invalid, &testServiceConfig{}).(ConfigErrors)
+	assert.True(t, ok)
+
+	cfgCheck, cfgRender = false, true
+	assert.Equal(t, ErrConfigHandled, ParseConfig(valid, &testServiceConfig{}))
+	assert.NotNil(t, ParseConfig(valid+".missing", &testServiceConfig{}))
+}
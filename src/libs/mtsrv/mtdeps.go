@@ -0,0 +1,215 @@
+package mtsrv
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mtbox/mtlog"
+)
+
+// Services are started in dependency order: a service listing others
+// in DependsOn is started once all of them are ready, and stopped
+// before them. A service is ready when its dispatch function calls
+// SetReady or returns without error, so a dispatch function that keeps
+// running must call SetReady once it is up. It is not ready anymore
+// once its run fails, is restarted, stopped or removed, until SetReady
+// is called again.
+
+// serviceOrder sorts the services so that each one comes after its
+// dependencies, keeping the configuration order otherwise. Unknown
+// dependencies and cycles are errors.
+func serviceOrder(services []NetServices) ([]string, error) {
+	known := make(map[string]bool, len(services))
+	for _, cp := range services {
+		if known[cp.Name] {
+			return nil, fmt.Errorf("service %v is configured twice", cp.Name)
+		}
+		known[cp.Name] = true
+	}
+	for _, cp := range services {
+		for _, dep := range cp.DependsOn {
+			if dep == cp.Name {
+				return nil, fmt.Errorf("service %v depends on itself", cp.Name)
+			}
+			if !known[dep] {
+				return nil, fmt.Errorf("service %v depends on unknown service %v", cp.Name, dep)
+			}
+		}
+	}
+
+	placed := make(map[string]bool, len(services))
+	order := make([]string, 0, len(services))
+	for len(order) < len(services) {
+		progress := false
+		for _, cp := range services {
+			if placed[cp.Name] || !depsPlaced(cp, placed) {
+				continue
+			}
+			placed[cp.Name] = true
+			order = append(order, cp.Name)
+			progress = true
+		}
+		if !progress {
+			return nil, fmt.Errorf("services depend on each other: %v", serviceCycle(services, placed))
+		}
+	}
+	return order, nil
+}
+
+func depsPlaced(cp NetServices, placed map[string]bool) bool {
+	for _, dep := range cp.DependsOn {
+		if !placed[dep] {
+			return false
+		}
+	}
+	return true
+}
+
+// serviceCycle describes a cycle among the services not placed.
+func serviceCycle(services []NetServices, placed map[string]bool) string {
+	deps := make(map[string][]string)
+	var start string
+	for _, cp := range services {
+		if !placed[cp.Name] {
+			deps[cp.Name] = cp.DependsOn
+			if start == "" {
+				start = cp.Name
+			}
+		}
+	}
+	// every unplaced service has an unplaced dependency, walk them
+	// until a service shows up twice
+	seen := make(map[string]int)
+	var path []string
+	for name := start; ; {
+		if i, ok := seen[name]; ok {
+			return strings.Join(append(path[i:], name), " -> ")
+		}
+		seen[name] = len(path)
+		path = append(path, name)
+		for _, dep := range deps[name] {
+			if !placed[dep] {
+				name = dep
+				break
+			}
+		}
+	}
+}
+
+func reverseNames(names []string) []string {
+	out := make([]string, 0, len(names))
+	for i := len(names) - 1; i >= 0; i-- {
+		out = append(out, names[i])
+	}
+	return out
+}
+
+// validate the DependsOn of the Services list at path.
+func validateServiceDeps(services []NetServices, path string, errs *ConfigErrors) {
+	// duplicate names are reported by the unique rule
+	known := make(map[string]bool, len(services))
+	bad := false
+	for _, cp := range services {
+		bad = bad || known[cp.Name]
+		known[cp.Name] = true
+	}
+	for i, cp := range services {
+		for j, dep := range cp.DependsOn {
+			switch {
+			case dep == cp.Name:
+				errs.add(fmt.Sprintf("%s[%d].DependsOn[%d]", path, i, j), "service depends on itself")
+				bad = true
+			case !known[dep]:
+				errs.add(fmt.Sprintf("%s[%d].DependsOn[%d]", path, i, j), "unknown service %q", dep)
+				bad = true
+			}
+		}
+	}
+	if bad {
+		return
+	}
+	if _, err := serviceOrder(services); err != nil {
+		errs.add(path, "%v", err)
+	}
+}
+
+// SetReady tells the services depending on name that it is up.
+func (s *Server) SetReady(name string) {
+	s.Lock()
+	defer s.Unlock()
+	ch := s.readyChanLocked(name)
+	select {
+	case <-ch:
+	default:
+		mtlog.Infof("Service %v is ready", name)
+		close(ch)
+	}
+}
+
+// IsReady tells whether the service name is ready.
+func (s *Server) IsReady(name string) bool {
+	s.Lock()
+	defer s.Unlock()
+	select {
+	case <-s.readyChanLocked(name):
+		return true
+	default:
+		return false
+	}
+}
+
+// unready makes the service of run not ready, unless run was replaced
+// by a reload in the meantime.
+func (s *Server) unready(run *serviceRun) {
+	s.Lock()
+	defer s.Unlock()
+	if s.services[run.cfg.Name] == run {
+		s.unreadyLocked(run.cfg.Name)
+	}
+}
+
+// unreadyLocked re-arms the ready channel of name, the services
+// waiting for it keep waiting.
+func (s *Server) unreadyLocked(name string) {
+	select {
+	case <-s.readyChanLocked(name):
+		mtlog.Infof("Service %v is not ready anymore", name)
+		s.ready[name] = make(chan struct{})
+	default:
+	}
+}
+
+func (s *Server) readyChanLocked(name string) chan struct{} {
+	ch, ok := s.ready[name]
+	if !ok {
+		ch = make(chan struct{})
+		s.ready[name] = ch
+	}
+	return ch
+}
+
+// start cp once its dependencies are ready, unless the server shuts
+// down first.
+func (s *Server) startWhenReady(cp NetServices) {
+	for _, dep := range cp.DependsOn {
+		s.Lock()
+		ch := s.readyChanLocked(dep)
+		s.Unlock()
+		select {
+		case <-ch:
+			continue
+		default:
+		}
+		mtlog.Infof("Service %v waits for %v", cp.Name, dep)
+		select {
+		case <-ch:
+		case <-s.ctx.Done():
+			return
+		}
+	}
+	s.Lock()
+	defer s.Unlock()
+	if s.ctx.Err() == nil {
+		s.startServiceLocked(cp, nil)
+	}
+}
@@ -0,0 +1,98 @@
+package mtsrv
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServiceOrder(t *testing.T) {
+	order, err := serviceOrder([]NetServices{
+		{Name: "kafka", DependsOn: []string{"cassandra", "zvault"}},
+		{Name: "health"},
+		{Name: "cassandra", DependsOn: []string{"zvault"}},
+		{Name: "zvault"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"health", "zvault", "cassandra", "kafka"}, order)
+
+	_, err = serviceOrder([]NetServices{
+		{Name: "health"},
+		{Name: "kafka", DependsOn: []string{"cassandra"}},
+		{Name: "cassandra", DependsOn: []string{"kafka"}},
+	})
+	assert.EqualError(t, err, "services depend on each other: kafka -> cassandra -> kafka")
+
+	_, err = serviceOrder([]NetServices{{Name: "kafka", DependsOn: []string{"zookeeper"}}})
+	assert.EqualError(t, err, "service kafka depends on unknown service zookeeper")
+
+	file := writeTestConfig(t, "helloworld.json", `{
+    "ServiceCommonConfig": {
+        "Services": [
+            {"Name": "kafka", "DependsOn": ["cassandra", "zookeeper"]},
+            {"Name": "cassandra", "DependsOn": ["cassandra"]}
+        ]
+    }
+}`)
+	err = (&ConfigLoader{}).Load(file, &testServiceConfig{})
+	assert.Equal(t, ConfigErrors{
+		{"$.ServiceCommonConfig.Services[0].DependsOn[1]", "unknown service \"zookeeper\""},
+		{"$.ServiceCommonConfig.Services[1].DependsOn[0]", "service depends on itself"},
+	}, err)
+}
+
+func TestDependencyStartStop(t *testing.T) {
+	cfg := &ServiceCommonConfig{ServiceName: "helloworld", RootPath: t.TempDir(), ShutdownTimeout: 1,
+		Services: []NetServices{
+			{Name: "kafka", DependsOn: []string{"cassandra", "zvault"}},
+			{Name: "cassandra"},
+			{Name: "zvault"},
+		}}
+	srv := NewServer(cfg)
+
+	var mu sync.Mutex
+	var started, stopped []string
+	up := make(chan struct{})
+	disp := func(ctx context.Context, cp *NetServices, level int) error {
+		mu.Lock()
+		started = append(started, cp.Name)
+		mu.Unlock()
+		if cp.Name == "zvault" {
+			// ready only once unsealed
+			<-up
+		}
+		srv.SetReady(cp.Name)
+		<-ctx.Done()
+		mu.Lock()
+		stopped = append(stopped, cp.Name)
+		mu.Unlock()
+		return nil
+	}
+	codes := make(chan int)
+	go func() { codes <- srv.RunCommonLoop(cfg, disp) }()
+	time.Sleep(100 * time.Millisecond)
+
+	mu.Lock()
+	assert.ElementsMatch(t, []string{"cassandra", "zvault"}, started)
+	mu.Unlock()
+	assert.True(t, srv.IsReady("cassandra"))
+	assert.False(t, srv.IsReady("zvault"))
+	assert.False(t, srv.IsReady("kafka"))
+
+	close(up)
+	time.Sleep(100 * time.Millisecond)
+	assert.True(t, srv.IsReady("kafka"))
+
+	assert.Equal(t, EXIT_OK, srv.Shutdown())
+	assert.Equal(t, EXIT_OK, <-codes)
+	assert.Equal(t, "kafka", started[2])
+	assert.Equal(t, []string{"kafka", "zvault", "cassandra"}, stopped)
+
+	// a cycle starts nothing
+	cfg.Services[1].DependsOn = []string{"kafka"}
+	srv = NewServer(cfg)
+	assert.Equal(t, EXIT_CONFIG, srv.RunCommonLoop(cfg, disp))
+}
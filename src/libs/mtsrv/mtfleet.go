@@ -0,0 +1,281 @@
+package mtsrv
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mtbox/mtlog"
+)
+
+// A FleetAggregator follows the health reports the instances of the
+// fleet publish, see StatusEnvelope. An instance whose report is missing
+// for deadAfter intervals is declared dead, and alive again with its
+// next report. A dead instance is forgotten once it has been silent for
+// the retention. Every change is sent to the subscribers as a
+// FleetEvent. The Server given the aggregator with SetFleet sweeps it
+// every interval.
+
+// Fleet events.
+const (
+	FLEET_JOINED = "joined" // first report of an instance
+	FLEET_STATUS = "status" // the status of an instance changed
+	FLEET_DEAD   = "dead"   // no report for deadAfter intervals
+	FLEET_ALIVE  = "alive"  // report of an instance declared dead
+	FLEET_GONE   = "gone"   // dead instance silent for the retention
+
+	defaultFleetRetention = time.Hour
+)
+
+// FleetMember is the last report of an instance. Missed is the number of
+// intervals without a report.
+type FleetMember struct {
+	HostName        string
+	EnvName         string
+	ServiceName     string
+	ServiceInstance string
+	Status          SrvHealthStatusType
+	LastSeen        time.Time
+	Missed          int
+	Dead            bool
+}
+
+// FleetEvent is a change of a member.
+type FleetEvent struct {
+	Event  string
+	From   SrvHealthStatusType
+	Member FleetMember
+	Time   time.Time
+}
+
+// FleetView is the fleet served by the aggregator.
+type FleetView struct {
+	Alive   int
+	Dead    int
+	Members []FleetMember
+}
+
+// FleetAggregator tracks the instances of the fleet.
+type FleetAggregator struct {
+	sync.Mutex
+	interval  time.Duration
+	deadAfter int
+	retention time.Duration
+	members   map[string]*FleetMember
+	subs      map[int]func(FleetEvent)
+	nextSub   int
+}
+
+// NewFleetAggregator expects a report from each instance every interval
+// and declares it dead after deadAfter intervals without one.
+func NewFleetAggregator(interval time.Duration, deadAfter int) *FleetAggregator {
+	if deadAfter < 1 {
+		deadAfter = 1
+	}
+	return &FleetAggregator{
+		interval:  interval,
+		deadAfter: deadAfter,
+		retention: defaultFleetRetention,
+		members:   make(map[string]*FleetMember),
+		subs:      make(map[int]func(FleetEvent)),
+	}
+}
+
+// SetRetention sets how long a silent instance is kept, an hour by
+// default. It is kept at least until declared dead.
+func (fa *FleetAggregator) SetRetention(retention time.Duration) {
+	fa.Lock()
+	defer fa.Unlock()
+	fa.retention = retention
+}
+
+// Subscribe calls fn with every event. The returned function cancels the
+// subscription.
+func (fa *FleetAggregator) Subscribe(fn func(FleetEvent)) func() {
+	fa.Lock()
+	defer fa.Unlock()
+	id := fa.nextSub
+	fa.nextSub++
+	fa.subs[id] = fn
+	return func() {
+		fa.Lock()
+		defer fa.Unlock()
+		delete(fa.subs, id)
+	}
+}
+
+// Consume takes a health report message, a StatusEnvelope in JSON.
+func (fa *FleetAggregator) Consume(msg []byte) error {
+	env := &StatusEnvelope{}
+	if err := json.Unmarshal(msg, env); err != nil {
+		return fmt.Errorf("invalid health report: %v", err)
+	}
+	if env.ServiceName == "" {
+		return fmt.Errorf("health report without a service name")
+	}
+	fa.observe(env, time.Now())
+	return nil
+}
+
+// Name and Publish make the aggregator a StatusPublisher of the reports
+// of its own instance.
+func (fa *FleetAggregator) Name() string {
+	return "fleet"
+}
+
+func (fa *FleetAggregator) Publish(env *StatusEnvelope) error {
+	fa.observe(env, time.Now())
+	return nil
+}
+
+func memberKey(service, instance string) string {
+	return service + "/" + instance
+}
+
+func (fa *FleetAggregator) observe(env *StatusEnvelope, now time.Time) {
+	fa.Lock()
+	key := memberKey(env.ServiceName, env.ServiceInstance)
+	m := fa.members[key]
+	var event *FleetEvent
+	switch {
+	case m == nil:
+		m = &FleetMember{ServiceName: env.ServiceName, ServiceInstance: env.ServiceInstance, Status: env.Status}
+		fa.members[key] = m
+		event = &FleetEvent{Event: FLEET_JOINED, From: ServiceHealthStatus_HEALTH_UNK}
+	case m.Dead:
+		event = &FleetEvent{Event: FLEET_ALIVE, From: m.Status}
+	case m.Status != env.Status:
+		event = &FleetEvent{Event: FLEET_STATUS, From: m.Status}
+	}
+	m.HostName, m.EnvName, m.Status = env.HostName, env.EnvName, env.Status
+	m.LastSeen, m.Missed, m.Dead = now, 0, false
+
+	var events []FleetEvent
+	if event != nil {
+		event.Member, event.Time = *m, now
+		events = append(events, *event)
+	}
+	fa.emitLocked(events)
+}
+
+// Sweep counts the missed intervals, declares the silent instances dead
+// and forgets those silent for the retention, it is run every interval.
+func (fa *FleetAggregator) Sweep() {
+	fa.sweep(time.Now())
+}
+
+func (fa *FleetAggregator) sweep(now time.Time) {
+	fa.Lock()
+	if fa.interval <= 0 {
+		fa.Unlock()
+		return
+	}
+	var events []FleetEvent
+	for key, m := range fa.members {
+		m.Missed = int(now.Sub(m.LastSeen) / fa.interval)
+		if !m.Dead && m.Missed >= fa.deadAfter {
+			m.Dead = true
+			mtlog.Errorf("Instance %v of %v on %v declared dead, last seen %v", m.ServiceInstance, m.ServiceName,
+				m.HostName, m.LastSeen)
+			events = append(events, FleetEvent{Event: FLEET_DEAD, From: m.Status, Member: *m, Time: now})
+		} else if m.Dead && now.Sub(m.LastSeen) >= fa.retention {
+			delete(fa.members, key)
+			events = append(events, FleetEvent{Event: FLEET_GONE, From: m.Status, Member: *m, Time: now})
+		}
+	}
+	sort.Slice(events, func(a, b int) bool {
+		ma, mb := events[a].Member, events[b].Member
+		return memberKey(ma.ServiceName, ma.ServiceInstance) < memberKey(mb.ServiceName, mb.ServiceInstance)
+	})
+	fa.emitLocked(events)
+}
+
+// send events to the subscribers, fa is unlocked first.
+func (fa *FleetAggregator) emitLocked(events []FleetEvent) {
+	subs := make([]func(FleetEvent), 0, len(fa.subs))
+	for _, fn := range fa.subs {
+		subs = append(subs, fn)
+	}
+	fa.Unlock()
+	for _, e := range events {
+		for _, fn := range subs {
+			fn(e)
+		}
+	}
+}
+
+// Members returns the instances, sorted by service and instance.
+func (fa *FleetAggregator) Members() []FleetMember {
+	fa.Lock()
+	defer fa.Unlock()
+	members := make([]FleetMember, 0, len(fa.members))
+	for _, m := range fa.members {
+		members = append(members, *m)
+	}
+	sort.Slice(members, func(a, b int) bool {
+		return memberKey(members[a].ServiceName, members[a].ServiceInstance) <
+			memberKey(members[b].ServiceName, members[b].ServiceInstance)
+	})
+	return members
+}
+
+// View returns the fleet.
+func (fa *FleetAggregator) View() FleetView {
+	view := FleetView{Members: fa.Members()}
+	for _, m := range view.Members {
+		if m.Dead {
+			view.Dead++
+		} else {
+			view.Alive++
+		}
+	}
+	return view
+}
+
+// ServeHTTP serves the FleetView as JSON.
+func (fa *FleetAggregator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !adminGetOnly(w, r) {
+		return
+	}
+	writeAdminJson(w, http.StatusOK, fa.View())
+}
+
+// SetFleet serves fa on /fleet of the admin listener and sweeps it every
+// interval with the scheduler.
+func (s *Server) SetFleet(fa *FleetAggregator) {
+	s.Lock()
+	s.fleet = fa
+	s.Unlock()
+
+	s.sched.Unregister("fleetSweep")
+	if fa == nil || fa.interval <= 0 {
+		return
+	}
+	err := s.sched.Register(JobSpec{
+		Name:     "fleetSweep",
+		Interval: fa.interval,
+		Overlap:  OverlapSkip,
+		Fn: func(ctx context.Context) error {
+			fa.Sweep()
+			return nil
+		},
+	})
+	if err != nil {
+		mtlog.Errorf("Fleet is not swept: %v", err)
+	}
+}
+
+func (s *Server) serveFleet(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	fa := s.fleet
+	s.Unlock()
+	if fa == nil {
+		http.NotFound(w, r)
+		return
+	}
+	fa.ServeHTTP(w, r)
+}
@@ -0,0 +1,98 @@
+package mtsrv
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFleetAggregator(t *testing.T) {
+	fa := NewFleetAggregator(time.Minute, 3)
+	var events []string
+	unsubscribe := fa.Subscribe(func(e FleetEvent) {
+		events = append(events, e.Member.ServiceName+"/"+e.Member.ServiceInstance+" "+e.Event)
+	})
+
+	t0 := time.Now()
+	green := func(inst string) *StatusEnvelope {
+		return &StatusEnvelope{HostName: "vm" + inst, ServiceName: "helloworld", ServiceInstance: inst,
+			Status: ServiceHealthStatus_HEALTH_GREEN}
+	}
+	fa.observe(green("0"), t0)
+	fa.observe(green("1"), t0)
+	yellow := green("1")
+	yellow.Status = ServiceHealthStatus_HEALTH_YELLOW
+	fa.observe(yellow, t0.Add(time.Minute))
+	fa.observe(green("0"), t0.Add(2*time.Minute))
+	assert.Equal(t, []string{"helloworld/0 joined", "helloworld/1 joined", "helloworld/1 status"}, events)
+
+	// instance 1 missed 2 intervals, not dead yet
+	fa.sweep(t0.Add(3 * time.Minute))
+	assert.Equal(t, 3, len(events))
+	assert.Equal(t, 2, fa.Members()[1].Missed)
+
+	fa.sweep(t0.Add(4*time.Minute + time.Second))
+	assert.Equal(t, "helloworld/1 dead", events[3])
+	members := fa.Members()
+	assert.False(t, members[0].Dead)
+	assert.True(t, members[1].Dead)
+	assert.Equal(t, ServiceHealthStatus_HEALTH_YELLOW, members[1].Status)
+	// declared dead once
+	fa.sweep(t0.Add(4*time.Minute + 30*time.Second))
+	assert.Equal(t, 4, len(events))
+
+	body, err := json.Marshal(green("1"))
+	assert.Nil(t, err)
+	assert.Nil(t, fa.Consume(body))
+	assert.Equal(t, "helloworld/1 alive", events[4])
+	assert.NotNil(t, fa.Consume([]byte("{")))
+	assert.NotNil(t, fa.Consume([]byte("{}")))
+
+	unsubscribe()
+	fa.sweep(t0.Add(time.Hour))
+	assert.Equal(t, 5, len(events))
+	view := fa.View()
+	assert.Equal(t, 0, view.Alive)
+	assert.Equal(t, 2, view.Dead)
+
+	// forgotten after the retention
+	fa.Subscribe(func(e FleetEvent) {
+		events = append(events, e.Member.ServiceName+"/"+e.Member.ServiceInstance+" "+e.Event)
+	})
+	fa.SetRetention(2 * time.Hour)
+	fa.sweep(t0.Add(2*time.Hour + time.Minute))
+	assert.Equal(t, []string{"helloworld/1 gone"}, events[5:])
+	assert.Equal(t, 1, len(fa.Members()))
+	fa.sweep(t0.Add(3 * time.Hour))
+	assert.Equal(t, []string{"helloworld/1 gone", "helloworld/0 gone"}, events[5:])
+	assert.Equal(t, 0, len(fa.Members()))
+}
+
+func TestFleetEndpoint(t *testing.T) {
+	srv := NewServer(&ServiceCommonConfig{ServiceName: "helloworld"})
+	ts := httptest.NewServer(srv.AdminHandler())
+	defer ts.Close()
+	assert.Equal(t, http.StatusNotFound, adminGet(t, ts.URL, "/fleet", nil))
+
+	fa := NewFleetAggregator(time.Minute, 3)
+	srv.SetFleet(fa)
+	srv.AddStatusPublisher(fa)
+	hCtx := &Health{name: "helloworld"}
+	srv.RegisterHealth(hCtx)
+	srv.PublishStatus(hCtx, srv.statusPublishers())
+
+	var view FleetView
+	assert.Equal(t, http.StatusOK, adminGet(t, ts.URL, "/fleet", &view))
+	assert.Equal(t, 1, view.Alive)
+	assert.Equal(t, "helloworld", view.Members[0].ServiceName)
+	assert.Equal(t, "0", view.Members[0].ServiceInstance)
+
+	// swept by the scheduler
+	assert.Equal(t, "fleetSweep", srv.Scheduler().Status()[0].Name)
+	srv.SetFleet(nil)
+	assert.Equal(t, 0, len(srv.Scheduler().Status()))
+}
@@ -1,8 +1,10 @@
 package mtsrv
 
 import (
+	"context"
 	"fmt"
 	"net"
+	"sync"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/reflection"
@@ -11,7 +13,7 @@ import (
 func GrpcServer(port string, fn func(*grpc.Server)) error {
 	lis, err := net.Listen("tcp", port)
 	if err != nil {
-		fmt.Errorf("failed to listen: %v", err)
+		return fmt.Errorf("failed to listen: %v", err)
 	}
 	s := grpc.NewServer()
 
@@ -26,3 +28,64 @@ func GrpcServer(port string, fn func(*grpc.Server)) error {
 
 	return fmt.Errorf("returned from listener")
 }
+
+// grpcHandler serves a grpc server on the address of the service.
+type grpcHandler struct {
+	sync.Mutex
+	addr    string
+	grpcSrv *grpc.Server
+	err     error
+}
+
+// GrpcHandler is the factory of a service serving a grpc server on its
+// Server:Port address, fn registers the grpc services like for
+// GrpcServer.
+func GrpcHandler(fn func(*grpc.Server)) ServiceHandlerFactory {
+	return func(srv *Server, cp *NetServices) (ServiceHandler, error) {
+		s := grpc.NewServer()
+		fn(s)
+		reflection.Register(s)
+		return &grpcHandler{addr: cp.ServiceAddr(), grpcSrv: s}, nil
+	}
+}
+
+func (h *grpcHandler) Start(ctx context.Context) error {
+	lis, err := net.Listen("tcp", h.addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen: %v", err)
+	}
+	go func() {
+		if err := h.grpcSrv.Serve(lis); err != nil {
+			h.Lock()
+			h.err = fmt.Errorf("failed to serve: %v", err)
+			h.Unlock()
+		}
+	}()
+	return nil
+}
+
+// Stop lets the pending calls finish until ctx expires.
+func (h *grpcHandler) Stop(ctx context.Context) error {
+	stopped := make(chan struct{})
+	go func() {
+		h.grpcSrv.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		h.grpcSrv.Stop()
+		return ctx.Err()
+	}
+}
+
+func (h *grpcHandler) Ready() bool {
+	return h.Health() == nil
+}
+
+func (h *grpcHandler) Health() error {
+	h.Lock()
+	defer h.Unlock()
+	return h.err
+}
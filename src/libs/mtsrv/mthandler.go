@@ -0,0 +1,290 @@
+package mtsrv
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mtbox/mtlog"
+)
+
+// A NetServices entry with a Kind is run by the ServiceHandler the
+// factory registered for that kind creates, the entries without one by
+// the dispatch function given to RunCommonLoop. Unknown kinds stop the
+// server at startup and make a configuration reload fail.
+//
+// The health and metrics kinds are registered by mtsrv, HTTPHandler and
+// GrpcHandler make factories for the http and grpc servers of a service.
+
+// ServiceHandler runs one service.
+type ServiceHandler interface {
+	// Start returns once the service is started, ctx is cancelled
+	// when it is stopped and may be kept for the goroutines it starts.
+	// An error is a failure, see RestartPolicy.
+	Start(ctx context.Context) error
+	// Stop stops the service, ctx expires after ShutdownTimeout.
+	Stop(ctx context.Context) error
+	// Ready tells whether the services depending on it can start, it
+	// is a failure when it is still false after ServiceReadyTimeout.
+	Ready() bool
+	// Health is nil when the service works, an error once the service
+	// started is a failure: it is stopped and restarted as its
+	// RestartPolicy says.
+	Health() error
+}
+
+// ServiceHandlerFactory creates the handler of a service, for every run
+// of the service.
+type ServiceHandlerFactory func(srv *Server, cp *NetServices) (ServiceHandler, error)
+
+var (
+	// how often the readiness and health of a started handler are checked
+	serviceReadyInterval = 100 * time.Millisecond
+	// how long a started handler is given to be ready
+	ServiceReadyTimeout = time.Minute
+)
+
+var serviceHandlers = struct {
+	sync.Mutex
+	factories map[string]ServiceHandlerFactory
+}{
+	factories: map[string]ServiceHandlerFactory{
+		"health":  NewHealthHandler,
+		"metrics": newMetricsHandler,
+	},
+}
+
+// RegisterServiceHandler adds or replaces the factory of kind, a nil
+// factory removes it.
+func RegisterServiceHandler(kind string, factory ServiceHandlerFactory) {
+	serviceHandlers.Lock()
+	defer serviceHandlers.Unlock()
+	if factory == nil {
+		delete(serviceHandlers.factories, kind)
+		return
+	}
+	serviceHandlers.factories[kind] = factory
+}
+
+func serviceHandlerFactory(kind string) (ServiceHandlerFactory, bool) {
+	serviceHandlers.Lock()
+	defer serviceHandlers.Unlock()
+	factory, ok := serviceHandlers.factories[kind]
+	return factory, ok
+}
+
+func serviceKinds() []string {
+	serviceHandlers.Lock()
+	defer serviceHandlers.Unlock()
+	kinds := make([]string, 0, len(serviceHandlers.factories))
+	for kind := range serviceHandlers.factories {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+// checkServiceKinds reports the services that cannot run, withDisp
+// tells whether there is a dispatch function for those without a Kind.
+func checkServiceKinds(services []NetServices, withDisp bool) error {
+	for _, cp := range services {
+		if cp.Kind == "" {
+			if !withDisp {
+				return fmt.Errorf("service %v has no Kind", cp.Name)
+			}
+			continue
+		}
+		if _, ok := serviceHandlerFactory(cp.Kind); !ok {
+			return fmt.Errorf("service %v is of unknown kind %q, known kinds are %v",
+				cp.Name, cp.Kind, serviceKinds())
+		}
+	}
+	return nil
+}
+
+// serviceDispatch runs the handler of cp.Kind, or disp for the services
+// without a Kind.
+func (s *Server) serviceDispatch(disp ServiceDispatchFunc) ServiceDispatchFunc {
+	return func(ctx context.Context, cp *NetServices, logLevel int) error {
+		if cp.Kind == "" {
+			if disp == nil {
+				return fmt.Errorf("service %v has no Kind", cp.Name)
+			}
+			return disp(ctx, cp, logLevel)
+		}
+		factory, ok := serviceHandlerFactory(cp.Kind)
+		if !ok {
+			return fmt.Errorf("service %v is of unknown kind %q", cp.Name, cp.Kind)
+		}
+		return s.runHandler(ctx, cp, factory)
+	}
+}
+
+// runHandler starts the handler, marks the service ready once the
+// handler is and stops it when ctx is cancelled or the handler failed,
+// the failure is returned for the supervisor.
+func (s *Server) runHandler(ctx context.Context, cp *NetServices, factory ServiceHandlerFactory) error {
+	h, err := factory(s, cp)
+	if err != nil {
+		return err
+	}
+	if err := h.Start(ctx); err != nil {
+		return err
+	}
+	s.Lock()
+	s.handlers[cp.Name] = h
+	s.Unlock()
+	defer func() {
+		s.Lock()
+		if s.handlers[cp.Name] == h {
+			delete(s.handlers, cp.Name)
+		}
+		s.Unlock()
+	}()
+
+	err = s.watchHandler(ctx, cp.Name, h)
+
+	stopCtx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout())
+	defer cancel()
+	if err := h.Stop(stopCtx); err != nil {
+		mtlog.Errorf("Service %v did not stop cleanly: %v", cp.Name, err)
+	}
+	return err
+}
+
+// watchHandler marks the service ready once h is, it returns nil when
+// ctx is cancelled and an error when h fails or is not ready in time.
+func (s *Server) watchHandler(ctx context.Context, name string, h ServiceHandler) error {
+	ticker := time.NewTicker(serviceReadyInterval)
+	defer ticker.Stop()
+	readyBy := time.Now().Add(ServiceReadyTimeout)
+	ready := false
+	for {
+		if err := h.Health(); err != nil {
+			return err
+		}
+		if !ready {
+			if h.Ready() {
+				ready = true
+				s.SetReady(name)
+			} else if time.Now().After(readyBy) {
+				return fmt.Errorf("not ready within %v", ServiceReadyTimeout)
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// ServiceHealth is the Health of the handler running the service name,
+// nil for a service run by the dispatch function.
+func (s *Server) ServiceHealth(name string) error {
+	s.Lock()
+	h, ok := s.handlers[name]
+	s.Unlock()
+	if !ok {
+		return nil
+	}
+	return h.Health()
+}
+
+// the health kind registers the process metrics, see RegisterHealth.
+// Its report is published every Frequency seconds, see publishStatus.
+// A restart keeps the Health of the server, with its checks, checkers
+// and history.
+type healthHandler struct {
+	srv       *Server
+	name      string
+	frequency uint64
+}
+
+// NewHealthHandler is the factory of the health kind, for handlers
+// adding to it.
+func NewHealthHandler(srv *Server, cp *NetServices) (ServiceHandler, error) {
+	name := cp.Name
+	if srv.cfg != nil && srv.cfg.ServiceName != "" {
+		name = srv.cfg.ServiceName
+	}
+	return &healthHandler{srv: srv, name: name, frequency: cp.Frequency}, nil
+}
+
+func (h *healthHandler) Start(ctx context.Context) error {
+	hCtx := h.srv.healthCtx()
+	if hCtx == nil {
+		var err error
+		if hCtx, err = NewHealthSrvs(h.name); err != nil {
+			return err
+		}
+	}
+	mtlog.Info("Starting health monitoring service")
+	h.srv.RegisterHealth(hCtx)
+	hCtx.SetReportInterval(time.Duration(h.frequency) * time.Second)
+	if h.frequency > 0 {
+		go h.srv.publishStatus(ctx, hCtx, time.Duration(h.frequency)*time.Second)
+	}
+	return nil
+}
+
+func (h *healthHandler) Stop(ctx context.Context) error { return nil }
+func (h *healthHandler) Ready() bool                    { return true }
+func (h *healthHandler) Health() error                  { return nil }
+
+// httpHandler serves an http.Handler on the address of the service.
+type httpHandler struct {
+	sync.Mutex
+	httpSrv *http.Server
+	err     error
+}
+
+// HTTPHandler is the factory of a service serving handler on its
+// Server:Port address.
+func HTTPHandler(handler http.Handler) ServiceHandlerFactory {
+	return func(srv *Server, cp *NetServices) (ServiceHandler, error) {
+		return &httpHandler{httpSrv: &http.Server{Addr: cp.ServiceAddr(), Handler: handler}}, nil
+	}
+}
+
+// the metrics kind serves the registry on /metrics, like
+// Metrics.HttpAddr.
+func newMetricsHandler(srv *Server, cp *NetServices) (ServiceHandler, error) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", srv.MetricsHandler())
+	return HTTPHandler(mux)(srv, cp)
+}
+
+func (h *httpHandler) Start(ctx context.Context) error {
+	lis, err := net.Listen("tcp", h.httpSrv.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen: %v", err)
+	}
+	mtlog.Infof("Serving http on %v", lis.Addr())
+	go func() {
+		if err := h.httpSrv.Serve(lis); err != nil && err != http.ErrServerClosed {
+			h.Lock()
+			h.err = err
+			h.Unlock()
+		}
+	}()
+	return nil
+}
+
+func (h *httpHandler) Stop(ctx context.Context) error {
+	return h.httpSrv.Shutdown(ctx)
+}
+
+func (h *httpHandler) Ready() bool {
+	return h.Health() == nil
+}
+
+func (h *httpHandler) Health() error {
+	h.Lock()
+	defer h.Unlock()
+	return h.err
+}
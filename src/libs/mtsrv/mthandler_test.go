@@ -0,0 +1,175 @@
+package mtsrv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testHandler struct {
+	sync.Mutex
+	name    string
+	ready   bool
+	health  error
+	events  *[]string
+	eventMu *sync.Mutex
+}
+
+func (h *testHandler) record(event string) {
+	h.eventMu.Lock()
+	*h.events = append(*h.events, h.name+" "+event)
+	h.eventMu.Unlock()
+}
+
+func (h *testHandler) Start(ctx context.Context) error {
+	h.record("start")
+	return nil
+}
+
+func (h *testHandler) Stop(ctx context.Context) error {
+	h.record("stop")
+	return nil
+}
+
+func (h *testHandler) Ready() bool {
+	h.Lock()
+	defer h.Unlock()
+	return h.ready
+}
+
+func (h *testHandler) Health() error {
+	h.Lock()
+	defer h.Unlock()
+	return h.health
+}
+
+func TestServiceHandlers(t *testing.T) {
+	var mu sync.Mutex
+	var events []string
+	handlers := make(map[string]*testHandler)
+	RegisterServiceHandler("test", func(srv *Server, cp *NetServices) (ServiceHandler, error) {
+		// cassandra is made ready by the test
+		h := &testHandler{name: cp.Name, ready: cp.Name != "cassandra", events: &events, eventMu: &mu}
+		mu.Lock()
+		handlers[cp.Name] = h
+		mu.Unlock()
+		return h, nil
+	})
+	defer RegisterServiceHandler("test", nil)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	port := lis.Addr().(*net.TCPAddr).Port
+	lis.Close()
+
+	cfg := &ServiceCommonConfig{ServiceName: "helloworld", RootPath: t.TempDir(), ShutdownTimeout: 1,
+		Services: []NetServices{
+			{Name: "kafka", Kind: "test", DependsOn: []string{"cassandra"}, Restart: RestartPolicy{Backoff: "10ms"}},
+			{Name: "cassandra", Kind: "test"},
+			{Name: "metrics", Kind: "metrics", Host: "127.0.0.1", Port: uint32(port)},
+		}}
+	srv := NewServer(cfg)
+	codes := make(chan int)
+	go func() { codes <- srv.RunCommonLoop(cfg, nil) }()
+	time.Sleep(150 * time.Millisecond)
+
+	mu.Lock()
+	assert.Equal(t, []string{"cassandra start"}, events)
+	cassandra := handlers["cassandra"]
+	mu.Unlock()
+	assert.False(t, srv.IsReady("cassandra"))
+	assert.True(t, srv.IsReady("metrics"))
+
+	cassandra.Lock()
+	cassandra.ready = true
+	cassandra.Unlock()
+	time.Sleep(250 * time.Millisecond)
+	assert.True(t, srv.IsReady("kafka"))
+	assert.Nil(t, srv.ServiceHealth("cassandra"))
+	assert.Nil(t, srv.ServiceHealth("kafka"))
+
+	// a failed handler is stopped and restarted
+	mu.Lock()
+	kafka := handlers["kafka"]
+	mu.Unlock()
+	kafka.Lock()
+	kafka.health = errors.New("broker lost")
+	kafka.Unlock()
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return handlers["kafka"] != kafka && len(events) == 4
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 1, srv.FailedServices())
+	assert.Equal(t, 0, srv.CrashedServices())
+
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/metrics", port))
+	if assert.Nil(t, err) {
+		_, err = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	assert.Equal(t, EXIT_OK, srv.Shutdown())
+	assert.Equal(t, EXIT_OK, <-codes)
+	assert.Equal(t, []string{"cassandra start", "kafka start", "kafka stop", "kafka start", "kafka stop",
+		"cassandra stop"}, events)
+	assert.Nil(t, srv.ServiceHealth("cassandra"))
+
+	// a handler never ready fails
+	saved := ServiceReadyTimeout
+	ServiceReadyTimeout = 50 * time.Millisecond
+	defer func() { ServiceReadyTimeout = saved }()
+	events = nil
+	cfg.Services = []NetServices{{Name: "cassandra", Kind: "test", Restart: RestartPolicy{Policy: RESTART_NEVER}}}
+	srv = NewServer(cfg)
+	go func() { codes <- srv.RunCommonLoop(cfg, nil) }()
+	assert.Eventually(t, func() bool { return srv.FailedServices() == 1 }, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, EXIT_OK, srv.Shutdown())
+	assert.Equal(t, EXIT_OK, <-codes)
+	assert.Equal(t, []string{"cassandra start", "cassandra stop"}, events)
+
+	// unknown kinds and services without a Kind fail at startup
+	cfg.Services = []NetServices{{Name: "kafka", Kind: "kafak"}}
+	assert.Equal(t, EXIT_CONFIG, NewServer(cfg).RunCommonLoop(cfg, nil))
+	assert.Contains(t, checkServiceKinds(cfg.Services, true).Error(), `unknown kind "kafak"`)
+	cfg.Services = []NetServices{{Name: "kafka"}}
+	assert.Equal(t, EXIT_CONFIG, NewServer(cfg).RunCommonLoop(cfg, nil))
+}
+
+func TestHealthHandlerRestart(t *testing.T) {
+	cfg := &ServiceCommonConfig{ServiceName: "helloworld", RootPath: t.TempDir()}
+	srv := NewServer(cfg)
+	h, err := NewHealthHandler(srv, &NetServices{Name: "health", Kind: "health"})
+	assert.Nil(t, err)
+	assert.Nil(t, h.Start(context.Background()))
+	hCtx := srv.healthCtx()
+	checker := &countingChecker{}
+	hCtx.RegisterChecker(checker, CheckerOptions{Interval: 10 * time.Millisecond})
+	hCtx.SetHysteresis(HealthHistoryConfig{FailThreshold: 1})
+	hCtx.observe("database cassandra", CONNECTED, time.Now().Add(-time.Minute))
+	hCtx.observe("database cassandra", FAILED, time.Now())
+
+	// the checkers registered before a restart are still run and probed
+	assert.Nil(t, h.Stop(context.Background()))
+	assert.Nil(t, h.Start(context.Background()))
+	assert.True(t, hCtx == srv.healthCtx())
+	checker.set(0, fmt.Errorf("disk gone"))
+	srv.Scheduler().Start()
+	defer srv.Scheduler().Stop()
+	assert.Eventually(t, func() bool {
+		return srv.Readiness().Status == ServiceHealthStatus_HEALTH_RED
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 1, len(srv.healthCtx().CheckerStatus()))
+	// and so is the history
+	assert.Equal(t, 1, len(srv.healthCtx().StatusHistory()))
+}
@@ -0,0 +1,261 @@
+package mtsrv
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Health keeps the transitions of the brief status and of each
+// peripheral, so that the report tells how long a state lasted and the
+// uptime over the last minutes, hour and day. The state of a peripheral
+// changes only after FailThreshold failing reports in a row, and
+// recovers after RecoverThreshold healthy ones, a single error does not
+// make a peripheral flap. With a report interval set, the details asked
+// for more often do not count as more reports. The brief status follows
+// the filtered peripherals and the checks as they are, it is the
+// readiness of the same report.
+
+const (
+	defaultFailThreshold    = 3
+	defaultRecoverThreshold = 2
+	defaultMaxTransitions   = 100
+)
+
+// subject of the brief status in the history.
+const HISTORY_SERVICE = "service"
+
+// windows of the uptime in a StateSummary.
+var uptimeWindows = []struct {
+	name   string
+	window time.Duration
+}{
+	{"5m", 5 * time.Minute},
+	{"1h", time.Hour},
+	{"24h", 24 * time.Hour},
+}
+
+// HealthHistoryConfig sets the hysteresis and the size of the history,
+// the defaults are 3 failures, 2 recoveries and 100 transitions per
+// subject.
+type HealthHistoryConfig struct {
+	FailThreshold    int `json:"FailThreshold" validate:"min=0"`
+	RecoverThreshold int `json:"RecoverThreshold" validate:"min=0"`
+	MaxTransitions   int `json:"MaxTransitions" validate:"min=0"`
+}
+
+// StatusTransition is a change of state of the service or of a
+// peripheral, like "transport kafka".
+type StatusTransition struct {
+	Subject string
+	From    string
+	To      string
+	At      time.Time
+}
+
+// StateSummary is the current state of a subject, how long it lasted and
+// the percentage of time it was up in each window.
+type StateSummary struct {
+	Subject     string
+	State       string
+	Since       time.Time
+	TimeInState string
+	Uptime      map[string]float64
+}
+
+// the state of a subject, status is a SrvHealthStatusType or a
+// PeripheralStatusType.
+type stateTracker struct {
+	status      fmt.Stringer
+	since       time.Time
+	first       time.Time
+	streak      int
+	counted     time.Time // the last observation counted in the streak
+	transitions []StatusTransition
+}
+
+// SetHysteresis sets the failing reports before a state gets worse and
+// the healthy ones before it recovers, 0 keeps the default.
+func (hCtx *Health) SetHysteresis(cfg HealthHistoryConfig) {
+	hCtx.Lock()
+	defer hCtx.Unlock()
+	hCtx.history = cfg
+}
+
+// healthy states, any other counts as a failure.
+func statusHealthy(st fmt.Stringer) bool {
+	return st == ServiceHealthStatus_HEALTH_GREEN || st == CONNECTED
+}
+
+// SetReportInterval counts the observations of a peripheral once per
+// interval, the health report frequency, 0 counts them all.
+func (hCtx *Health) SetReportInterval(interval time.Duration) {
+	hCtx.Lock()
+	defer hCtx.Unlock()
+	hCtx.reportInterval = interval
+}
+
+func thresholdOr(n, def int) int {
+	if n <= 0 {
+		return def
+	}
+	return n
+}
+
+// observe the status of subject and return its state after hysteresis.
+func (hCtx *Health) observe(subject string, status fmt.Stringer, at time.Time) fmt.Stringer {
+	return hCtx.track(subject, status, at, true)
+}
+
+// record the status of subject in the history, without hysteresis.
+func (hCtx *Health) record(subject string, status fmt.Stringer, at time.Time) fmt.Stringer {
+	return hCtx.track(subject, status, at, false)
+}
+
+func (hCtx *Health) track(subject string, status fmt.Stringer, at time.Time, hysteresis bool) fmt.Stringer {
+	hCtx.Lock()
+	defer hCtx.Unlock()
+	if hCtx.states == nil {
+		hCtx.states = make(map[string]*stateTracker)
+	}
+	tr := hCtx.states[subject]
+	if tr == nil {
+		hCtx.states[subject] = &stateTracker{status: status, since: at, first: at, counted: at}
+		return status
+	}
+	// asked again within the same report, with some slack for the timer
+	if hysteresis && hCtx.reportInterval > 0 && at.Sub(tr.counted) < hCtx.reportInterval/2 {
+		return tr.status
+	}
+	tr.counted = at
+	if status == tr.status {
+		tr.streak = 0
+		return tr.status
+	}
+
+	threshold := 1
+	switch {
+	case !hysteresis:
+	case statusHealthy(status):
+		threshold = thresholdOr(hCtx.history.RecoverThreshold, defaultRecoverThreshold)
+	case statusHealthy(tr.status):
+		threshold = thresholdOr(hCtx.history.FailThreshold, defaultFailThreshold)
+	}
+	if tr.streak++; tr.streak < threshold {
+		return tr.status
+	}
+
+	tr.transitions = append(tr.transitions, StatusTransition{Subject: subject,
+		From: tr.status.String(), To: status.String(), At: at})
+	if max := thresholdOr(hCtx.history.MaxTransitions, defaultMaxTransitions); len(tr.transitions) > max {
+		tr.transitions = tr.transitions[len(tr.transitions)-max:]
+	}
+	tr.status, tr.since, tr.streak = status, at, 0
+	return status
+}
+
+// observe a peripheral, its status is replaced by the state.
+func (hCtx *Health) observePeripheral(subject string, status PeripheralStatusType) PeripheralStatusType {
+	return hCtx.observe(subject, status, time.Now()).(PeripheralStatusType)
+}
+
+// StatusHistory returns the transitions of every subject, oldest first.
+func (hCtx *Health) StatusHistory() []StatusTransition {
+	hCtx.Lock()
+	defer hCtx.Unlock()
+	var history []StatusTransition
+	for _, tr := range hCtx.states {
+		history = append(history, tr.transitions...)
+	}
+	sort.SliceStable(history, func(a, b int) bool {
+		if !history[a].At.Equal(history[b].At) {
+			return history[a].At.Before(history[b].At)
+		}
+		return history[a].Subject < history[b].Subject
+	})
+	return history
+}
+
+// StateSummaries returns the state of every subject, sorted by subject.
+func (hCtx *Health) StateSummaries() []StateSummary {
+	return hCtx.stateSummaries(time.Now())
+}
+
+func (hCtx *Health) stateSummaries(now time.Time) []StateSummary {
+	hCtx.Lock()
+	defer hCtx.Unlock()
+	summaries := make([]StateSummary, 0, len(hCtx.states))
+	for subject, tr := range hCtx.states {
+		summ := StateSummary{
+			Subject:     subject,
+			State:       tr.status.String(),
+			Since:       tr.since,
+			TimeInState: now.Sub(tr.since).String(),
+			Uptime:      make(map[string]float64),
+		}
+		for _, w := range uptimeWindows {
+			summ.Uptime[w.name] = tr.uptime(now, w.window)
+		}
+		summaries = append(summaries, summ)
+	}
+	sort.Slice(summaries, func(a, b int) bool { return summaries[a].Subject < summaries[b].Subject })
+	return summaries
+}
+
+// Uptime returns the percentage of the last window subject was up, 0
+// when it was never observed.
+func (hCtx *Health) Uptime(subject string, window time.Duration) float64 {
+	hCtx.Lock()
+	defer hCtx.Unlock()
+	if tr := hCtx.states[subject]; tr != nil {
+		return tr.uptime(time.Now(), window)
+	}
+	return 0
+}
+
+// the percentage of the window, since the first observation, spent in a
+// state that is up. Before the oldest transition kept, the subject is
+// taken to be in its From state.
+func (tr *stateTracker) uptime(now time.Time, window time.Duration) float64 {
+	start := now.Add(-window)
+	if start.Before(tr.first) {
+		start = tr.first
+	}
+	total := now.Sub(start)
+	if total <= 0 {
+		if stateUp(tr.status.String()) {
+			return 100
+		}
+		return 0
+	}
+
+	var up time.Duration
+	end, state := now, tr.status.String()
+	for i := len(tr.transitions) - 1; i >= 0 && end.After(start); i-- {
+		t := tr.transitions[i]
+		from := t.At
+		if from.Before(start) {
+			from = start
+		}
+		if stateUp(state) && end.After(from) {
+			up += end.Sub(from)
+		}
+		end, state = t.At, t.From
+	}
+	if end.After(start) && stateUp(state) {
+		up += end.Sub(start)
+	}
+	return 100 * float64(up) / float64(total)
+}
+
+// states counted in the uptime, a degraded service is up, a transport
+// reconnecting is not.
+func stateUp(name string) bool {
+	for _, st := range []fmt.Stringer{ServiceHealthStatus_HEALTH_GREEN, ServiceHealthStatus_HEALTH_YELLOW,
+		CONNECTED} {
+		if name == st.String() {
+			return true
+		}
+	}
+	return false
+}
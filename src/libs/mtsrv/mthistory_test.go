@@ -0,0 +1,129 @@
+package mtsrv
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mtbox/metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatusHysteresis(t *testing.T) {
+	hCtx := &Health{name: "helloworld"}
+	hCtx.SetHysteresis(HealthHistoryConfig{FailThreshold: 2, RecoverThreshold: 2})
+	t0 := time.Now().Add(-time.Hour)
+	at := func(min int) time.Time { return t0.Add(time.Duration(min) * time.Minute) }
+
+	statuses := []SrvHealthStatusType{
+		ServiceHealthStatus_HEALTH_GREEN,
+		ServiceHealthStatus_HEALTH_YELLOW, // one failure is ignored
+		ServiceHealthStatus_HEALTH_GREEN,
+		ServiceHealthStatus_HEALTH_YELLOW,
+		ServiceHealthStatus_HEALTH_RED, // second failure in a row
+		ServiceHealthStatus_HEALTH_YELLOW,
+		ServiceHealthStatus_HEALTH_GREEN,
+		ServiceHealthStatus_HEALTH_GREEN, // recovered
+	}
+	var states []string
+	for i, st := range statuses {
+		states = append(states, hCtx.observe(HISTORY_SERVICE, st, at(10*i)).String())
+	}
+	assert.Equal(t, []string{"GREEN", "GREEN", "GREEN", "GREEN", "RED", "YELLOW", "YELLOW", "GREEN"}, states)
+
+	assert.Equal(t, []StatusTransition{
+		{HISTORY_SERVICE, "GREEN", "RED", at(40)},
+		{HISTORY_SERVICE, "RED", "YELLOW", at(50)},
+		{HISTORY_SERVICE, "YELLOW", "GREEN", at(70)},
+	}, hCtx.StatusHistory())
+
+	// RED from 40 to 50, the first report was 70 minutes ago
+	now := at(70)
+	summ := hCtx.stateSummaries(now)
+	assert.Equal(t, 1, len(summ))
+	assert.Equal(t, "GREEN", summ[0].State)
+	assert.Equal(t, "0s", summ[0].TimeInState)
+	assert.InDelta(t, 100*50/60.0, summ[0].Uptime["1h"], 0.01)
+	assert.InDelta(t, 100*60/70.0, summ[0].Uptime["24h"], 0.01)
+	assert.Equal(t, 100.0, summ[0].Uptime["5m"])
+	assert.Equal(t, 0.0, hCtx.Uptime("transport kafka", time.Hour))
+
+	// the history is bounded
+	hCtx.SetHysteresis(HealthHistoryConfig{FailThreshold: 1, RecoverThreshold: 1, MaxTransitions: 2})
+	for i := 0; i < 5; i++ {
+		hCtx.observe("database cassandra", FAILED, at(71+2*i))
+		hCtx.observe("database cassandra", CONNECTED, at(72+2*i))
+	}
+	var cassandra []StatusTransition
+	for _, tr := range hCtx.StatusHistory() {
+		if tr.Subject == "database cassandra" {
+			cassandra = append(cassandra, tr)
+		}
+	}
+	assert.Equal(t, []StatusTransition{
+		{"database cassandra", "CONNECTED", "FAILED", at(79)},
+		{"database cassandra", "FAILED", "CONNECTED", at(80)},
+	}, cassandra)
+}
+
+func TestTransportDoesNotFlap(t *testing.T) {
+	hCtx := &Health{name: "helloworld"}
+	stat := &metrics.TransportHealthStat{TransportName: "kafka", IsConnected: true,
+		InitializationTime: time.Now().Add(-time.Minute)}
+
+	report := func(txErrs uint64) PeripheralStatusType {
+		stat.TotalTxErrInOneInterval.Set(txErrs)
+		detail, err := hCtx.TransportHealthDetail(stat)
+		assert.Nil(t, err)
+		return detail.Status
+	}
+	var states []string
+	for _, errs := range []uint64{0, 1, 0, 2, 3, 4, 0, 0} {
+		states = append(states, report(errs).String())
+	}
+	assert.Equal(t, []string{"CONNECTED", "CONNECTED", "CONNECTED", "CONNECTED", "CONNECTED",
+		"CONNECTING", "CONNECTING", "CONNECTED"}, states)
+
+	detail, _ := hCtx.TransportHealthDetail(stat)
+	assert.NotEqual(t, time.Time{}.String(), detail.UpTime)
+	assert.Equal(t, "transport kafka", hCtx.StateSummaries()[0].Subject)
+
+	// a transport reconnecting is down
+	hCtx = &Health{name: "helloworld"}
+	hCtx.SetHysteresis(HealthHistoryConfig{FailThreshold: 1, RecoverThreshold: 1})
+	t0 := time.Now().Add(-time.Hour)
+	hCtx.observe("transport kafka", CONNECTED, t0)
+	hCtx.observe("transport kafka", CONNECTING, t0.Add(30*time.Minute))
+	assert.InDelta(t, 50, hCtx.Uptime("transport kafka", time.Hour), 0.1)
+}
+
+func TestHysteresisOncePerReport(t *testing.T) {
+	hCtx := &Health{name: "helloworld"}
+	hCtx.SetHysteresis(HealthHistoryConfig{FailThreshold: 2, RecoverThreshold: 2})
+	hCtx.SetReportInterval(time.Minute)
+	t0 := time.Now()
+
+	hCtx.observe("database cassandra", CONNECTED, t0)
+	// asked three times for the same report, one failure
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, CONNECTED, hCtx.observe("database cassandra", FAILED, t0.Add(time.Minute+time.Duration(i)*time.Second)))
+	}
+	// the next report, a bit early, is the second failure
+	assert.Equal(t, FAILED, hCtx.observe("database cassandra", FAILED, t0.Add(119*time.Second)))
+}
+
+func TestServiceStatusIsReadiness(t *testing.T) {
+	hCtx := &Health{name: "helloworld"}
+	hCtx.SetHysteresis(HealthHistoryConfig{FailThreshold: 2, RecoverThreshold: 2})
+	hCtx.RegisterCheck(StatusCheck{Name: "disk", Check: func() (SrvHealthStatusType, string) {
+		return ServiceHealthStatus_HEALTH_RED, "disk full"
+	}})
+
+	// no hysteresis on top of the checks and filtered peripherals
+	report, err := hCtx.CompleteSrvsStatus(&SrvsComponentComposition{})
+	assert.Nil(t, err)
+	brief := report.BriefStatus
+	assert.Equal(t, ServiceHealthStatus_HEALTH_RED, brief.Status)
+	assert.Equal(t, brief.Readiness.Status, brief.Status)
+	assert.Equal(t, HISTORY_SERVICE, report.DetailedStatus.States[0].Subject)
+	assert.Equal(t, "RED", report.DetailedStatus.States[0].State)
+}
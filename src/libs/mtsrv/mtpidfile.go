@@ -0,0 +1,136 @@
+package mtsrv
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/mtbox/mtlog"
+)
+
+// The PID file holds the process id of the running instance, it stays
+// locked with flock while the instance runs so that a second one with
+// the same file refuses to start. The file of a crashed run is not
+// locked anymore and is taken over.
+
+// path of the PID file under RootPath, ServiceName-ServiceInst.pid when
+// PidFile is not set. The instance is added to PidFile too, before its
+// extension, so that the instances sharing a configuration do not lock
+// each other out.
+func (scCfg *ServiceCommonConfig) PidFilePath() string {
+	file := scCfg.PidFile
+	if file == "" {
+		file = fmt.Sprintf("%s-%d.pid", scCfg.ServiceName, scCfg.ServiceInst)
+	} else {
+		ext := filepath.Ext(file)
+		file = fmt.Sprintf("%s-%d%s", strings.TrimSuffix(file, ext), scCfg.ServiceInst, ext)
+	}
+	return filepath.Join(scCfg.RootPath, file)
+}
+
+// PidFile is a locked PID file.
+type PidFile struct {
+	path string
+	f    *os.File
+}
+
+// LockPidFile creates the PID file and locks it, it fails when another
+// running process holds the lock.
+func LockPidFile(path string) (*PidFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	var f *os.File
+	var err error
+	for attempt := 0; f == nil; attempt++ {
+		if attempt == pidFileAttempts {
+			return nil, fmt.Errorf("failed to lock %v: replaced %d times while locking", path, attempt)
+		}
+		if f, err = lockFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	if pid := readPid(path); pid != 0 {
+		mtlog.Warnf("Removing stale PID file %v of pid %d", path, pid)
+	}
+	if err = f.Truncate(0); err == nil {
+		_, err = f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to write %v: %v", path, err)
+	}
+	return &PidFile{path: path, f: f}, nil
+}
+
+// how many times the file is opened again when it was replaced while
+// being locked
+const pidFileAttempts = 10
+
+// lockFile opens and locks path, a nil file means that the locked file
+// was removed or replaced by the instance releasing it meanwhile.
+func lockFile(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			if pid := readPid(path); pid != 0 {
+				return nil, fmt.Errorf("another instance (pid %d) holds %v", pid, path)
+			}
+			return nil, fmt.Errorf("another instance holds %v", path)
+		}
+		return nil, fmt.Errorf("failed to lock %v: %v", path, err)
+	}
+	locked, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if current, err := os.Stat(path); err != nil || !os.SameFile(locked, current) {
+		f.Close()
+		return nil, nil
+	}
+	return f, nil
+}
+
+// Release removes the PID file and unlocks it.
+func (pf *PidFile) Release() error {
+	// removed while still locked, an instance that opened it meanwhile
+	// sees that it was replaced once it gets the lock, see lockFile
+	err := os.Remove(pf.path)
+	if cerr := pf.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// the pid in the file, 0 when there is none.
+func readPid(path string) int {
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(body)))
+	return pid
+}
+
+// lock the PID file of the service, it is removed on shutdown.
+func (s *Server) lockPidFile(scCfg *ServiceCommonConfig) error {
+	pf, err := LockPidFile(scCfg.PidFilePath())
+	if err != nil {
+		return err
+	}
+	s.OnShutdown("pid file", func(ctx context.Context) error {
+		return pf.Release()
+	})
+	return nil
+}
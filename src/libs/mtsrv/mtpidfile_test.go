@@ -0,0 +1,46 @@
+package mtsrv
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPidFile(t *testing.T) {
+	cfg := &ServiceCommonConfig{ServiceName: "helloworld", ServiceInst: 1, RootPath: filepath.Join(t.TempDir(), "data")}
+	path := cfg.PidFilePath()
+	assert.Equal(t, filepath.Join(cfg.RootPath, "helloworld-1.pid"), path)
+
+	// left by a crashed run
+	assert.Nil(t, os.MkdirAll(cfg.RootPath, 0755))
+	assert.Nil(t, ioutil.WriteFile(path, []byte("99999999\n"), 0644))
+	pf, err := LockPidFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, os.Getpid(), readPid(path))
+
+	_, err = LockPidFile(path)
+	assert.EqualError(t, err, fmt.Sprintf("another instance (pid %d) holds %v", os.Getpid(), path))
+	assert.Equal(t, EXIT_LOCKED, NewServer(cfg).RunCommonLoop(cfg, nil))
+
+	assert.Nil(t, pf.Release())
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+
+	// removed on shutdown
+	srv := NewServer(cfg)
+	assert.Nil(t, srv.lockPidFile(cfg))
+	assert.Equal(t, os.Getpid(), readPid(path))
+	assert.Equal(t, EXIT_OK, srv.Shutdown())
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+
+	cfg.PidFile = "helloworld.pid"
+	// the instances sharing the configuration get their own file
+	assert.Equal(t, filepath.Join(cfg.RootPath, "helloworld-1.pid"), cfg.PidFilePath())
+	cfg.PidFile = "run/helloworld"
+	assert.Equal(t, filepath.Join(cfg.RootPath, "run/helloworld-1"), cfg.PidFilePath())
+}
@@ -0,0 +1,293 @@
+package mtsrv
+
+import (
+	"fmt"
+	"sort"
+)
+
+// The health of a service is summed up in two states computed from
+// checks: liveness, whether the process is functioning, and readiness,
+// whether its dependencies are ready for it to serve. A service that is
+// not alive is not ready either. Each state is the worst status of its
+// checks, a failing degraded-only check makes it YELLOW at worst, and
+// the reason of every check that is not GREEN is kept.
+
+// Probes a check counts for.
+const (
+	PROBE_LIVENESS  = "liveness"
+	PROBE_READINESS = "readiness"
+)
+
+// Criticality of a check.
+const (
+	CHECK_CRITICAL = "critical" // failing makes the state RED
+	CHECK_DEGRADED = "degraded" // failing makes the state YELLOW only
+)
+
+// StatusCheck is a check registered with Health. Check returns the
+// status and, when it is not GREEN, the reason.
+type StatusCheck struct {
+	Name        string
+	Probe       string // PROBE_LIVENESS or PROBE_READINESS (the default)
+	Criticality string // CHECK_CRITICAL (the default) or CHECK_DEGRADED
+	Check       func() (SrvHealthStatusType, string)
+}
+
+// CheckReason is why a check is not GREEN.
+type CheckReason struct {
+	Check  string
+	Status SrvHealthStatusType
+	Reason string
+}
+
+// ProbeResult is a liveness or readiness state.
+type ProbeResult struct {
+	Status  SrvHealthStatusType
+	Reasons []CheckReason
+}
+
+// a check run, counted in the probe state.
+type checkResult struct {
+	probe       string
+	criticality string
+	reason      CheckReason
+}
+
+// RegisterCheck adds or replaces the check of the same name.
+func (hCtx *Health) RegisterCheck(check StatusCheck) {
+	hCtx.Lock()
+	defer hCtx.Unlock()
+	if hCtx.checks == nil {
+		hCtx.checks = make(map[string]StatusCheck)
+	}
+	hCtx.checks[check.Name] = check
+}
+
+// UnregisterCheck removes the check name.
+func (hCtx *Health) UnregisterCheck(name string) {
+	hCtx.Lock()
+	defer hCtx.Unlock()
+	delete(hCtx.checks, name)
+}
+
+// Liveness checks the process state and runs the liveness checks.
+func (hCtx *Health) Liveness() ProbeResult {
+	return probeState(append(hCtx.processChecks(), hCtx.runChecks()...), PROBE_LIVENESS)
+}
+
+// Readiness runs every check, the service is ready when it is alive and
+// its readiness checks pass.
+func (hCtx *Health) Readiness() ProbeResult {
+	return probeState(append(hCtx.processChecks(), hCtx.runChecks()...), PROBE_READINESS)
+}
+
+func (hCtx *Health) runChecks() []checkResult {
+	hCtx.Lock()
+	checks := make([]StatusCheck, 0, len(hCtx.checks))
+	for _, check := range hCtx.checks {
+		checks = append(checks, check)
+	}
+	hCtx.Unlock()
+	sort.Slice(checks, func(a, b int) bool { return checks[a].Name < checks[b].Name })
+
+	results := make([]checkResult, 0, len(checks))
+	for _, check := range checks {
+		status, reason := check.Check()
+		results = append(results, checkResult{
+			probe:       check.Probe,
+			criticality: check.Criticality,
+			reason:      CheckReason{Check: check.Name, Status: status, Reason: reason},
+		})
+	}
+	return results
+}
+
+// probeState is the worst status of the checks counting for probe, the
+// liveness checks count for readiness too.
+func probeState(results []checkResult, probe string) ProbeResult {
+	state := ProbeResult{Status: ServiceHealthStatus_HEALTH_GREEN}
+	for _, r := range results {
+		if probe == PROBE_LIVENESS && r.probe != PROBE_LIVENESS {
+			continue
+		}
+		reason := r.reason
+		if reason.Status == ServiceHealthStatus_HEALTH_GREEN {
+			continue
+		}
+		if r.criticality == CHECK_DEGRADED {
+			reason.Status = ServiceHealthStatus_HEALTH_YELLOW
+		}
+		if statusWorse(reason.Status, state.Status) {
+			state.Status = reason.Status
+		}
+		state.Reasons = append(state.Reasons, reason)
+	}
+	return state
+}
+
+// statusWorse tells whether a is worse than b, UNKNOWN is as bad as RED.
+func statusWorse(a, b SrvHealthStatusType) bool {
+	rank := func(st SrvHealthStatusType) int {
+		switch st {
+		case ServiceHealthStatus_HEALTH_GREEN:
+			return 0
+		case ServiceHealthStatus_HEALTH_YELLOW:
+			return 1
+		case ServiceHealthStatus_HEALTH_RED:
+			return 2
+		}
+		return 3
+	}
+	return rank(a) > rank(b)
+}
+
+// peripheralCheck turns a peripheral connectivity into a check result,
+// CONNECTING is YELLOW and FAILED is RED.
+func peripheralCheck(kind, name string, status PeripheralStatusType, errMsg string) checkResult {
+	r := checkResult{probe: PROBE_READINESS, criticality: CHECK_CRITICAL,
+		reason: CheckReason{Check: kind + " " + name, Status: ServiceHealthStatus_HEALTH_GREEN}}
+	if status == CONNECTED {
+		return r
+	}
+	r.reason.Status = ServiceHealthStatus_HEALTH_RED
+	if status == CONNECTING {
+		r.reason.Status = ServiceHealthStatus_HEALTH_YELLOW
+	}
+	r.reason.Reason = fmt.Sprintf("%v is %v", name, status)
+	if errMsg != "" {
+		r.reason.Reason += ": " + errMsg
+	}
+	return r
+}
+
+// statusChecks are the checks of a detailed status: the peripherals and
+// the alerts count for readiness, the process for liveness.
+func statusChecks(detailed *DetailedStatusSummary) []checkResult {
+	var results []checkResult
+	if cp := detailed.ConnectedPeripheral; cp != nil {
+		for _, db := range cp.Databases {
+			if db != nil {
+				results = append(results, peripheralCheck("database", db.Name, db.Status, db.Error))
+			}
+		}
+		for _, trans := range cp.Transports {
+			if trans != nil {
+				results = append(results, peripheralCheck("transport", trans.Name, trans.Status, trans.Error))
+			}
+		}
+	}
+	for _, security := range detailed.Security {
+		if security != nil {
+			results = append(results, peripheralCheck("security", security.Name, security.Status, security.Error))
+		}
+	}
+
+	//firing alerts, critical ones make the service RED.
+	for _, alert := range detailed.Alerts {
+		if !alert.Firing {
+			continue
+		}
+		r := checkResult{probe: PROBE_READINESS, criticality: CHECK_DEGRADED,
+			reason: CheckReason{Check: "alert " + alert.Rule, Status: ServiceHealthStatus_HEALTH_YELLOW,
+				Reason: fmt.Sprintf("%v is %v", alert.Metric, alert.Value)}}
+		if alert.Severity == ALERT_CRITICAL {
+			r.criticality, r.reason.Status = CHECK_CRITICAL, ServiceHealthStatus_HEALTH_RED
+		}
+		results = append(results, r)
+	}
+
+	return append(results, processCheck(detailed.ProcessStatus))
+}
+
+// processCheck is RED when the process is stopped, idle, waiting, a
+// zombie or locked, or when its state is unknown.
+func processCheck(ps *ProcessDetail) checkResult {
+	r := checkResult{probe: PROBE_LIVENESS, criticality: CHECK_CRITICAL,
+		reason: CheckReason{Check: "process", Status: ServiceHealthStatus_HEALTH_GREEN}}
+	switch {
+	case ps == nil:
+		r.reason.Status, r.reason.Reason = ServiceHealthStatus_HEALTH_RED, FAILED_UPTIME
+	case ps.State == "T" || ps.State == "I" || ps.State == "W" || ps.State == "Z" || ps.State == "L":
+		r.reason.Status = ServiceHealthStatus_HEALTH_RED
+		r.reason.Reason = fmt.Sprintf("process state is %v", ps.State)
+	}
+	return r
+}
+
+// the process check of Liveness and Readiness, none when the process
+// was not found.
+func (hCtx *Health) processChecks() []checkResult {
+	if hCtx.processCtx == nil {
+		return nil
+	}
+	state, err := hCtx.processCtx.Status()
+	if err != nil {
+		return []checkResult{processCheck(nil)}
+	}
+	return []checkResult{processCheck(&ProcessDetail{State: state})}
+}
+
+// merge adds the reasons of other, the status is the worst of both.
+func (pr *ProbeResult) merge(other ProbeResult) {
+	if statusWorse(other.Status, pr.Status) {
+		pr.Status = other.Status
+	}
+	pr.Reasons = append(pr.Reasons, other.Reasons...)
+}
+
+// Liveness is RED once the server shuts down, and the liveness of the
+// health service when it is registered.
+func (s *Server) Liveness() ProbeResult {
+	state := probeState(s.serverChecks(false), PROBE_LIVENESS)
+	if hCtx := s.healthCtx(); hCtx != nil {
+		state.merge(hCtx.Liveness())
+	}
+	return state
+}
+
+// Readiness is RED until the services started and are ready, while the
+// handler of one is not healthy, and when the server is not alive.
+func (s *Server) Readiness() ProbeResult {
+	state := probeState(s.serverChecks(true), PROBE_READINESS)
+	if hCtx := s.healthCtx(); hCtx != nil {
+		state.merge(hCtx.Readiness())
+	}
+	return state
+}
+
+func (s *Server) healthCtx() *Health {
+	s.Lock()
+	defer s.Unlock()
+	return s.health
+}
+
+func (s *Server) serverChecks(ready bool) []checkResult {
+	red := func(probe, check, reason string) checkResult {
+		return checkResult{probe: probe, criticality: CHECK_CRITICAL,
+			reason: CheckReason{Check: check, Status: ServiceHealthStatus_HEALTH_RED, Reason: reason}}
+	}
+	var results []checkResult
+	if s.ctx.Err() != nil {
+		results = append(results, red(PROBE_LIVENESS, "server", "shutting down"))
+	}
+	if !ready {
+		return results
+	}
+
+	s.Lock()
+	running := s.running
+	names := append([]string(nil), s.stopOrder...)
+	s.Unlock()
+	if !running {
+		results = append(results, red(PROBE_READINESS, "server", "services not started"))
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !s.IsReady(name) {
+			results = append(results, red(PROBE_READINESS, "service "+name, "not ready"))
+		} else if err := s.ServiceHealth(name); err != nil {
+			results = append(results, red(PROBE_READINESS, "service "+name, err.Error()))
+		}
+	}
+	return results
+}
@@ -0,0 +1,60 @@
+package mtsrv
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProbeStates(t *testing.T) {
+	hCtx := &Health{name: "helloworld"}
+	detailed := &DetailedStatusSummary{
+		ConnectedPeripheral: &PeripheralList{
+			Databases: []*PersistenceStatusDetail{
+				{Name: "cassandra", Status: CONNECTING, Error: "no quorum"},
+				{Name: "influx", Status: CONNECTED},
+			},
+			Transports: []*TransportBlockStatusDetail{{Name: "kafka", Status: CONNECTED}},
+		},
+		ProcessStatus: &ProcessDetail{State: "S"},
+	}
+	brief, err := hCtx.BriefSrvsStatus(&MtsrvStatus{DetailedStatus: detailed})
+	assert.Nil(t, err)
+	// a connected peripheral listed later does not hide cassandra
+	assert.Equal(t, ServiceHealthStatus_HEALTH_YELLOW, brief.Status)
+	assert.Equal(t, ProbeResult{Status: ServiceHealthStatus_HEALTH_GREEN}, brief.Liveness)
+	assert.Equal(t, []CheckReason{{"database cassandra", ServiceHealthStatus_HEALTH_YELLOW, "cassandra is CONNECTING: no quorum"}},
+		brief.Readiness.Reasons)
+
+	hCtx.RegisterCheck(StatusCheck{Name: "disk", Criticality: CHECK_DEGRADED,
+		Check: func() (SrvHealthStatusType, string) { return ServiceHealthStatus_HEALTH_RED, "disk 95% full" }})
+	assert.Equal(t, ProbeResult{Status: ServiceHealthStatus_HEALTH_YELLOW, Reasons: []CheckReason{
+		{"disk", ServiceHealthStatus_HEALTH_YELLOW, "disk 95% full"},
+	}}, hCtx.Readiness())
+	assert.Equal(t, ProbeResult{Status: ServiceHealthStatus_HEALTH_GREEN}, hCtx.Liveness())
+
+	hCtx.RegisterCheck(StatusCheck{Name: "deadlock", Probe: PROBE_LIVENESS,
+		Check: func() (SrvHealthStatusType, string) { return ServiceHealthStatus_HEALTH_RED, "event loop stuck" }})
+	live := hCtx.Liveness()
+	assert.Equal(t, ServiceHealthStatus_HEALTH_RED, live.Status)
+	assert.Equal(t, []CheckReason{{"deadlock", ServiceHealthStatus_HEALTH_RED, "event loop stuck"}}, live.Reasons)
+	assert.Equal(t, ServiceHealthStatus_HEALTH_RED, hCtx.Readiness().Status)
+	assert.Equal(t, 2, len(hCtx.Readiness().Reasons))
+
+	hCtx.UnregisterCheck("deadlock")
+	detailed.ProcessStatus.State = "Z"
+	brief, err = hCtx.BriefSrvsStatus(&MtsrvStatus{DetailedStatus: detailed})
+	assert.Nil(t, err)
+	assert.Equal(t, ServiceHealthStatus_HEALTH_RED, brief.Status)
+	assert.Equal(t, []CheckReason{{"process", ServiceHealthStatus_HEALTH_RED, "process state is Z"}}, brief.Liveness.Reasons)
+	assert.Equal(t, 3, len(brief.Readiness.Reasons))
+
+	body, err := json.Marshal(brief)
+	assert.Nil(t, err)
+	var again BriefStatusSummary
+	assert.Nil(t, json.Unmarshal(body, &again))
+	assert.Equal(t, *brief, again)
+	// the status stays a number in the reports
+	assert.Contains(t, string(body), `"Status":1`)
+}
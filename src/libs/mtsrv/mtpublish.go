@@ -0,0 +1,336 @@
+package mtsrv
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mtbox/mtlog"
+)
+
+// The health service publishes the MtsrvStatus every Frequency seconds
+// of its Services entry, enveloped with the host, environment, service
+// name and instance of the sender. Publishers are listed in
+// HealthReport.Publishers by Kind: kafka sends to a topic through the
+// handler of the kafka service, file appends JSON lines and log writes
+// to mtlog. Other kinds are added with RegisterStatusPublisher.
+
+// topic of the health reports when the publisher does not set one.
+const HEALTH_TOPIC = "SrvsHealthTopic"
+
+// HealthReportConfig lists the publishers of the health report, EnvName
+// is the environment in the envelope.
+type HealthReportConfig struct {
+	EnvName    string            `json:"EnvName"`
+	Publishers []PublisherConfig `json:"Publishers"`
+}
+
+// PublisherConfig selects a publisher. Topic and Service are the topic
+// and the Services entry of the kafka publisher, SrvsHealthTopic and
+// kafka by default, Path the file of the file publisher relative to
+// RootPath.
+type PublisherConfig struct {
+	Kind    string `json:"Kind" validate:"required"`
+	Topic   string `json:"Topic"`
+	Service string `json:"Service"`
+	Path    string `json:"Path"`
+}
+
+// StatusEnvelope is a published health report.
+type StatusEnvelope struct {
+	HostName        string
+	EnvName         string
+	ServiceName     string
+	ServiceInstance string
+	Status          SrvHealthStatusType
+	Timestamp       time.Time
+	Report          *MtsrvStatus
+}
+
+// StatusPublisher sends the health reports somewhere.
+type StatusPublisher interface {
+	Name() string
+	Publish(env *StatusEnvelope) error
+}
+
+// StatusPublisherFactory creates a publisher of the HealthReport config.
+type StatusPublisherFactory func(srv *Server, pc PublisherConfig) (StatusPublisher, error)
+
+// KafkaProducer is implemented by the handler of the kafka service, the
+// kafka publisher sends through it.
+type KafkaProducer interface {
+	Produce(topic string, key, value []byte) error
+}
+
+var statusPublishers = struct {
+	sync.Mutex
+	factories map[string]StatusPublisherFactory
+}{
+	factories: map[string]StatusPublisherFactory{
+		"kafka": newKafkaPublisher,
+		"file":  newFilePublisher,
+		"log":   newLogPublisher,
+	},
+}
+
+// RegisterStatusPublisher adds or replaces the factory of kind, a nil
+// factory removes it.
+func RegisterStatusPublisher(kind string, factory StatusPublisherFactory) {
+	statusPublishers.Lock()
+	defer statusPublishers.Unlock()
+	if factory == nil {
+		delete(statusPublishers.factories, kind)
+		return
+	}
+	statusPublishers.factories[kind] = factory
+}
+
+// AddStatusPublisher adds a publisher to the ones of the config.
+func (s *Server) AddStatusPublisher(p StatusPublisher) {
+	s.Lock()
+	defer s.Unlock()
+	s.publishers = append(s.publishers, p)
+}
+
+// SetStatusComponents sets the function giving the peripherals of the
+// published health reports, filled with the detail methods of hCtx.
+func (s *Server) SetStatusComponents(fn func(hCtx *Health) *SrvsComponentComposition) {
+	s.Lock()
+	defer s.Unlock()
+	s.components = fn
+}
+
+// the HealthReport of the configuration, the reloaded one once there is.
+func (s *Server) healthReportConfig() HealthReportConfig {
+	s.Lock()
+	defer s.Unlock()
+	if s.report != nil {
+		return *s.report
+	}
+	if s.cfg != nil {
+		return s.cfg.HealthReport
+	}
+	return HealthReportConfig{}
+}
+
+// build the publishers of the config, the unknown kinds are skipped.
+func (s *Server) statusPublishers() []StatusPublisher {
+	s.Lock()
+	publishers := append([]StatusPublisher(nil), s.publishers...)
+	s.Unlock()
+
+	for _, pc := range s.healthReportConfig().Publishers {
+		statusPublishers.Lock()
+		factory, ok := statusPublishers.factories[pc.Kind]
+		statusPublishers.Unlock()
+		if !ok {
+			mtlog.Errorf("Unknown health report publisher %v, ignored", pc.Kind)
+			continue
+		}
+		p, err := factory(s, pc)
+		if err != nil {
+			mtlog.Errorf("Failed to create health report publisher %v: %v", pc.Kind, err)
+			continue
+		}
+		publishers = append(publishers, p)
+	}
+	return publishers
+}
+
+// publish the health report every interval until ctx is done, the
+// publishers are built again when a reload changed HealthReport.
+func (s *Server) publishStatus(ctx context.Context, hCtx *Health, interval time.Duration) {
+	reloaded := make(chan struct{}, 1)
+	unsubscribe := s.SubscribeConfig(func(diff *ConfigDiff) {
+		for _, c := range diff.Changes {
+			if strings.HasPrefix(c.Path, "HealthReport.") || strings.Contains(c.Path, ".HealthReport.") {
+				select {
+				case reloaded <- struct{}{}:
+				default:
+				}
+				return
+			}
+		}
+	})
+	defer unsubscribe()
+
+	publishers := s.statusPublishers()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-reloaded:
+			publishers = s.statusPublishers()
+			mtlog.Infof("Health report publishers reloaded, %d publishers", len(publishers))
+		case <-ticker.C:
+			s.PublishStatus(hCtx, publishers)
+		}
+	}
+}
+
+// PublishStatus sends the current health report to publishers.
+func (s *Server) PublishStatus(hCtx *Health, publishers []StatusPublisher) {
+	env, err := s.statusEnvelope(hCtx)
+	if err != nil {
+		mtlog.Errorf("Failed to build health report: %v", err)
+		return
+	}
+	for _, p := range publishers {
+		if err := p.Publish(env); err != nil {
+			mtlog.Errorf("Failed to publish health report to %v: %v", p.Name(), err)
+		}
+	}
+}
+
+func (s *Server) statusEnvelope(hCtx *Health) (*StatusEnvelope, error) {
+	s.Lock()
+	components := s.components
+	s.Unlock()
+	comp := &SrvsComponentComposition{}
+	if components != nil {
+		comp = components(hCtx)
+	}
+	report, err := hCtx.CompleteSrvsStatus(comp)
+	if err != nil {
+		return nil, err
+	}
+
+	env := &StatusEnvelope{Status: report.BriefStatus.Status, Timestamp: time.Now(), Report: report}
+	env.HostName, _ = os.Hostname()
+	env.EnvName = s.healthReportConfig().EnvName
+	if s.cfg != nil {
+		env.ServiceName = s.cfg.ServiceName
+		env.ServiceInstance = strconv.Itoa(int(s.cfg.ServiceInst))
+	}
+	if env.ServiceName == "" {
+		env.ServiceName = hCtx.name
+	}
+	return env, nil
+}
+
+// sends the report as JSON to a topic, keyed by service and instance.
+type kafkaPublisher struct {
+	srv     *Server
+	service string
+	topic   string
+}
+
+func newKafkaPublisher(srv *Server, pc PublisherConfig) (StatusPublisher, error) {
+	kp := &kafkaPublisher{srv: srv, service: pc.Service, topic: pc.Topic}
+	if kp.service == "" {
+		kp.service = "kafka"
+	}
+	if kp.topic == "" {
+		kp.topic = HEALTH_TOPIC
+	}
+	return kp, nil
+}
+
+func (kp *kafkaPublisher) Name() string {
+	return "kafka:" + kp.topic
+}
+
+func (kp *kafkaPublisher) Publish(env *StatusEnvelope) error {
+	// the handler of the current run of the service
+	kp.srv.Lock()
+	h := kp.srv.handlers[kp.service]
+	kp.srv.Unlock()
+	producer, ok := h.(KafkaProducer)
+	if !ok {
+		return fmt.Errorf("service %v is not running a kafka producer", kp.service)
+	}
+	body, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	return producer.Produce(kp.topic, []byte(env.ServiceName+"-"+env.ServiceInstance), body)
+}
+
+// appends the report as one JSON line to a file.
+type filePublisher struct {
+	exp *fileExporter
+}
+
+func newFilePublisher(srv *Server, pc PublisherConfig) (StatusPublisher, error) {
+	file := pc.Path
+	var root string
+	if srv.cfg != nil {
+		root = srv.cfg.RootPath
+		if file == "" {
+			file = fmt.Sprintf("%s-%d.health.log", srv.cfg.ServiceName, srv.cfg.ServiceInst)
+		}
+	}
+	if file == "" {
+		return nil, fmt.Errorf("file publisher without a Path")
+	}
+	return NewFilePublisher(filepath.Join(root, file)), nil
+}
+
+// NewFilePublisher appends the reports to path, one JSON line each.
+func NewFilePublisher(path string) StatusPublisher {
+	return &filePublisher{exp: &fileExporter{path: path}}
+}
+
+func (fp *filePublisher) Name() string {
+	return fp.exp.Name()
+}
+
+func (fp *filePublisher) Publish(env *StatusEnvelope) error {
+	body, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	return fp.exp.appendLine(body)
+}
+
+// writes the report to mtlog.
+type logPublisher struct{}
+
+func newLogPublisher(srv *Server, pc PublisherConfig) (StatusPublisher, error) {
+	return logPublisher{}, nil
+}
+
+func (logPublisher) Name() string {
+	return "log"
+}
+
+func (logPublisher) Publish(env *StatusEnvelope) error {
+	body, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	mtlog.Infof("%s", body)
+	return nil
+}
+
+// MemoryPublisher keeps the published reports, for tests.
+type MemoryPublisher struct {
+	sync.Mutex
+	envelopes []StatusEnvelope
+}
+
+func (mp *MemoryPublisher) Name() string {
+	return "memory"
+}
+
+func (mp *MemoryPublisher) Publish(env *StatusEnvelope) error {
+	mp.Lock()
+	defer mp.Unlock()
+	mp.envelopes = append(mp.envelopes, *env)
+	return nil
+}
+
+// Envelopes returns the reports published so far.
+func (mp *MemoryPublisher) Envelopes() []StatusEnvelope {
+	mp.Lock()
+	defer mp.Unlock()
+	return append([]StatusEnvelope(nil), mp.envelopes...)
+}
@@ -0,0 +1,148 @@
+package mtsrv
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testProducer struct {
+	testHandler
+	mu       sync.Mutex
+	messages map[string][][]byte
+}
+
+func (tp *testProducer) Produce(topic string, key, value []byte) error {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	tp.messages[topic] = append(tp.messages[topic], value)
+	return nil
+}
+
+func TestPublishStatus(t *testing.T) {
+	root := t.TempDir()
+	cfg := &ServiceCommonConfig{ServiceName: "helloworld", ServiceInst: 2, RootPath: root,
+		HealthReport: HealthReportConfig{EnvName: "staging", Publishers: []PublisherConfig{
+			{Kind: "file"},
+			{Kind: "kafka"},
+			{Kind: "zookeeper"},
+		}}}
+	srv := NewServer(cfg)
+	hCtx := &Health{name: "helloworld"}
+	srv.RegisterHealth(hCtx)
+	srv.SetStatusComponents(func(hCtx *Health) *SrvsComponentComposition {
+		return &SrvsComponentComposition{Databases: []*PersistenceStatusDetail{{Name: "cassandra", Status: CONNECTED}}}
+	})
+	mem := &MemoryPublisher{}
+	srv.AddStatusPublisher(mem)
+
+	producer := &testProducer{messages: make(map[string][][]byte)}
+	srv.handlers["kafka"] = producer
+
+	publishers := srv.statusPublishers()
+	assert.Equal(t, []string{"memory", "file:" + filepath.Join(root, "helloworld-2.health.log"), "kafka:SrvsHealthTopic"},
+		[]string{publishers[0].Name(), publishers[1].Name(), publishers[2].Name()})
+	srv.PublishStatus(hCtx, publishers)
+
+	envs := mem.Envelopes()
+	assert.Equal(t, 1, len(envs))
+	host, _ := os.Hostname()
+	assert.Equal(t, host, envs[0].HostName)
+	assert.Equal(t, "staging", envs[0].EnvName)
+	assert.Equal(t, "helloworld", envs[0].ServiceName)
+	assert.Equal(t, "2", envs[0].ServiceInstance)
+	assert.Equal(t, "cassandra", envs[0].Report.DetailedStatus.ConnectedPeripheral.Databases[0].Name)
+	// no process detail
+	assert.Equal(t, ServiceHealthStatus_HEALTH_RED, envs[0].Status)
+
+	f, err := os.Open(filepath.Join(root, "helloworld-2.health.log"))
+	assert.Nil(t, err)
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	assert.True(t, scanner.Scan())
+	var fromFile StatusEnvelope
+	assert.Nil(t, json.Unmarshal(scanner.Bytes(), &fromFile))
+	assert.Equal(t, "staging", fromFile.EnvName)
+	assert.Equal(t, envs[0].Status, fromFile.Status)
+
+	assert.Equal(t, 1, len(producer.messages[HEALTH_TOPIC]))
+	var fromKafka StatusEnvelope
+	assert.Nil(t, json.Unmarshal(producer.messages[HEALTH_TOPIC][0], &fromKafka))
+	assert.Equal(t, "2", fromKafka.ServiceInstance)
+
+	// without a kafka service the other publishers still get the report
+	delete(srv.handlers, "kafka")
+	srv.PublishStatus(hCtx, publishers)
+	assert.Equal(t, 2, len(mem.Envelopes()))
+}
+
+func TestHealthServicePublishes(t *testing.T) {
+	cfg := &ServiceCommonConfig{ServiceName: "helloworld", RootPath: t.TempDir(), ShutdownTimeout: 1,
+		Services: []NetServices{{Name: "health", Kind: "health", Frequency: 1}}}
+	srv := NewServer(cfg)
+	mem := &MemoryPublisher{}
+	srv.AddStatusPublisher(mem)
+
+	codes := make(chan int)
+	go func() { codes <- srv.RunCommonLoop(cfg, nil) }()
+	time.Sleep(1500 * time.Millisecond)
+	assert.Equal(t, EXIT_OK, srv.Shutdown())
+	assert.Equal(t, EXIT_OK, <-codes)
+
+	envs := mem.Envelopes()
+	assert.Equal(t, 1, len(envs))
+	assert.Equal(t, "helloworld", envs[0].ServiceName)
+	assert.Equal(t, "0", envs[0].ServiceInstance)
+}
+
+func TestPublishersReload(t *testing.T) {
+	root := t.TempDir()
+	config := func(path string) string {
+		return `{
+    "ServiceCommonConfig": {
+        "ServiceName": "helloworld",
+        "RootPath": "` + root + `",
+        "HealthReport": {"EnvName": "staging", "Publishers": [{"Kind": "file", "Path": "` + path + `"}]}
+    }
+}`
+	}
+	file := writeTestConfig(t, "helloworld.json", config("first.log"))
+	cfg := testServiceConfig{}
+	assert.Nil(t, NewConfigLoader().Load(file, &cfg))
+	srv := NewServer(&cfg.ScCfg)
+	assert.Nil(t, srv.WatchConfig(file, &cfg))
+	hCtx := &Health{name: "helloworld"}
+	srv.RegisterHealth(hCtx)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		srv.publishStatus(ctx, hCtx, 20*time.Millisecond)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	exists := func(name string) func() bool {
+		return func() bool {
+			_, err := os.Stat(filepath.Join(root, name))
+			return err == nil
+		}
+	}
+	assert.Eventually(t, exists("first.log"), 2*time.Second, 10*time.Millisecond)
+
+	assert.Nil(t, ioutil.WriteFile(file, []byte(config("second.log")), 0644))
+	diff, err := srv.Reload()
+	assert.Nil(t, err)
+	assert.NotNil(t, diff)
+	assert.Eventually(t, exists("second.log"), 2*time.Second, 10*time.Millisecond)
+}
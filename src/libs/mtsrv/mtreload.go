@@ -0,0 +1,417 @@
+package mtsrv
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mtbox/mtlog"
+)
+
+var (
+	// how often WatchConfig checks the configuration file
+	ConfigWatchInterval = 5 * time.Second
+	// how long a restarted service is given to return before its
+	// replacement is started anyway
+	ServiceRestartTimeout = 30 * time.Second
+)
+
+// ConfigChange is one configuration value that changed on reload, Path
+// is as in ConfigSource except that list elements with a Name are
+// selected by it, e.g. ServiceCommonConfig.Services.kafka.Topics.
+type ConfigChange struct {
+	Path string
+	Old  interface{}
+	New  interface{}
+}
+
+// ConfigDiff is published to the subscribers when a reload changed the
+// configuration. Config is the new configuration, a pointer of the type
+// given to WatchConfig, services are listed by name.
+type ConfigDiff struct {
+	Config          interface{}
+	Changes         []ConfigChange
+	ServicesAdded   []string
+	ServicesRemoved []string
+	ServicesChanged []string
+}
+
+// one run of the dispatch function of a service.
+type serviceRun struct {
+	cfg    NetServices
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+type configWatch struct {
+	sync.Mutex // serializes the reloads
+	file       string
+	current    interface{}
+	// the configuration file and its includes
+	stamps map[string]fileStamp
+	sighup chan os.Signal
+}
+
+// what tells that a watched file changed.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// stampFiles stats files, a missing file gets the zero stamp.
+func stampFiles(files []string) map[string]fileStamp {
+	stamps := make(map[string]fileStamp, len(files))
+	for _, f := range files {
+		if fi, err := os.Stat(f); err == nil {
+			stamps[f] = fileStamp{fi.ModTime(), fi.Size()}
+		} else {
+			stamps[f] = fileStamp{}
+		}
+	}
+	return stamps
+}
+
+// configFiles lists the configuration file and the files it includes.
+func configFiles(configFile string) []string {
+	cl := NewConfigLoader()
+	cl.Read(configFile)
+	if files := cl.Files(); len(files) != 0 {
+		return files
+	}
+	return []string{configFile}
+}
+
+// WatchConfig reloads the configuration when configFile or a file it
+// includes changes, or on SIGHUP. srvCfg is the configuration
+// ParseConfig loaded, it is never modified: the new configuration goes
+// to the subscribers and the services whose NetServices entry changed
+// are restarted.
+func (s *Server) WatchConfig(configFile string, srvCfg interface{}) error {
+	rv := reflect.ValueOf(srvCfg)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("configuration must be a pointer to a struct")
+	}
+	if _, err := os.Stat(configFile); err != nil {
+		return err
+	}
+
+	s.Lock()
+	if s.watch != nil {
+		s.Unlock()
+		return fmt.Errorf("configuration %v is already watched", s.watch.file)
+	}
+	w := &configWatch{
+		file:    configFile,
+		current: srvCfg,
+		stamps:  stampFiles(configFiles(configFile)),
+		sighup:  make(chan os.Signal, 1),
+	}
+	s.watch = w
+	s.Unlock()
+
+	// stopped by Shutdown before the services drain
+	signal.Notify(w.sighup, syscall.SIGHUP)
+	go func() {
+		for range w.sighup {
+			mtlog.Infof("SIGHUP, reloading configuration %v", configFile)
+			s.Reload()
+		}
+	}()
+
+	return s.sched.Register(JobSpec{
+		Name:     "configWatch",
+		Interval: ConfigWatchInterval,
+		Overlap:  OverlapSkip,
+		Fn: func(ctx context.Context) error {
+			w.Lock()
+			changed := false
+			for f, stamp := range w.stamps {
+				fi, err := os.Stat(f)
+				if err != nil {
+					if f == configFile {
+						w.Unlock()
+						return err
+					}
+					// a removed include fails the reload
+					changed = changed || stamp != fileStamp{}
+					continue
+				}
+				changed = changed || !fi.ModTime().Equal(stamp.modTime) || fi.Size() != stamp.size
+			}
+			w.Unlock()
+			if !changed {
+				return nil
+			}
+			_, err := s.Reload()
+			return err
+		},
+	})
+}
+
+// SubscribeConfig calls fn with every configuration change, in the
+// order of the reloads. The returned function cancels the subscription.
+func (s *Server) SubscribeConfig(fn func(*ConfigDiff)) func() {
+	s.Lock()
+	defer s.Unlock()
+	id := s.nextSub
+	s.nextSub++
+	s.configSubs[id] = fn
+	return func() {
+		s.Lock()
+		defer s.Unlock()
+		delete(s.configSubs, id)
+	}
+}
+
+// Reload parses and validates the configuration file again. When it
+// is invalid the current configuration stays, otherwise the changes
+// are applied and published, a nil diff means nothing changed.
+func (s *Server) Reload() (*ConfigDiff, error) {
+	s.Lock()
+	w := s.watch
+	s.Unlock()
+	if w == nil {
+		return nil, fmt.Errorf("configuration is not watched")
+	}
+	w.Lock()
+	defer w.Unlock()
+
+	newCfg := reflect.New(reflect.TypeOf(w.current).Elem()).Interface()
+	cl := NewConfigLoader()
+	err := cl.Load(w.file, newCfg)
+	// the includes may have changed too, an invalid configuration is
+	// not reloaded again until one of its files changes
+	files := cl.Files()
+	if len(files) == 0 {
+		files = []string{w.file}
+	}
+	w.stamps = stampFiles(files)
+	if err != nil {
+		mtlog.Errorf("Configuration %v not reloaded: %v", w.file, err)
+		return nil, err
+	}
+	if scCfg := findCommonConfig(newCfg); scCfg != nil {
+		s.Lock()
+		withDisp := !s.running || s.disp != nil
+		s.Unlock()
+		if err := checkServiceKinds(scCfg.Services, withDisp); err != nil {
+			mtlog.Errorf("Configuration %v not reloaded: %v", w.file, err)
+			return nil, err
+		}
+	}
+	diff := diffConfig(w.current, newCfg)
+	if len(diff.Changes) == 0 {
+		return nil, nil
+	}
+	w.current = newCfg
+
+	paths := make([]string, 0, len(diff.Changes))
+	for _, c := range diff.Changes {
+		paths = append(paths, c.Path)
+	}
+	mtlog.Infof("Configuration %v reloaded, changed %s", w.file, strings.Join(paths, ", "))
+
+	if scCfg := findCommonConfig(newCfg); scCfg != nil {
+		s.applyConfig(scCfg, diff)
+	}
+	s.Lock()
+	subs := make([]func(*ConfigDiff), 0, len(s.configSubs))
+	for _, fn := range s.configSubs {
+		subs = append(subs, fn)
+	}
+	s.Unlock()
+	for _, fn := range subs {
+		fn(diff)
+	}
+	return diff, nil
+}
+
+// applyConfig takes the log level and the health report publishers and
+// restarts the changed services.
+func (s *Server) applyConfig(scCfg *ServiceCommonConfig, diff *ConfigDiff) {
+	for _, c := range diff.Changes {
+		if strings.HasSuffix(c.Path, "LogCfg.Level") {
+			mtlog.SetLevel(scCfg.LogCfg.Level)
+		}
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	report := scCfg.HealthReport
+	s.report = &report
+	if !s.running || s.ctx.Err() != nil {
+		return
+	}
+	services := make(map[string]NetServices)
+	for _, cp := range scCfg.Services {
+		services[cp.Name] = cp
+	}
+	for _, name := range diff.ServicesRemoved {
+		if run, ok := s.services[name]; ok {
+			mtlog.Infof("Stopping service %v removed from the configuration", name)
+			run.cancel()
+			delete(s.services, name)
+			s.unreadyLocked(name)
+		}
+	}
+	for _, name := range diff.ServicesChanged {
+		mtlog.Infof("Restarting service %v, its configuration changed", name)
+		s.startServiceLocked(services[name], s.services[name])
+	}
+	for _, name := range diff.ServicesAdded {
+		mtlog.Infof("Starting service %v added to the configuration", name)
+		go s.startWhenReady(services[name])
+	}
+	if order, err := serviceOrder(scCfg.Services); err == nil {
+		s.stopOrder = reverseNames(order)
+	}
+}
+
+// start a run of the dispatch function for cp, once prev returned.
+func (s *Server) startServiceLocked(cp NetServices, prev *serviceRun) *serviceRun {
+	run := &serviceRun{cfg: cp, done: make(chan struct{})}
+	// cancelled by Shutdown in dependency order, not with s.ctx
+	run.ctx, run.cancel = context.WithCancel(context.Background())
+	s.services[cp.Name] = run
+	if prev != nil {
+		s.unreadyLocked(cp.Name)
+	}
+
+	disp, level := s.serviceDispatch(s.disp), s.dispLevel
+	go func() {
+		defer close(run.done)
+		if prev != nil {
+			prev.cancel()
+			select {
+			case <-prev.done:
+			case <-time.After(ServiceRestartTimeout):
+				mtlog.Warnf("Service %v did not return within %v, starting it again anyway",
+					cp.Name, ServiceRestartTimeout)
+			}
+		}
+		if run.ctx.Err() != nil {
+			return
+		}
+		s.supervise(run, disp, level)
+	}()
+	return run
+}
+
+// ServiceContext is the context given to the dispatch function of the
+// service, for the goroutines it starts. It is cancelled on shutdown and
+// when the service is restarted or removed by a configuration reload.
+func (s *Server) ServiceContext(name string) context.Context {
+	s.Lock()
+	defer s.Unlock()
+	if run, ok := s.services[name]; ok {
+		return run.ctx
+	}
+	return context.Background()
+}
+
+// stopWatch stops watching the configuration and waits for a reload
+// in progress, nothing is restarted once the services drain.
+func (s *Server) stopWatch() {
+	s.Lock()
+	w := s.watch
+	s.Unlock()
+	if w == nil {
+		return
+	}
+	s.sched.Unregister("configWatch")
+	signal.Stop(w.sighup)
+	close(w.sighup)
+	// a reload in progress returns first
+	w.Lock()
+	w.Unlock()
+}
+
+// findCommonConfig returns the ServiceCommonConfig of a configuration.
+func findCommonConfig(srvCfg interface{}) *ServiceCommonConfig {
+	if scCfg, ok := srvCfg.(*ServiceCommonConfig); ok {
+		return scCfg
+	}
+	rv := reflect.Indirect(reflect.ValueOf(srvCfg))
+	for i := 0; i < rv.NumField(); i++ {
+		if rv.Field(i).Type() == commonConfigType && rv.Field(i).CanAddr() {
+			return rv.Field(i).Addr().Interface().(*ServiceCommonConfig)
+		}
+	}
+	return nil
+}
+
+func diffConfig(oldCfg, newCfg interface{}) *ConfigDiff {
+	oldValues, newValues := make(map[string]interface{}), make(map[string]interface{})
+	configValues(reflect.ValueOf(oldCfg).Elem(), "", oldValues)
+	configValues(reflect.ValueOf(newCfg).Elem(), "", newValues)
+
+	diff := &ConfigDiff{Config: newCfg}
+	for path, nv := range newValues {
+		if ov, ok := oldValues[path]; !ok || !reflect.DeepEqual(ov, nv) {
+			diff.Changes = append(diff.Changes, ConfigChange{Path: path, Old: ov, New: nv})
+		}
+	}
+	for path, ov := range oldValues {
+		if _, ok := newValues[path]; !ok {
+			diff.Changes = append(diff.Changes, ConfigChange{Path: path, Old: ov})
+		}
+	}
+	sort.Slice(diff.Changes, func(a, b int) bool { return diff.Changes[a].Path < diff.Changes[b].Path })
+
+	oldSc, newSc := findCommonConfig(oldCfg), findCommonConfig(newCfg)
+	if oldSc == nil || newSc == nil {
+		return diff
+	}
+	oldServices := make(map[string]NetServices)
+	for _, cp := range oldSc.Services {
+		oldServices[cp.Name] = cp
+	}
+	for _, cp := range newSc.Services {
+		prev, ok := oldServices[cp.Name]
+		switch {
+		case !ok:
+			diff.ServicesAdded = append(diff.ServicesAdded, cp.Name)
+		case !reflect.DeepEqual(prev, cp):
+			diff.ServicesChanged = append(diff.ServicesChanged, cp.Name)
+		}
+		delete(oldServices, cp.Name)
+	}
+	for name := range oldServices {
+		diff.ServicesRemoved = append(diff.ServicesRemoved, name)
+	}
+	sort.Strings(diff.ServicesRemoved)
+	return diff
+}
+
+// configValues maps the path of every configuration value to the value,
+// list elements with a Name field are selected by it.
+func configValues(rv reflect.Value, path string, values map[string]interface{}) {
+	switch {
+	case rv.Kind() == reflect.Struct:
+		rt := rv.Type()
+		for i := 0; i < rt.NumField(); i++ {
+			if name := configFieldName(rt.Field(i)); name != "" {
+				configValues(rv.Field(i), joinConfigPath(path, name), values)
+			}
+		}
+	case rv.Kind() == reflect.Slice && rv.Type().Elem().Kind() == reflect.Struct:
+		for i := 0; i < rv.Len(); i++ {
+			key := fmt.Sprint(i)
+			if nf := rv.Index(i).FieldByName("Name"); nf.IsValid() && nf.Kind() == reflect.String && nf.String() != "" {
+				key = nf.String()
+			}
+			configValues(rv.Index(i), joinConfigPath(path, key), values)
+		}
+	case rv.Kind() == reflect.Interface, rv.Kind() == reflect.Func, rv.Kind() == reflect.Chan:
+	default:
+		values[path] = rv.Interface()
+	}
+}
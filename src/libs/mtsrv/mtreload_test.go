@@ -0,0 +1,206 @@
+package mtsrv
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigReload(t *testing.T) {
+	root := t.TempDir()
+	file := writeTestConfig(t, "helloworld.json", `{
+    "ServiceCommonConfig": {
+        "ServiceName": "helloworld",
+        "RootPath": "`+root+`",
+        "Services": [
+            {"Name": "kafka", "Port": 9092, "Topics": ["TutorialTopic"]},
+            {"Name": "health", "Frequency": 60}
+        ]
+    }
+}`)
+	cfg := testServiceConfig{}
+	assert.Nil(t, NewConfigLoader().Load(file, &cfg))
+
+	saved := ConfigWatchInterval
+	ConfigWatchInterval = 20 * time.Millisecond
+	defer func() { ConfigWatchInterval = saved }()
+
+	srv := NewServer(&cfg.ScCfg)
+	assert.Nil(t, srv.WatchConfig(file, &cfg))
+	diffs := make(chan *ConfigDiff, 4)
+	srv.SubscribeConfig(func(diff *ConfigDiff) { diffs <- diff })
+
+	var mu sync.Mutex
+	var started, stopped []string
+	disp := func(ctx context.Context, cp *NetServices, level int) error {
+		mu.Lock()
+		started = append(started, cp.Name)
+		mu.Unlock()
+		srv.SetReady(cp.Name)
+		<-ctx.Done()
+		mu.Lock()
+		stopped = append(stopped, cp.Name)
+		mu.Unlock()
+		return nil
+	}
+	loopDone := make(chan struct{})
+	go func() {
+		srv.RunCommonLoop(&cfg.ScCfg, disp)
+		close(loopDone)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// invalid, the current configuration stays
+	assert.Nil(t, ioutil.WriteFile(file, []byte(`{"ServiceCommonConfig": {"Threads": -1}}`), 0644))
+	diff, err := srv.Reload()
+	assert.Nil(t, diff)
+	assert.NotNil(t, err)
+
+	assert.Nil(t, ioutil.WriteFile(file, []byte(`{
+    "ServiceCommonConfig": {
+        "ServiceName": "helloworld",
+        "RootPath": "`+root+`",
+        "Services": [
+            {"Name": "kafka", "Port": 9092, "Topics": ["TutorialTopic", "SrvsHealthTopic"]},
+            {"Name": "zvault", "Port": 8200}
+        ]
+    }
+}`), 0644))
+	// picked up by the watch
+	select {
+	case diff = <-diffs:
+	case <-time.After(2 * time.Second):
+		t.Fatal("configuration change not noticed")
+	}
+	assert.Equal(t, []string{"kafka"}, diff.ServicesChanged)
+	assert.Equal(t, []string{"health"}, diff.ServicesRemoved)
+	assert.Equal(t, []string{"zvault"}, diff.ServicesAdded)
+	assert.Contains(t, diff.Changes, ConfigChange{Path: "ServiceCommonConfig.Services.kafka.Topics",
+		Old: []string{"TutorialTopic"}, New: []string{"TutorialTopic", "SrvsHealthTopic"}})
+	assert.Equal(t, uint32(8200), diff.Config.(*testServiceConfig).ScCfg.Services[1].Port)
+	assert.Equal(t, []string{"TutorialTopic"}, cfg.ScCfg.Services[0].Topics)
+	// a removed service is not ready, a restarted one once it is up again
+	assert.False(t, srv.IsReady("health"))
+	assert.Eventually(t, func() bool {
+		return srv.IsReady("kafka") && srv.IsReady("zvault")
+	}, time.Second, 10*time.Millisecond)
+
+	// nothing changed
+	diff, err = srv.Reload()
+	assert.Nil(t, diff)
+	assert.Nil(t, err)
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, EXIT_OK, srv.Shutdown())
+	<-loopDone
+	mu.Lock()
+	assert.ElementsMatch(t, []string{"kafka", "health"}, started[:2])
+	assert.ElementsMatch(t, []string{"kafka", "zvault"}, started[2:])
+	assert.ElementsMatch(t, []string{"kafka", "health", "kafka", "zvault"}, stopped)
+	mu.Unlock()
+}
+
+func TestConfigReloadIncludes(t *testing.T) {
+	file := writeTestConfig(t, "helloworld.json", `{
+    "Include": "base.json",
+    "ServiceCommonConfig": {"ServiceName": "helloworld"}
+}`)
+	base := filepath.Join(filepath.Dir(file), "base.json")
+	assert.Nil(t, ioutil.WriteFile(base, []byte(`{
+    "ServiceCommonConfig": {
+        "Services": [{"Name": "kafka", "Port": 9092}]
+    }
+}`), 0644))
+	cl := NewConfigLoader()
+	cfg := testServiceConfig{}
+	assert.Nil(t, cl.Load(file, &cfg))
+	assert.Equal(t, []string{file, base}, cl.Files())
+
+	saved := ConfigWatchInterval
+	ConfigWatchInterval = 20 * time.Millisecond
+	defer func() { ConfigWatchInterval = saved }()
+
+	srv := NewServer(&cfg.ScCfg)
+	assert.Nil(t, srv.WatchConfig(file, &cfg))
+	diffs := make(chan *ConfigDiff, 4)
+	srv.SubscribeConfig(func(diff *ConfigDiff) { diffs <- diff })
+	srv.Scheduler().Start()
+	defer srv.Scheduler().Stop()
+
+	// only the included file changes
+	assert.Nil(t, ioutil.WriteFile(base, []byte(`{
+    "ServiceCommonConfig": {
+        "Services": [{"Name": "kafka", "Port": 9093}]
+    }
+}`), 0644))
+	select {
+	case diff := <-diffs:
+		assert.Equal(t, []string{"kafka"}, diff.ServicesChanged)
+	case <-time.After(2 * time.Second):
+		t.Fatal("change of the included file not noticed")
+	}
+}
+
+func TestConfigReloadDuringShutdown(t *testing.T) {
+	root := t.TempDir()
+	file := writeTestConfig(t, "helloworld.json", `{
+    "ServiceCommonConfig": {
+        "ServiceName": "helloworld",
+        "RootPath": "`+root+`",
+        "Services": [{"Name": "kafka", "Port": 9092}]
+    }
+}`)
+	cfg := testServiceConfig{}
+	assert.Nil(t, NewConfigLoader().Load(file, &cfg))
+	srv := NewServer(&cfg.ScCfg)
+	assert.Nil(t, srv.WatchConfig(file, &cfg))
+
+	var mu sync.Mutex
+	var started []string
+	draining := make(chan struct{})
+	disp := func(ctx context.Context, cp *NetServices, level int) error {
+		mu.Lock()
+		started = append(started, cp.Name)
+		mu.Unlock()
+		<-ctx.Done()
+		if cp.Name == "kafka" {
+			close(draining)
+			time.Sleep(100 * time.Millisecond)
+		}
+		return nil
+	}
+	loopDone := make(chan struct{})
+	go func() {
+		srv.RunCommonLoop(&cfg.ScCfg, disp)
+		close(loopDone)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	shutdown := make(chan int)
+	go func() { shutdown <- srv.Shutdown() }()
+	<-draining
+	// a reload landing during the drain starts nothing
+	assert.Nil(t, ioutil.WriteFile(file, []byte(`{
+    "ServiceCommonConfig": {
+        "ServiceName": "helloworld",
+        "RootPath": "`+root+`",
+        "Services": [{"Name": "kafka", "Port": 9093}, {"Name": "zvault", "Port": 8200}]
+    }
+}`), 0644))
+	diff, err := srv.Reload()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"zvault"}, diff.ServicesAdded)
+	assert.Equal(t, EXIT_OK, <-shutdown)
+	<-loopDone
+
+	time.Sleep(50 * time.Millisecond)
+	mu.Lock()
+	assert.Equal(t, []string{"kafka"}, started)
+	mu.Unlock()
+	assert.Equal(t, 0, len(srv.Scheduler().Status()))
+}
@@ -0,0 +1,212 @@
+package mtsrv
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+// A configuration file ending in .mustache is rendered before it is
+// parsed, with the subset of mustache used by the runfiles:
+//
+//   {{VAR}}          the value, HTML escaped as mustache does
+//   {{{VAR}}}        the raw value, also {{&VAR}}
+//   {{#VAR}}..{{/VAR}}  kept when VAR is set, not empty and not "false"
+//   {{^VAR}}..{{/VAR}}  kept otherwise
+//   {{! comment}}
+//
+// Values come from the environment and, with lower precedence, from the
+// JSON object in the -cfg-values file. A variable used as a value that
+// is set in neither is an error.
+const templateSuffix = ".mustache"
+
+type tmplNode struct {
+	kind     byte // 0 text, 'v' escaped, '&' raw, '#' section, '^' inverted
+	name     string
+	text     string
+	line     int
+	children []*tmplNode
+}
+
+// MissingValuesError lists the variables a template uses without a
+// value, with the line of their first use.
+type MissingValuesError struct {
+	File    string
+	Missing map[string]int
+}
+
+func (me *MissingValuesError) Error() string {
+	names := make([]string, 0, len(me.Missing))
+	for name := range me.Missing {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	msgs := make([]string, 0, len(names))
+	for _, name := range names {
+		msgs = append(msgs, fmt.Sprintf("%v (line %d)", name, me.Missing[name]))
+	}
+	return fmt.Sprintf("%v: no value for %s", me.File, strings.Join(msgs, ", "))
+}
+
+// RenderTemplate renders the mustache template tmpl with values, name
+// is only used in errors.
+func RenderTemplate(name, tmpl string, values map[string]string) (string, error) {
+	nodes, err := parseTemplate(name, tmpl)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	missing := make(map[string]int)
+	renderNodes(&b, nodes, values, missing)
+	if len(missing) != 0 {
+		return "", &MissingValuesError{File: name, Missing: missing}
+	}
+	return b.String(), nil
+}
+
+// RenderConfig renders the template configFile with the values of the
+// environ list ("KEY=VALUE") over the ones of valuesFile, which may be "".
+func RenderConfig(configFile, valuesFile string, environ []string) ([]byte, error) {
+	body, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read configuration [%v]: %v", configFile, err)
+	}
+	values := make(map[string]string)
+	if valuesFile != "" {
+		vbody, err := ioutil.ReadFile(valuesFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read template values [%v]: %v", valuesFile, err)
+		}
+		fileValues := make(map[string]interface{})
+		if err := json.Unmarshal(vbody, &fileValues); err != nil {
+			return nil, fmt.Errorf("failed to parse template values [%v]: %v", valuesFile, err)
+		}
+		for k, v := range fileValues {
+			if v != nil {
+				values[k] = fmt.Sprint(v)
+			}
+		}
+	}
+	for _, kv := range environ {
+		if i := strings.Index(kv, "="); i > 0 {
+			values[kv[:i]] = kv[i+1:]
+		}
+	}
+	out, err := RenderTemplate(configFile, string(body), values)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(out), nil
+}
+
+func parseTemplate(name, tmpl string) ([]*tmplNode, error) {
+	root := &tmplNode{}
+	stack := []*tmplNode{root}
+	pos := 0
+	for {
+		start := strings.Index(tmpl[pos:], "{{")
+		if start < 0 {
+			break
+		}
+		start += pos
+		line := 1 + strings.Count(tmpl[:start], "\n")
+
+		closing := "}}"
+		if strings.HasPrefix(tmpl[start:], "{{{") {
+			closing = "}}}"
+		}
+		end := strings.Index(tmpl[start+len(closing):], closing)
+		if end < 0 {
+			return nil, fmt.Errorf("%v:%d: unclosed tag", name, line)
+		}
+		end += start + 2*len(closing)
+		tag := strings.TrimSpace(tmpl[start+len(closing) : end-len(closing)])
+
+		kind := byte('v')
+		if closing == "}}}" {
+			kind = '&'
+		} else if tag != "" && strings.IndexByte("#^/!&", tag[0]) >= 0 {
+			kind = tag[0]
+			tag = strings.TrimSpace(tag[1:])
+		}
+		if tag == "" && kind != '!' {
+			return nil, fmt.Errorf("%v:%d: empty tag", name, line)
+		}
+
+		// a section or comment tag alone on its line takes the line away
+		text, next := tmpl[pos:start], end
+		if strings.IndexByte("#^/!", kind) >= 0 {
+			lineStart := strings.LastIndexByte(tmpl[:start], '\n') + 1
+			lineEnd := strings.IndexByte(tmpl[end:], '\n')
+			if lineEnd < 0 {
+				lineEnd = len(tmpl) - end
+			}
+			if lineStart >= pos && strings.TrimSpace(tmpl[lineStart:start]) == "" &&
+				strings.TrimSpace(tmpl[end:end+lineEnd]) == "" {
+				text = tmpl[pos:lineStart]
+				next = end + lineEnd
+				if next < len(tmpl) {
+					next++
+				}
+			}
+		}
+
+		top := stack[len(stack)-1]
+		if text != "" {
+			top.children = append(top.children, &tmplNode{text: text})
+		}
+		switch kind {
+		case '!':
+		case '#', '^':
+			n := &tmplNode{kind: kind, name: tag, line: line}
+			top.children = append(top.children, n)
+			stack = append(stack, n)
+		case '/':
+			if len(stack) == 1 || top.name != tag {
+				return nil, fmt.Errorf("%v:%d: unexpected {{/%v}}", name, line, tag)
+			}
+			stack = stack[:len(stack)-1]
+		default:
+			top.children = append(top.children, &tmplNode{kind: kind, name: tag, line: line})
+		}
+		pos = next
+	}
+	if len(stack) != 1 {
+		open := stack[len(stack)-1]
+		return nil, fmt.Errorf("%v:%d: {{#%v}} is not closed", name, open.line, open.name)
+	}
+	if pos < len(tmpl) {
+		root.children = append(root.children, &tmplNode{text: tmpl[pos:]})
+	}
+	return root.children, nil
+}
+
+func renderNodes(b *strings.Builder, nodes []*tmplNode, values map[string]string, missing map[string]int) {
+	for _, n := range nodes {
+		switch n.kind {
+		case 0:
+			b.WriteString(n.text)
+		case 'v', '&':
+			v, ok := values[n.name]
+			if !ok {
+				if _, seen := missing[n.name]; !seen {
+					missing[n.name] = n.line
+				}
+				continue
+			}
+			if n.kind == 'v' {
+				v = html.EscapeString(v)
+			}
+			b.WriteString(v)
+		case '#', '^':
+			v, ok := values[n.name]
+			set := ok && v != "" && !strings.EqualFold(v, "false")
+			if set == (n.kind == '#') {
+				renderNodes(b, n.children, values, missing)
+			}
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package mtsrv
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderTemplate(t *testing.T) {
+	tmpl := `{
+{{! rendered by mtsrv }}
+    "LogCfg": {
+    {{#LOG_TO_STDOUT}}
+        "LogToStdout": true,
+    {{/LOG_TO_STDOUT}}
+    {{^LOG_TO_STDOUT}}
+        "Path": "{{LOG_PATH}}",
+    {{/LOG_TO_STDOUT}}
+        "Level": {{LEVEL}}
+    },
+    "Password": "{{{PASSWORD}}}", "User": "{{ USER }}"
+}`
+	values := map[string]string{"LOG_TO_STDOUT": "true", "LEVEL": "1", "PASSWORD": "a<b", "USER": "a<b"}
+	out, err := RenderTemplate("t", tmpl, values)
+	assert.Nil(t, err)
+	assert.Equal(t, `{
+    "LogCfg": {
+        "LogToStdout": true,
+        "Level": 1
+    },
+    "Password": "a<b", "User": "a&lt;b"
+}`, out)
+
+	values["LOG_TO_STDOUT"] = "false"
+	out, err = RenderTemplate("t", tmpl, values)
+	assert.NotNil(t, err)
+	assert.Equal(t, "t: no value for LOG_PATH (line 8)", err.Error())
+
+	delete(values, "LEVEL")
+	_, err = RenderTemplate("t", tmpl, values)
+	assert.Equal(t, map[string]int{"LOG_PATH": 8, "LEVEL": 10}, err.(*MissingValuesError).Missing)
+
+	_, err = RenderTemplate("t", "{{#A}}\n{{/B}}", values)
+	assert.EqualError(t, err, "t:2: unexpected {{/B}}")
+	_, err = RenderTemplate("t", "{{#A}}\n", values)
+	assert.EqualError(t, err, "t:1: {{#A}} is not closed")
+	_, err = RenderTemplate("t", "{{A", values)
+	assert.EqualError(t, err, "t:1: unclosed tag")
+}
+
+func TestLoadTemplateConfig(t *testing.T) {
+	file := writeTestConfig(t, "helloworld.json.mustache", `{
+    "ServiceCommonConfig": {
+        "ServiceName": "{{SERVICE}}",
+        "Services": [{"Name": "kafka", "Port": {{KAFKA01_PORT}}}]
+    }
+}`)
+	values := writeTestConfig(t, "values.json", `{"SERVICE": "helloworld", "KAFKA01_PORT": 9092}`)
+
+	cl := &ConfigLoader{EnvPrefix: ConfigEnvPrefix, Values: values, Environ: []string{"KAFKA01_PORT=9093"}}
+	cfg := testServiceConfig{}
+	assert.Nil(t, cl.Load(file, &cfg))
+	assert.Equal(t, "helloworld", cfg.ScCfg.ServiceName)
+	assert.Equal(t, uint32(9093), cfg.ScCfg.Services[0].Port)
+
+	cl.Values = ""
+	err := cl.Load(file, &testServiceConfig{})
+	assert.Contains(t, err.Error(), "no value for SERVICE (line 3)")
+}
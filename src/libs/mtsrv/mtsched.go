@@ -0,0 +1,260 @@
+package mtsrv
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mtbox/metrics"
+	"github.com/mtbox/mtlog"
+)
+
+// What to do when a job is due while its previous run is still going.
+type OverlapPolicy int
+
+const (
+	// OverlapSkip drops the run, it is counted in JobStatus.Skipped.
+	OverlapSkip OverlapPolicy = iota
+	// OverlapQueue runs it as soon as the previous run returns. Only
+	// one run is queued, more due runs are skipped.
+	OverlapQueue
+)
+
+// JobFunc is one run of a periodic job, ctx is cancelled on timeout
+// and when the scheduler stops.
+type JobFunc func(ctx context.Context) error
+
+// JobSpec describes a periodic job. Each run is started after
+// Interval plus a random delay up to Jitter, Timeout of 0 means the
+// run is only cancelled when the scheduler stops.
+type JobSpec struct {
+	Name     string
+	Interval time.Duration
+	Jitter   time.Duration
+	Timeout  time.Duration
+	Overlap  OverlapPolicy
+	Fn       JobFunc
+}
+
+// JobStatus is the bookkeeping of one job.
+type JobStatus struct {
+	Name         string
+	LastRun      time.Time
+	LastDuration time.Duration
+	LastError    string
+	Runs         uint64
+	Failures     uint64
+	Skipped      uint64
+	Running      bool
+}
+
+type job struct {
+	spec   JobSpec
+	status JobStatus
+	queued bool
+	cancel context.CancelFunc
+}
+
+// Scheduler runs the named periodic jobs of a server.
+type Scheduler struct {
+	sync.Mutex
+	jobs    map[string]*job
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	started bool
+}
+
+func NewScheduler() *Scheduler {
+	sc := &Scheduler{jobs: make(map[string]*job)}
+	sc.ctx, sc.cancel = context.WithCancel(context.Background())
+	return sc
+}
+
+// Register adds a job, it starts right away when the scheduler is
+// already running.
+func (sc *Scheduler) Register(spec JobSpec) error {
+	if spec.Name == "" || spec.Fn == nil {
+		return fmt.Errorf("job needs a name and a function")
+	}
+	if spec.Interval <= 0 {
+		return fmt.Errorf("job %v: interval must be positive", spec.Name)
+	}
+
+	sc.Lock()
+	defer sc.Unlock()
+	if _, ok := sc.jobs[spec.Name]; ok {
+		return fmt.Errorf("job %v is already registered", spec.Name)
+	}
+	if sc.ctx.Err() != nil {
+		return fmt.Errorf("scheduler is stopped")
+	}
+	j := &job{spec: spec, status: JobStatus{Name: spec.Name}}
+	sc.jobs[spec.Name] = j
+	if sc.started {
+		sc.startLocked(j)
+	}
+	return nil
+}
+
+// Unregister stops scheduling the job, a run in progress is cancelled.
+func (sc *Scheduler) Unregister(name string) {
+	sc.Lock()
+	defer sc.Unlock()
+	if j, ok := sc.jobs[name]; ok {
+		if j.cancel != nil {
+			j.cancel()
+		}
+		delete(sc.jobs, name)
+	}
+}
+
+// Start all the registered jobs.
+func (sc *Scheduler) Start() {
+	sc.Lock()
+	defer sc.Unlock()
+	if sc.started {
+		return
+	}
+	sc.started = true
+	for _, j := range sc.jobs {
+		sc.startLocked(j)
+	}
+}
+
+// Stop cancels all the jobs and waits for the running ones to return.
+func (sc *Scheduler) Stop() {
+	sc.cancel()
+	sc.wg.Wait()
+}
+
+// Status of every job, sorted by name.
+func (sc *Scheduler) Status() []JobStatus {
+	sc.Lock()
+	defer sc.Unlock()
+	st := make([]JobStatus, 0, len(sc.jobs))
+	for _, j := range sc.jobs {
+		st = append(st, j.status)
+	}
+	sort.Slice(st, func(a, b int) bool { return st[a].Name < st[b].Name })
+	return st
+}
+
+// Collect reports the runs of every job in the metrics registry.
+func (sc *Scheduler) Collect() []metrics.Sample {
+	var samples []metrics.Sample
+	for _, st := range sc.Status() {
+		samples = append(samples,
+			metrics.CounterSample(st.Name+".Runs", "scheduler_job_runs_total."+st.Name, st.Runs),
+			metrics.CounterSample(st.Name+".Failures", "scheduler_job_failures_total."+st.Name, st.Failures),
+			metrics.CounterSample(st.Name+".Skipped", "scheduler_job_skipped_total."+st.Name, st.Skipped),
+			metrics.GaugeSample(st.Name+".LastDuration", "scheduler_job_last_duration_ns."+st.Name,
+				int64(st.LastDuration)))
+	}
+	return samples
+}
+
+func (sc *Scheduler) startLocked(j *job) {
+	ctx, cancel := context.WithCancel(sc.ctx)
+	j.cancel = cancel
+	sc.wg.Add(1)
+	go func() {
+		defer sc.wg.Done()
+		sc.loop(ctx, j)
+	}()
+}
+
+func (sc *Scheduler) loop(ctx context.Context, j *job) {
+	timer := time.NewTimer(nextDelay(j.spec))
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		sc.trigger(ctx, j)
+		timer.Reset(nextDelay(j.spec))
+	}
+}
+
+func nextDelay(spec JobSpec) time.Duration {
+	d := spec.Interval
+	if spec.Jitter > 0 {
+		d += time.Duration(rand.Int63n(int64(spec.Jitter)))
+	}
+	return d
+}
+
+// start a run, or apply the overlap policy when one is in progress.
+func (sc *Scheduler) trigger(ctx context.Context, j *job) {
+	sc.Lock()
+	defer sc.Unlock()
+	if j.status.Running {
+		if j.spec.Overlap == OverlapQueue && !j.queued {
+			j.queued = true
+		} else {
+			j.status.Skipped++
+			mtlog.Warnf("Job %v is still running, skipped", j.spec.Name)
+		}
+		return
+	}
+	j.status.Running = true
+	sc.wg.Add(1)
+	go func() {
+		defer sc.wg.Done()
+		sc.run(ctx, j)
+	}()
+}
+
+// run the job until nothing is queued for it. The scheduler is locked
+// between the runs, Running and queued are reset however run returns.
+func (sc *Scheduler) run(ctx context.Context, j *job) {
+	sc.Lock()
+	defer func() {
+		j.queued = false
+		j.status.Running = false
+		sc.Unlock()
+	}()
+	for {
+		sc.Unlock()
+		runCtx, cancel := ctx, context.CancelFunc(func() {})
+		if j.spec.Timeout > 0 {
+			runCtx, cancel = context.WithTimeout(ctx, j.spec.Timeout)
+		}
+		start := time.Now()
+		err := callJob(runCtx, j.spec)
+		cancel()
+		elapsed := time.Since(start)
+
+		sc.Lock()
+		j.status.LastRun = start
+		j.status.LastDuration = elapsed
+		j.status.Runs++
+		j.status.LastError = ""
+		if err != nil {
+			j.status.Failures++
+			j.status.LastError = err.Error()
+			mtlog.Errorf("Job %v failed after %v: %v", j.spec.Name, elapsed, err)
+		}
+		if !j.queued || ctx.Err() != nil {
+			return
+		}
+		j.queued = false
+	}
+}
+
+// callJob runs spec.Fn once, a panic is returned as an error with its
+// stack.
+func callJob(ctx context.Context, spec JobSpec) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v\n%s", r, debug.Stack())
+		}
+	}()
+	return spec.Fn(ctx)
+}
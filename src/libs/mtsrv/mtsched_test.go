@@ -0,0 +1,85 @@
+package mtsrv
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSchedulerOverlap(t *testing.T) {
+	sc := NewScheduler()
+	var skipRuns, queueRuns int32
+	slow := func(n *int32) JobFunc {
+		return func(ctx context.Context) error {
+			atomic.AddInt32(n, 1)
+			time.Sleep(25 * time.Millisecond)
+			return errors.New("slow")
+		}
+	}
+	// a skipped run waits for the next interval, a queued one does not
+	assert.Nil(t, sc.Register(JobSpec{Name: "skip", Interval: 20 * time.Millisecond, Fn: slow(&skipRuns)}))
+	assert.Nil(t, sc.Register(JobSpec{Name: "queue", Interval: 20 * time.Millisecond,
+		Overlap: OverlapQueue, Fn: slow(&queueRuns)}))
+	assert.NotNil(t, sc.Register(JobSpec{Name: "skip", Interval: time.Second, Fn: slow(&skipRuns)}))
+	sc.Start()
+	time.Sleep(250 * time.Millisecond)
+	sc.Stop()
+
+	st := sc.Status()
+	assert.Equal(t, "queue", st[0].Name)
+	assert.Equal(t, "skip", st[1].Name)
+	assert.True(t, st[1].Skipped > 0)
+	assert.True(t, st[0].Runs > st[1].Runs)
+	assert.Equal(t, "slow", st[1].LastError)
+	assert.Equal(t, st[1].Runs, st[1].Failures)
+	assert.False(t, st[0].Running)
+	assert.Equal(t, uint64(atomic.LoadInt32(&skipRuns)), st[1].Runs)
+
+	// nothing runs after stop
+	runs := atomic.LoadInt32(&queueRuns)
+	time.Sleep(30 * time.Millisecond)
+	assert.Equal(t, runs, atomic.LoadInt32(&queueRuns))
+	assert.NotNil(t, sc.Register(JobSpec{Name: "late", Interval: time.Second, Fn: slow(&skipRuns)}))
+}
+
+func TestSchedulerTimeout(t *testing.T) {
+	sc := NewScheduler()
+	sc.Start()
+	done := make(chan error, 1)
+	assert.Nil(t, sc.Register(JobSpec{Name: "timeout", Interval: 5 * time.Millisecond, Timeout: 5 * time.Millisecond,
+		Fn: func(ctx context.Context) error {
+			<-ctx.Done()
+			select {
+			case done <- ctx.Err():
+			default:
+			}
+			return ctx.Err()
+		}}))
+	assert.Equal(t, context.DeadlineExceeded, <-done)
+	sc.Stop()
+}
+
+func TestSchedulerPanic(t *testing.T) {
+	sc := NewScheduler()
+	var runs int32
+	assert.Nil(t, sc.Register(JobSpec{Name: "panic", Interval: 5 * time.Millisecond,
+		Fn: func(ctx context.Context) error {
+			atomic.AddInt32(&runs, 1)
+			panic("bad job")
+		}}))
+	sc.Start()
+	defer sc.Stop()
+
+	// recorded as a failure and run again
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&runs) >= 2
+	}, 2*time.Second, time.Millisecond)
+	st := sc.Status()[0]
+	assert.True(t, st.Failures >= 1)
+	assert.Contains(t, st.LastError, "panic: bad job")
+	assert.Contains(t, st.LastError, "runtime/debug.Stack")
+}
@@ -0,0 +1,296 @@
+package mtsrv
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mtbox/mtlog"
+)
+
+// A configuration string of the form <scheme>://<ref> is a secret
+// reference when a SecretProvider is registered for the scheme, it is
+// replaced by the secret when the configuration is loaded:
+//
+//   secret://<file path>   the content of the file, e.g. a docker secret
+//   env://<NAME>           the environment variable NAME
+//   vault://<path>#<key>   the key of a vault KV secret, VAULT_ADDR and
+//                          VAULT_TOKEN locate the vault
+//
+// Resolved secrets are written back as their reference by StoreConfig
+// and are redacted from the logs.
+type SecretProvider interface {
+	Resolve(ref string) (string, error)
+}
+
+const vaultTimeout = 10 * time.Second
+
+var secrets = struct {
+	sync.Mutex
+	providers map[string]SecretProvider
+	// resolved secrets by their JSON path
+	refs map[string]secretRef
+}{
+	providers: map[string]SecretProvider{
+		"secret": FileSecretProvider{},
+		"env":    EnvSecretProvider{},
+		"vault":  &VaultSecretProvider{},
+	},
+	refs: make(map[string]secretRef),
+}
+
+type secretRef struct {
+	value string
+	ref   string
+}
+
+// RegisterSecretProvider adds or replaces the provider of scheme, a
+// nil provider removes it.
+func RegisterSecretProvider(scheme string, p SecretProvider) {
+	secrets.Lock()
+	defer secrets.Unlock()
+	if p == nil {
+		delete(secrets.providers, scheme)
+		return
+	}
+	secrets.providers[scheme] = p
+}
+
+func secretProvider(s string) (SecretProvider, string, string, bool) {
+	i := strings.Index(s, "://")
+	if i <= 0 {
+		return nil, "", "", false
+	}
+	secrets.Lock()
+	defer secrets.Unlock()
+	p, ok := secrets.providers[s[:i]]
+	return p, s[:i], s[i+3:], ok
+}
+
+// isSecretRef tells whether s is a reference of a registered provider.
+func isSecretRef(s string) bool {
+	_, _, _, ok := secretProvider(s)
+	return ok
+}
+
+// FileSecretProvider reads the secret from a file, without the trailing
+// newline.
+type FileSecretProvider struct{}
+
+func (FileSecretProvider) Resolve(ref string) (string, error) {
+	body, err := ioutil.ReadFile(ref)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(body), "\r\n"), nil
+}
+
+// EnvSecretProvider reads the secret from an environment variable.
+type EnvSecretProvider struct{}
+
+func (EnvSecretProvider) Resolve(ref string) (string, error) {
+	v, ok := os.LookupEnv(ref)
+	if !ok {
+		return "", fmt.Errorf("environment variable %v is not set", ref)
+	}
+	return v, nil
+}
+
+// VaultSecretProvider reads the secret from the vault HTTP API, both
+// KV version 1 and 2 secrets work. Addr and Token default to the
+// VAULT_ADDR and VAULT_TOKEN environment variables.
+type VaultSecretProvider struct {
+	Addr   string
+	Token  string
+	Client *http.Client
+}
+
+func (vp *VaultSecretProvider) Resolve(ref string) (string, error) {
+	i := strings.LastIndex(ref, "#")
+	if i <= 0 || i == len(ref)-1 {
+		return "", fmt.Errorf("vault reference must be <path>#<key>")
+	}
+	path, key := strings.Trim(ref[:i], "/"), ref[i+1:]
+
+	addr, token, client := vp.Addr, vp.Token, vp.Client
+	if addr == "" {
+		addr = os.Getenv("VAULT_ADDR")
+	}
+	if token == "" {
+		token = os.Getenv("VAULT_TOKEN")
+	}
+	if client == nil {
+		client = &http.Client{Timeout: vaultTimeout}
+	}
+	if addr == "" {
+		return "", fmt.Errorf("no vault address, set VAULT_ADDR")
+	}
+
+	req, err := http.NewRequest(http.MethodGet, strings.TrimRight(addr, "/")+"/v1/"+path, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("vault returned %v for %v", resp.Status, path)
+	}
+
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return "", fmt.Errorf("bad vault response for %v: %v", path, err)
+	}
+	data := secret.Data
+	// KV version 2 nests the secret in data.data
+	if inner, ok := data["data"].(map[string]interface{}); ok {
+		if _, ok := data["metadata"]; ok {
+			data = inner
+		}
+	}
+	v, ok := data[key]
+	if !ok || v == nil {
+		return "", fmt.Errorf("vault secret %v has no key %v", path, key)
+	}
+	if s, ok := v.(string); ok {
+		return s, nil
+	}
+	return fmt.Sprint(v), nil
+}
+
+// ResolveSecrets replaces every secret reference in srvCfg, a pointer
+// to the configuration struct. All the failures are returned as
+// ConfigErrors.
+func ResolveSecrets(srvCfg interface{}) error {
+	refs, errs := resolveSecrets(srvCfg)
+	if len(errs) != 0 {
+		return errs.sorted()
+	}
+	keepSecrets(refs)
+	return nil
+}
+
+// resolveSecrets resolves the references of srvCfg, the values are
+// redacted right away, see keepSecrets.
+func resolveSecrets(srvCfg interface{}) (map[string]secretRef, ConfigErrors) {
+	var errs ConfigErrors
+	refs := make(map[string]secretRef)
+	walkConfigStrings(reflect.ValueOf(srvCfg), "$", func(sv reflect.Value, path string) {
+		ref := sv.String()
+		p, scheme, name, ok := secretProvider(ref)
+		if !ok {
+			return
+		}
+		if !sv.CanSet() {
+			errs.add(path, "cannot set secret %v", ref)
+			return
+		}
+		v, err := p.Resolve(name)
+		if err != nil {
+			errs.add(path, "%v secret %v: %v", scheme, ref, err)
+			return
+		}
+		refs[path] = secretRef{value: v, ref: ref}
+		mtlog.Redact(v)
+		sv.SetString(v)
+	})
+	return refs, errs
+}
+
+// keepSecrets replaces the secrets of the previous configuration with
+// refs once a configuration is loaded, the rotated ones are no longer
+// redacted.
+func keepSecrets(refs map[string]secretRef) {
+	values := make([]string, 0, len(refs))
+	for _, sr := range refs {
+		values = append(values, sr.value)
+	}
+	secrets.Lock()
+	secrets.refs = refs
+	secrets.Unlock()
+	mtlog.SetRedacted(values)
+}
+
+// walkConfigStrings calls fn with every string of rv and its JSON path.
+func walkConfigStrings(rv reflect.Value, path string, fn func(sv reflect.Value, path string)) {
+	switch rv.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if !rv.IsNil() {
+			walkConfigStrings(rv.Elem(), path, fn)
+		}
+	case reflect.Struct:
+		rt := rv.Type()
+		for i := 0; i < rt.NumField(); i++ {
+			sf := rt.Field(i)
+			name := configFieldName(sf)
+			if name == "" {
+				continue
+			}
+			// the fields of an embedded struct are at its level in JSON
+			if sf.Anonymous && sf.Tag.Get("json") == "" && sf.Type.Kind() == reflect.Struct {
+				walkConfigStrings(rv.Field(i), path, fn)
+				continue
+			}
+			walkConfigStrings(rv.Field(i), path+"."+name, fn)
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < rv.Len(); i++ {
+			walkConfigStrings(rv.Index(i), fmt.Sprintf("%s[%d]", path, i), fn)
+		}
+	case reflect.String:
+		fn(rv, path)
+	}
+}
+
+// hideSecrets encodes srvCfg as JSON with the references back in place
+// of the resolved secrets, by the path they were resolved at. srvCfg
+// may be a part of the resolved configuration, e.g. its
+// ServiceCommonConfig, the paths are then matched by their end.
+func hideSecrets(srvCfg interface{}) ([]byte, error) {
+	configJson, err := json.Marshal(srvCfg)
+	if err != nil {
+		return nil, err
+	}
+	secrets.Lock()
+	refs := make(map[string]secretRef, len(secrets.refs))
+	for path, sr := range secrets.refs {
+		refs[path] = sr
+	}
+	secrets.Unlock()
+	rv := reflect.ValueOf(srvCfg)
+	for rv.Kind() == reflect.Ptr || rv.Kind() == reflect.Interface {
+		if rv.IsNil() {
+			return configJson, nil
+		}
+		rv = rv.Elem()
+	}
+	if len(refs) == 0 {
+		return configJson, nil
+	}
+
+	// a copy, the configuration in use keeps the secrets
+	cp := reflect.New(rv.Type())
+	if err := json.Unmarshal(configJson, cp.Interface()); err != nil {
+		return nil, err
+	}
+	walkConfigStrings(cp, "$", func(sv reflect.Value, path string) {
+		for resolved, sr := range refs {
+			if sv.String() == sr.value && strings.HasSuffix(resolved, path[1:]) {
+				sv.SetString(sr.ref)
+				return
+			}
+		}
+	})
+	return json.Marshal(cp.Interface())
+}
@@ -0,0 +1,157 @@
+package mtsrv
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newVaultStandIn(t *testing.T) *httptest.Server {
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "root" {
+			http.Error(w, `{"errors":["permission denied"]}`, http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secret/data/cassandra":
+			w.Write([]byte(`{"data": {"data": {"password": "cass-vault-pw"}, "metadata": {"version": 1}}}`))
+		case "/v1/kv/zvault":
+			w.Write([]byte(`{"data": {"secret_id": "zvault-secret-id"}}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(vault.Close)
+	return vault
+}
+
+func TestVaultSecretProvider(t *testing.T) {
+	vault := newVaultStandIn(t)
+	vp := &VaultSecretProvider{Addr: vault.URL, Token: "root"}
+
+	v, err := vp.Resolve("secret/data/cassandra#password")
+	assert.Nil(t, err)
+	assert.Equal(t, "cass-vault-pw", v)
+	v, err = vp.Resolve("kv/zvault#secret_id")
+	assert.Nil(t, err)
+	assert.Equal(t, "zvault-secret-id", v)
+
+	_, err = vp.Resolve("kv/zvault#role_id")
+	assert.EqualError(t, err, "vault secret kv/zvault has no key role_id")
+	_, err = vp.Resolve("kv/zvault")
+	assert.NotNil(t, err)
+	_, err = vp.Resolve("kv/missing#key")
+	assert.EqualError(t, err, "vault returned 404 Not Found for kv/missing")
+	vp.Token = "bad"
+	_, err = vp.Resolve("kv/zvault#secret_id")
+	assert.EqualError(t, err, "vault returned 403 Forbidden for kv/zvault")
+}
+
+func TestConfigSecrets(t *testing.T) {
+	vault := newVaultStandIn(t)
+	RegisterSecretProvider("vault", &VaultSecretProvider{Addr: vault.URL, Token: "root"})
+	t.Cleanup(func() { RegisterSecretProvider("vault", &VaultSecretProvider{}) })
+
+	pwFile := writeTestConfig(t, "kafka.pw", "kafka-file-pw\n")
+	os.Setenv("MT_TEST_ZVAULT_PW", "zvault-env-pw")
+	t.Cleanup(func() { os.Unsetenv("MT_TEST_ZVAULT_PW") })
+
+	file := writeTestConfig(t, "helloworld.json", `{
+    "ServiceCommonConfig": {
+        "Services": [
+            {"Name": "cassandra", "Password": "vault://secret/data/cassandra#password"},
+            {"Name": "kafka", "Password": "secret://`+pwFile+`"},
+            {"Name": "zvault", "Password": "env://MT_TEST_ZVAULT_PW", "Server": "https://zvault"}
+        ]
+    }
+}`)
+	cl := &ConfigLoader{EnvPrefix: ConfigEnvPrefix}
+	cfg := testServiceConfig{}
+	assert.Nil(t, cl.Load(file, &cfg))
+	assert.Equal(t, "cass-vault-pw", cfg.ScCfg.Services[0].Password)
+	assert.Equal(t, "kafka-file-pw", cfg.ScCfg.Services[1].Password)
+	assert.Equal(t, "zvault-env-pw", cfg.ScCfg.Services[2].Password)
+	assert.Equal(t, "https://zvault", cfg.ScCfg.Services[2].Host)
+
+	stored := filepath.Join(filepath.Dir(file), "stored.json")
+	assert.Nil(t, StoreConfig(stored, &cfg))
+	body, err := ioutil.ReadFile(stored)
+	assert.Nil(t, err)
+	assert.Contains(t, string(body), `"Password":"vault://secret/data/cassandra#password"`)
+	assert.Contains(t, string(body), `"Password":"env://MT_TEST_ZVAULT_PW"`)
+	for _, pw := range []string{"cass-vault-pw", "kafka-file-pw", "zvault-env-pw"} {
+		assert.NotContains(t, string(body), pw)
+	}
+
+	file = writeTestConfig(t, "helloworld.json", `{
+    "ServiceCommonConfig": {
+        "Services": [
+            {"Name": "cassandra", "Password": "vault://secret/data/cassandra#user"},
+            {"Name": "kafka", "Password": "env://MT_TEST_UNSET"}
+        ]
+    }
+}`)
+	err = cl.Load(file, &testServiceConfig{})
+	assert.Equal(t, ConfigErrors{
+		{"$.ServiceCommonConfig.Services[0].Password",
+			"vault secret vault://secret/data/cassandra#user: vault secret secret/data/cassandra has no key user"},
+		{"$.ServiceCommonConfig.Services[1].Password",
+			"env secret env://MT_TEST_UNSET: environment variable MT_TEST_UNSET is not set"},
+	}, err)
+}
+
+func TestHideSecretsByPath(t *testing.T) {
+	os.Setenv("MT_TEST_SHORT_PW", "kafka")
+	t.Cleanup(func() { os.Unsetenv("MT_TEST_SHORT_PW") })
+
+	file := writeTestConfig(t, "helloworld.json", `{
+    "ServiceCommonConfig": {
+        "Services": [
+            {"Name": "kafka", "Kind": "kafka", "Password": "env://MT_TEST_SHORT_PW"},
+            {"Name": "health", "Kind": "health"}
+        ]
+    }
+}`)
+	cl := &ConfigLoader{EnvPrefix: ConfigEnvPrefix}
+	cfg := testServiceConfig{}
+	assert.Nil(t, cl.Load(file, &cfg))
+	assert.Equal(t, "kafka", cfg.ScCfg.Services[0].Password)
+
+	// only the resolved field gets its reference back
+	body, err := hideSecrets(&cfg)
+	assert.Nil(t, err)
+	assert.Contains(t, string(body), `"Name":"kafka","Kind":"kafka"`)
+	assert.Contains(t, string(body), `"Password":"env://MT_TEST_SHORT_PW"`)
+	// the configuration in use keeps the secret
+	assert.Equal(t, "kafka", cfg.ScCfg.Services[0].Password)
+
+	// a part of the configuration, as served by /config
+	body, err = hideSecrets(&cfg.ScCfg)
+	assert.Nil(t, err)
+	assert.Contains(t, string(body), `"Name":"kafka","Kind":"kafka"`)
+	assert.Contains(t, string(body), `"Password":"env://MT_TEST_SHORT_PW"`)
+
+	// a failed reload keeps the secrets in use
+	os.Unsetenv("MT_TEST_SHORT_PW")
+	assert.NotNil(t, cl.Load(file, &testServiceConfig{}))
+	body, err = hideSecrets(&cfg)
+	assert.Nil(t, err)
+	assert.Contains(t, string(body), `"Password":"env://MT_TEST_SHORT_PW"`)
+
+	// a reload forgets the secrets no longer used
+	file = writeTestConfig(t, "helloworld.json", `{
+    "ServiceCommonConfig": {
+        "Services": [{"Name": "kafka", "Kind": "kafka", "Password": "kafka"}]
+    }
+}`)
+	reloaded := testServiceConfig{}
+	assert.Nil(t, cl.Load(file, &reloaded))
+	body, err = hideSecrets(&reloaded)
+	assert.Nil(t, err)
+	assert.Contains(t, string(body), `"Password":"kafka"`)
+}
@@ -0,0 +1,129 @@
+package mtsrv
+
+import (
+	"context"
+	"time"
+
+	"github.com/mtbox/mtlog"
+)
+
+// Exit codes of RunCommonLoop, for os.Exit.
+const (
+	EXIT_OK            = 0 // every service returned and every hook succeeded
+	EXIT_HOOK_FAILED   = 1 // a shutdown hook returned an error
+	EXIT_DRAIN_TIMEOUT = 2 // a service did not return within the drain timeout
+	EXIT_CONFIG        = 3 // the services could not be started
+	EXIT_LOCKED        = 4 // another instance holds the PID file
+
+	defaultShutdownTimeout = 30 * time.Second
+)
+
+// how long each service still running, and the hooks, are given once
+// the shutdown timeout passed
+var ShutdownOverdueWait = time.Second
+
+// ShutdownHook releases something on shutdown, ctx expires with the
+// ServiceCommonConfig.ShutdownTimeout shared by the services and hooks.
+type ShutdownHook func(ctx context.Context) error
+
+type shutdownHook struct {
+	name string
+	fn   ShutdownHook
+}
+
+// OnShutdown registers a hook, hooks run in the reverse order of their
+// registration once the services returned, so something registered
+// when it is started is released after what was started later.
+func (s *Server) OnShutdown(name string, fn ShutdownHook) {
+	s.Lock()
+	defer s.Unlock()
+	s.hooks = append(s.hooks, shutdownHook{name: name, fn: fn})
+}
+
+// Context is cancelled when the server starts shutting down, services
+// not started yet are not started anymore.
+func (s *Server) Context() context.Context {
+	return s.ctx
+}
+
+// the time left until deadline, at least ShutdownOverdueWait.
+func overdueWait(deadline time.Time) time.Duration {
+	if wait := time.Until(deadline); wait > ShutdownOverdueWait {
+		return wait
+	}
+	return ShutdownOverdueWait
+}
+
+func (s *Server) shutdownTimeout() time.Duration {
+	if s.cfg != nil && s.cfg.ShutdownTimeout != 0 {
+		return time.Duration(s.cfg.ShutdownTimeout) * time.Second
+	}
+	return defaultShutdownTimeout
+}
+
+// Shutdown stops the services in reverse dependency order, cancelling
+// the context of each one and waiting for its dispatch function to
+// return, then runs the shutdown hooks in reverse order, all within
+// ServiceCommonConfig.ShutdownTimeout. Once it passed, each service
+// still running and the hooks get ShutdownOverdueWait more, so the
+// order holds and shutdown stays bounded. The configuration watch is
+// stopped first, the periodic jobs, the metrics listener and the
+// metrics checkpoint (saved one last time) are released by hooks. It returns the exit code,
+// later calls wait for the first one and return the same code.
+func (s *Server) Shutdown() int {
+	s.shutdownOnce.Do(func() {
+		code := EXIT_OK
+		timeout := s.shutdownTimeout()
+		mtlog.Infof("Shutting down, draining services for up to %v", timeout)
+		s.cancel()
+		s.stopWatch()
+
+		// no reload starts a service from now on
+		s.Lock()
+		s.running = false
+		runs := make([]*serviceRun, 0, len(s.services))
+		stopped := make(map[string]bool)
+		for _, name := range s.stopOrder {
+			if run, ok := s.services[name]; ok {
+				runs = append(runs, run)
+				stopped[name] = true
+			}
+		}
+		for name, run := range s.services {
+			if !stopped[name] {
+				runs = append(runs, run)
+			}
+		}
+		hooks := append([]shutdownHook(nil), s.hooks...)
+		s.Unlock()
+
+		deadline := time.Now().Add(timeout)
+		for _, run := range runs {
+			run.cancel()
+			timer := time.NewTimer(overdueWait(deadline))
+			select {
+			case <-run.done:
+			case <-timer.C:
+				mtlog.Errorf("Service %v did not return within %v", run.cfg.Name, timeout)
+				code = EXIT_DRAIN_TIMEOUT
+			}
+			timer.Stop()
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), overdueWait(deadline))
+		defer cancel()
+		for i := len(hooks) - 1; i >= 0; i-- {
+			if err := hooks[i].fn(ctx); err != nil {
+				mtlog.Errorf("Shutdown hook %v failed: %v", hooks[i].name, err)
+				if code == EXIT_OK {
+					code = EXIT_HOOK_FAILED
+				}
+			}
+		}
+		mtlog.Infof("Shutdown complete, exit code %d", code)
+		s.exitCode = code
+		close(s.shutdownDone)
+	})
+	<-s.shutdownDone
+	return s.exitCode
+}
@@ -0,0 +1,129 @@
+package mtsrv
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGracefulShutdown(t *testing.T) {
+	cfg := &ServiceCommonConfig{ServiceName: "helloworld", RootPath: t.TempDir(), ShutdownTimeout: 1,
+		Services: []NetServices{{Name: "kafka"}}}
+	srv := NewServer(cfg)
+
+	var mu sync.Mutex
+	var order []string
+	record := func(name string) {
+		mu.Lock()
+		order = append(order, name)
+		mu.Unlock()
+	}
+	srv.OnShutdown("flush logs", func(ctx context.Context) error {
+		record("flush logs")
+		return nil
+	})
+	srv.OnShutdown("close kafka", func(ctx context.Context) error {
+		record("close kafka")
+		return nil
+	})
+	srv.OnShutdown("deregister", func(ctx context.Context) error {
+		record("deregister")
+		return nil
+	})
+
+	disp := func(ctx context.Context, cp *NetServices, level int) error {
+		<-ctx.Done()
+		record(cp.Name)
+		return nil
+	}
+	codes := make(chan int)
+	go func() { codes <- srv.RunCommonLoop(cfg, disp) }()
+	time.Sleep(100 * time.Millisecond)
+	syscall.Kill(syscall.Getpid(), syscall.SIGTERM)
+
+	select {
+	case code := <-codes:
+		assert.Equal(t, EXIT_OK, code)
+	case <-time.After(3 * time.Second):
+		t.Fatal("SIGTERM did not stop the server")
+	}
+	assert.Equal(t, []string{"kafka", "deregister", "close kafka", "flush logs"}, order)
+	assert.NotNil(t, srv.Context().Err())
+	assert.Equal(t, EXIT_OK, srv.Shutdown())
+}
+
+func TestShutdownExitCodes(t *testing.T) {
+	cfg := &ServiceCommonConfig{ServiceName: "helloworld", RootPath: t.TempDir(), ShutdownTimeout: 1,
+		Services: []NetServices{{Name: "stuck"}}}
+	srv := NewServer(cfg)
+	srv.OnShutdown("broken", func(ctx context.Context) error { return errors.New("broken") })
+	release := make(chan struct{})
+	defer close(release)
+
+	codes := make(chan int)
+	go func() {
+		codes <- srv.RunCommonLoop(cfg, func(ctx context.Context, cp *NetServices, level int) error {
+			<-release
+			return nil
+		})
+	}()
+	time.Sleep(100 * time.Millisecond)
+	start := time.Now()
+	assert.Equal(t, EXIT_DRAIN_TIMEOUT, srv.Shutdown())
+	assert.True(t, time.Since(start) >= time.Second)
+	assert.Equal(t, EXIT_DRAIN_TIMEOUT, <-codes)
+
+	srv = NewServer(&ServiceCommonConfig{})
+	srv.OnShutdown("broken", func(ctx context.Context) error { return errors.New("broken") })
+	assert.Equal(t, EXIT_HOOK_FAILED, srv.Shutdown())
+}
+
+func TestShutdownOverdue(t *testing.T) {
+	saved := ShutdownOverdueWait
+	ShutdownOverdueWait = 100 * time.Millisecond
+	defer func() { ShutdownOverdueWait = saved }()
+
+	// kafka, started last, stops first, both ignore the cancellation
+	cfg := &ServiceCommonConfig{ServiceName: "helloworld", RootPath: t.TempDir(), ShutdownTimeout: 1,
+		Services: []NetServices{{Name: "cassandra"}, {Name: "kafka"}}}
+	srv := NewServer(cfg)
+	var hookLeft time.Duration
+	srv.OnShutdown("flush", func(ctx context.Context) error {
+		deadline, _ := ctx.Deadline()
+		hookLeft = time.Until(deadline)
+		return nil
+	})
+	release := make(chan struct{})
+	defer close(release)
+
+	var mu sync.Mutex
+	var cancelled []string
+	codes := make(chan int)
+	go func() {
+		codes <- srv.RunCommonLoop(cfg, func(ctx context.Context, cp *NetServices, level int) error {
+			<-ctx.Done()
+			mu.Lock()
+			cancelled = append(cancelled, cp.Name)
+			mu.Unlock()
+			<-release
+			return nil
+		})
+	}()
+	time.Sleep(100 * time.Millisecond)
+	start := time.Now()
+	assert.Equal(t, EXIT_DRAIN_TIMEOUT, srv.Shutdown())
+	// the timeout, then the overdue wait of cassandra, shared by the hooks
+	took := time.Since(start)
+	assert.True(t, took >= 1100*time.Millisecond, took)
+	assert.True(t, took < 1500*time.Millisecond, took)
+	assert.True(t, hookLeft <= ShutdownOverdueWait)
+	assert.Equal(t, EXIT_DRAIN_TIMEOUT, <-codes)
+	mu.Lock()
+	assert.Equal(t, []string{"kafka", "cassandra"}, cancelled)
+	mu.Unlock()
+}
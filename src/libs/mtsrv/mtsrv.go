@@ -1,62 +1,114 @@
 package mtsrv
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"runtime"
 	"strconv"
 	"sync"
+	"syscall"
 	"time"
 
+	"github.com/mtbox/metrics"
 	"github.com/mtbox/mtlog"
 )
 
-type ServiceDispatchFunc func(*NetServices, int) error
+// ServiceDispatchFunc runs one service, ctx is cancelled when the server
+// shuts down or when a configuration reload restarts the service. An
+// error or a panic is a failure, the service is then restarted as its
+// RestartPolicy says.
+type ServiceDispatchFunc func(ctx context.Context, cp *NetServices, logLevel int) error
+
+// ErrConfigHandled is returned by ParseConfig once -render-config or
+// -check-cfg printed their result, the service should exit with code 0.
+var ErrConfigHandled = errors.New("configuration rendered or checked")
 
 func showVersion(name, ver string) {
 	log.Printf("%s service version build %v", name, ver)
 }
 
+// ParseConfig loads the configuration file and applies the MT_*
+// environment variables and -set flags on top of it, see ConfigLoader.
+// The file may be JSON, YAML or TOML and include base files, see
+// ConfigCodec. A .mustache configuration is rendered first, see
+// RenderTemplate, and secret references are resolved last, see
+// SecretProvider.
+// With -render-config it prints the rendered configuration and with
+// -check-cfg it reports whether the configuration is valid, it then
+// returns ErrConfigHandled or the error found and main should exit.
 func ParseConfig(configFile string, srvCfg interface{}) error {
-	if body, err := ioutil.ReadFile(configFile); err != nil {
-		log.Printf("Could not read configuration [%v]: %v", configFile, err)
-		return err
-	} else {
-		if err := json.Unmarshal(body, srvCfg); err != nil {
-			log.Printf("Failed to parse for external configuration, error: %v", err)
+	cl := NewConfigLoader()
+	if cfgRender {
+		body, err := cl.Render(configFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return err
+		}
+		os.Stdout.Write(body)
+		return ErrConfigHandled
+	}
+	err := cl.Load(configFile, srvCfg)
+	if cfgCheck {
+		if errs, ok := err.(ConfigErrors); ok {
+			fmt.Fprintf(os.Stderr, "%v: %v\n", configFile, errs)
+			return err
+		} else if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
 			return err
 		}
+		fmt.Printf("%v: configuration is valid\n", configFile)
+		return ErrConfigHandled
+	}
+	if err != nil {
+		mtlog.Errorf("Failed to load configuration: %v", err)
+		return err
+	}
+	if cfgDumpSources {
+		cl.Dump(os.Stdout)
 	}
 
 	return nil
 }
 
+// StoreConfig writes the configuration in the format of its extension,
+// secrets resolved by ParseConfig are written as their secret:// env://
+// or vault:// references.
 func StoreConfig(configFile string, srvCfg interface{}) error {
-	configJson, err := json.Marshal(srvCfg)
+	configJson, err := hideSecrets(srvCfg)
 	if err != nil {
-		log.Printf("Failed to parse for external configuration, error: %v", err)
+		mtlog.Errorf("Failed to parse for external configuration, error: %v", err)
 		return err
 	}
-	err = ioutil.WriteFile(configFile, configJson, 0644)
+	body, err := encodeConfig(configFile, configJson)
 	if err != nil {
-		log.Printf("Failed to write configuration to file: error was: %v", err)
+		mtlog.Errorf("Failed to encode configuration for %v, error: %v", configFile, err)
+		return err
+	}
+	err = ioutil.WriteFile(configFile, body, 0644)
+	if err != nil {
+		mtlog.Errorf("Failed to write configuration to file: error was: %v", err)
 		return err
 	}
 	return nil
 }
 
 type RetentionPolicy struct {
-	Duration      string `json:"Duration"`
-	ShardDuration string `json:"ShardDuration"`
+	Duration      string `json:"Duration" validate:"duration"`
+	ShardDuration string `json:"ShardDuration" validate:"duration"`
 }
 
 type NetServices struct {
-	Name       string          `json:"Name"`
+	Name       string          `json:"Name" validate:"required"`
+	Kind       string          `json:"Kind"`
 	Host       string          `json:"Server"`
-	Port       uint32          `json:"Port"`
+	Port       uint32          `json:"Port" validate:"max=65535"`
 	User       string          `json:"User"`
 	Password   string          `json:"Password"`
 	Topics     []string        `json:"Topics"`
@@ -65,6 +117,8 @@ type NetServices struct {
 	DbSerialNo int             `json:"DbSerialNo"`
 	Retention  RetentionPolicy `json:"Retention"`
 	TLSDisable bool            `json:"TLSDisable"`
+	DependsOn  []string        `json:"DependsOn"`
+	Restart    RestartPolicy   `json:"Restart"`
 }
 
 func (cp *NetServices) ServiceAddr() string {
@@ -79,21 +133,78 @@ func (cp *NetServices) ServiceAddr() string {
 	return hostPoint
 }
 
+// Metrics checkpointing, lifetime counters survive a restart when
+// enabled. CheckpointFile is relative to RootPath and CheckpointInterval
+// is in seconds. The periodic report goes to Exporters and, when
+// HttpAddr is set, is served on http://HttpAddr/metrics.
+type MetricsConfig struct {
+	Checkpoint         bool             `json:"Checkpoint"`
+	CheckpointFile     string           `json:"CheckpointFile"`
+	CheckpointInterval uint64           `json:"CheckpointInterval"`
+	Exporters          []ExporterConfig `json:"Exporters"`
+	HttpAddr           string           `json:"HttpAddr"`
+}
+
 type ServiceCommonConfig struct {
-	PidFile        string          `json:"PidFile"`
-	ServiceName    string          `json:"ServiceName"`
-	ServiceInst    uint8           `json:"ServiceInst"`
-	DebugMode      bool            `json:"DebugMode"`
-	Threads        int             `json:"Threads"`
-	RootPath       string          `json:"RootPath"`
-	LogCfg         mtlog.LogConfig `json:"LogCfg"`
-	SystemPeriodic bool            `json:"SystemPeriodic"`
-	Services       []NetServices   `json:"Services"`
+	PidFile         string              `json:"PidFile"`
+	ServiceName     string              `json:"ServiceName"`
+	ServiceInst     uint8               `json:"ServiceInst"`
+	DebugMode       bool                `json:"DebugMode"`
+	Threads         int                 `json:"Threads" validate:"min=0,max=1024"`
+	RootPath        string              `json:"RootPath"`
+	LogCfg          mtlog.LogConfig     `json:"LogCfg"`
+	SystemPeriodic  bool                `json:"SystemPeriodic"`
+	SystemInterval  uint64              `json:"SystemInterval"`
+	ShutdownTimeout uint64              `json:"ShutdownTimeout"`
+	Metrics         MetricsConfig       `json:"Metrics"`
+	Alerts          AlertConfig         `json:"Alerts"`
+	Admin           AdminConfig         `json:"Admin"`
+	HealthHistory   HealthHistoryConfig `json:"HealthHistory"`
+	HealthReport    HealthReportConfig  `json:"HealthReport"`
+	Services        []NetServices       `json:"Services" validate:"unique=Name"`
+}
+
+// path of the metrics checkpoint file under RootPath.
+func (scCfg *ServiceCommonConfig) CheckpointPath() string {
+	file := scCfg.Metrics.CheckpointFile
+	if file == "" {
+		file = fmt.Sprintf("%s-%d.metrics.json", scCfg.ServiceName, scCfg.ServiceInst)
+	}
+	return filepath.Join(scCfg.RootPath, file)
 }
 
 type Server struct {
 	sync.Mutex
-	metList map[string]MtMetric
+	cfg        *ServiceCommonConfig
+	metList    map[string]MtMetric
+	registry   *metrics.Registry
+	exporters  []MetricExporter
+	publishers []StatusPublisher
+	report     *HealthReportConfig // reloaded, cfg has the first one
+	components func(hCtx *Health) *SrvsComponentComposition
+	sched      *Scheduler
+	alerts     *AlertEvaluator
+	watch      *configWatch
+	configSubs map[int]func(*ConfigDiff)
+	nextSub    int
+	running    bool
+	disp       ServiceDispatchFunc
+	dispLevel  int
+	services   map[string]*serviceRun
+	handlers   map[string]ServiceHandler
+	health     *Health
+	fleet      *FleetAggregator
+	ready      map[string]chan struct{}
+	stopOrder  []string
+	crashed    int
+	failed     int
+
+	ctx          context.Context
+	cancel       context.CancelFunc
+	hooks        []shutdownHook
+	shutdownOnce sync.Once
+	shutdownDone chan struct{}
+	exitCode     int
 }
 
 // Initialize the common flags
@@ -103,8 +214,16 @@ func InitFlags(name string, ver string) string {
 	flConfig := flag.String("cfg", "", "Json - Configuration File")
 	// Check if config File name has been passed as environment variable
 	envConfig := os.Getenv("cfgFile")
+	// Override single configuration values, see ConfigLoader
+	flag.Var(&cfgOverrides, "set", "Override a configuration value, <path>=<value> (repeatable)")
+	flag.BoolVar(&cfgDumpSources, "cfg-sources", false, "Print where each configuration value comes from")
+	flag.BoolVar(&cfgCheck, "check-cfg", false, "Validate the configuration, report every error and quit")
+	// Render a .mustache configuration, see RenderTemplate
+	flag.StringVar(&cfgValues, "cfg-values", "", "Json - Values of a .mustache configuration, the environment overrides them")
+	flag.BoolVar(&cfgRender, "render-config", false, "Print the rendered configuration and quit")
 
 	flag.Parse()
+	serviceVersion.name, serviceVersion.version = name, ver
 
 	if *flVersion {
 		showVersion(name, ver)
@@ -127,33 +246,71 @@ func InitFlags(name string, ver string) string {
 	}
 }
 
-func (s *Server) RunCommonLoop(scCfg *ServiceCommonConfig, disp ServiceDispatchFunc) {
+// RunCommonLoop starts the services and runs until SIGINT, SIGTERM or
+// a call to Shutdown, it returns the exit code of the shutdown for
+// os.Exit. ShutdownTimeout is in seconds, 30 by default. It first
+// locks the PID file and refuses to start when another instance holds
+// it, see PidFilePath. disp runs the services without a Kind, it may be
+// nil when they all have one, see ServiceHandler.
+func (s *Server) RunCommonLoop(scCfg *ServiceCommonConfig, disp ServiceDispatchFunc) int {
 	runtime.GOMAXPROCS(scCfg.Threads)
-	wg := sync.WaitGroup{}
+	if err := s.lockPidFile(scCfg); err != nil {
+		mtlog.Errorf("Not starting: %v", err)
+		s.Shutdown()
+		return EXIT_LOCKED
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	if scCfg.Metrics.Checkpoint {
+		s.startCheckpoint(scCfg)
+	}
+	if scCfg.Metrics.HttpAddr != "" {
+		s.startMetricsListener(scCfg.Metrics.HttpAddr)
+	}
+	if scCfg.Admin.HttpAddr != "" {
+		s.startAdminListener(scCfg.Admin.HttpAddr)
+	}
 
 	if scCfg.SystemPeriodic {
 		log.Printf("Starting periodic")
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			s.systemServicePeriodic()
-		}()
+		s.systemServicePeriodic(scCfg)
 	}
+	s.startAlerts(scCfg)
+	s.sched.Start()
 
-	for _, v := range scCfg.Services {
-		wg.Add(1)
-		// start the individual service
-		go func(cp NetServices) {
-			defer wg.Done()
-			disp(&cp, int(scCfg.LogCfg.Level))
-		}(v)
+	order, err := serviceOrder(scCfg.Services)
+	if err == nil {
+		err = checkServiceKinds(scCfg.Services, disp != nil)
+	}
+	if err != nil {
+		mtlog.Errorf("Services not started: %v", err)
+		s.Shutdown()
+		return EXIT_CONFIG
+	}
+	s.Lock()
+	s.running = s.ctx.Err() == nil
+	s.disp, s.dispLevel = disp, int(scCfg.LogCfg.Level)
+	s.stopOrder = reverseNames(order)
+	s.Unlock()
 
-		// FIXME: we need to add dependancy model
-		// add a delay here to actually so that there is time
-		// between other services to start
-		time.Sleep(time.Second)
+	// start the individual services in dependency order, a
+	// configuration reload may restart them later
+	services := make(map[string]NetServices)
+	for _, cp := range scCfg.Services {
+		services[cp.Name] = cp
 	}
-	wg.Wait()
+	for _, name := range order {
+		go s.startWhenReady(services[name])
+	}
+
+	select {
+	case sig := <-sigs:
+		mtlog.Infof("Received %v", sig)
+	case <-s.ctx.Done():
+	}
+	return s.Shutdown()
 }
 
 func (s *Server) RegisterMetric(name string, met MtMetric) {
@@ -170,9 +327,75 @@ func (s *Server) UnregisterMetric(name string) {
 	return
 }
 
+// Scheduler runs the periodic jobs of the service, jobs can be
+// registered before or after RunCommonLoop.
+func (s *Server) Scheduler() *Scheduler {
+	return s.sched
+}
+
+// Registry holds the metric sources of the service, they are
+// checkpointed when ServiceCommonConfig.Metrics.Checkpoint is set.
+func (s *Server) Registry() *metrics.Registry {
+	return s.registry
+}
+
+// RegisterHealth exposes the process metrics of the health service
+// in the registry and on /healthz of the admin listener.
+func (s *Server) RegisterHealth(hCtx *Health) {
+	hCtx.alerts = s.alerts
+	hCtx.crashed = s.CrashedServices
+	hCtx.failed = s.FailedServices
+	if s.cfg != nil {
+		hCtx.SetHysteresis(s.cfg.HealthHistory)
+	}
+	hCtx.RunCheckers(s.sched)
+	s.Lock()
+	s.health = hCtx
+	s.Unlock()
+	s.registry.Register("process", hCtx)
+}
+
+// restore the last checkpoint and keep saving the registry. Restored
+// values are applied to sources as they get registered.
+func (s *Server) startCheckpoint(scCfg *ServiceCommonConfig) {
+	file := scCfg.CheckpointPath()
+	if err := s.registry.Restore(file); err != nil {
+		mtlog.Errorf("Failed to restore metrics checkpoint %s: %v", file, err)
+	}
+	interval := time.Duration(scCfg.Metrics.CheckpointInterval) * time.Second
+	checkpoint := s.registry.Checkpoint(file, interval)
+	s.OnShutdown("metrics checkpoint", func(ctx context.Context) error {
+		checkpoint.Stop()
+		return nil
+	})
+}
+
 //
 func NewServer(scCfg *ServiceCommonConfig) *Server {
 	s := Server{}
+	s.cfg = scCfg
 	s.metList = make(map[string]MtMetric)
+	s.configSubs = make(map[int]func(*ConfigDiff))
+	s.services = make(map[string]*serviceRun)
+	s.ready = make(map[string]chan struct{})
+	s.handlers = make(map[string]ServiceHandler)
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.shutdownDone = make(chan struct{})
+	s.exporters = newExporters(scCfg)
+	s.registry = metrics.NewRegistry()
+	s.registry.Register("go", metrics.RuntimeCollector{})
+	s.sched = NewScheduler()
+	s.OnShutdown("scheduler", func(ctx context.Context) error {
+		s.sched.Stop()
+		return nil
+	})
+	s.registry.Register("scheduler", s.sched)
+	if len(scCfg.Alerts.Rules) != 0 {
+		alerts, err := NewAlertEvaluator(s.registry, scCfg)
+		if err != nil {
+			mtlog.Errorf("Invalid alert rules ignored: %v", err)
+		}
+		s.alerts = alerts
+	}
 	return &s
 }
@@ -1,19 +1,35 @@
 package mtsrv
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
 	"time"
 
+	"github.com/mtbox/metrics"
 	"github.com/mtbox/mtlog"
 )
 
+// collect and export every registered metric, returns the number
+// of collections exported.
 func (s *Server) statusUpdate() int {
+	report := s.CollectMetrics()
+
 	s.Lock()
-	defer s.Unlock()
-	for _, met := range s.metList {
-		metStr, _ := met.Marshal()
-		mtlog.Tracef("%v %v", time.Now(), metStr)
+	exporters := append([]MetricExporter(nil), s.exporters...)
+	s.Unlock()
+
+	for _, exp := range exporters {
+		if err := exp.Export(report); err != nil {
+			mtlog.Errorf("Metric exporter %v failed: %v", exp.Name(), err)
+		}
 	}
-	return 1
+	return len(report.Collections)
 }
 
 type MetricType int
@@ -24,27 +40,54 @@ const (
 	metState   MetricType = 3
 )
 
+func (mt MetricType) String() string {
+	switch mt {
+	case metCounter:
+		return "counter"
+	case metGauge:
+		return "gauge"
+	case metState:
+		return "state"
+	default:
+		return fmt.Sprintf("MetricType(%d)", int(mt))
+	}
+}
+
+func (mt MetricType) MarshalText() ([]byte, error) {
+	return []byte(mt.String()), nil
+}
+
 type MetricEntry struct {
-	mtype  MetricType
-	mkey   string
-	mvalue interface{}
+	Type  MetricType  `json:"Type"`
+	Key   string      `json:"Key"`
+	Value interface{} `json:"Value"`
 }
 
 // genric collection structure for metrics..
+// Timestamp is set by the server when it is left empty by Marshal.
 type MetricCollect struct {
-	CollectionName string
-	metrics        []MetricEntry
+	CollectionName string        `json:"CollectionName"`
+	Timestamp      time.Time     `json:"Timestamp"`
+	Metrics        []MetricEntry `json:"Metrics"`
 }
 
 // Add counter type
 func (mc *MetricCollect) AddCounter(key string, val interface{}) {
-	mEntry := MetricEntry{mtype: metCounter, mkey: key, mvalue: val}
-	mc.metrics = append(mc.metrics, mEntry)
+	mEntry := MetricEntry{Type: metCounter, Key: key, Value: val}
+	mc.Metrics = append(mc.Metrics, mEntry)
 }
 
 func (mc *MetricCollect) AddGauge(key string, val interface{}) {
-	mEntry := MetricEntry{mtype: metGauge, mkey: key, mvalue: val}
-	mc.metrics = append(mc.metrics, mEntry)
+	mEntry := MetricEntry{Type: metGauge, Key: key, Value: val}
+	mc.Metrics = append(mc.Metrics, mEntry)
+}
+
+// Add state type, val is an enum like PeripheralStatusType. It is
+// stored by name so the collection reads the same after the enum
+// values are renumbered.
+func (mc *MetricCollect) AddState(key string, val interface{}) {
+	mEntry := MetricEntry{Type: metState, Key: key, Value: fmt.Sprint(val)}
+	mc.Metrics = append(mc.Metrics, mEntry)
 }
 
 // The stats structure implemented by the client
@@ -60,12 +103,218 @@ type MtMetric interface {
 	Marshal() (*MetricCollect, error)
 }
 
+// MetricReport is everything the server knows about its metrics at
+// one point in time, it is what the exporters and the HTTP endpoint
+// serialize.
+type MetricReport struct {
+	ServiceName string           `json:"ServiceName"`
+	ServiceInst uint8            `json:"ServiceInst"`
+	Timestamp   time.Time        `json:"Timestamp"`
+	Collections []*MetricCollect `json:"Collections"`
+	Registry    []metrics.Sample `json:"Registry"`
+}
+
+// CollectMetrics marshals every registered MtMetric, holding its lock
+// while doing so, and gathers the registry.
+func (s *Server) CollectMetrics() *MetricReport {
+	s.Lock()
+	names := make([]string, 0, len(s.metList))
+	mets := make(map[string]MtMetric, len(s.metList))
+	for name, met := range s.metList {
+		names = append(names, name)
+		mets[name] = met
+	}
+	report := &MetricReport{Timestamp: time.Now()}
+	if s.cfg != nil {
+		report.ServiceName = s.cfg.ServiceName
+		report.ServiceInst = s.cfg.ServiceInst
+	}
+	s.Unlock()
+	sort.Strings(names)
+
+	for _, name := range names {
+		mc, err := marshalMetric(mets[name])
+		if err != nil {
+			mtlog.Errorf("Failed to marshal metric %v: %v", name, err)
+			continue
+		}
+		if mc == nil {
+			continue
+		}
+		if mc.CollectionName == "" {
+			mc.CollectionName = name
+		}
+		if mc.Timestamp.IsZero() {
+			mc.Timestamp = report.Timestamp
+		}
+		report.Collections = append(report.Collections, mc)
+	}
+	report.Registry = s.registry.Gather()
+	return report
+}
+
+func marshalMetric(met MtMetric) (*MetricCollect, error) {
+	met.Lock()
+	defer met.Unlock()
+	return met.Marshal()
+}
+
+// MetricExporter sends the periodic metric report somewhere.
+type MetricExporter interface {
+	Name() string
+	Export(report *MetricReport) error
+}
+
+// ExporterConfig selects a built in exporter, Kind is "log" or "file".
+// Path is the file of the file exporter, relative to RootPath.
+type ExporterConfig struct {
+	Kind string `json:"Kind" validate:"required"`
+	Path string `json:"Path"`
+}
+
+// AddExporter adds an exporter to the ones built from the config.
+func (s *Server) AddExporter(exp MetricExporter) {
+	s.Lock()
+	defer s.Unlock()
+	s.exporters = append(s.exporters, exp)
+}
+
+// build the exporters listed in the config, without any the report
+// is traced to the log as before.
+func newExporters(scCfg *ServiceCommonConfig) []MetricExporter {
+	if len(scCfg.Metrics.Exporters) == 0 {
+		return []MetricExporter{&logExporter{level: mtlog.DebugLevel}}
+	}
+	var exporters []MetricExporter
+	for _, ec := range scCfg.Metrics.Exporters {
+		switch ec.Kind {
+		case "log":
+			exporters = append(exporters, &logExporter{level: mtlog.InfoLevel})
+		case "file":
+			file := ec.Path
+			if file == "" {
+				file = fmt.Sprintf("%s-%d.metrics.log", scCfg.ServiceName, scCfg.ServiceInst)
+			}
+			exporters = append(exporters, &fileExporter{path: filepath.Join(scCfg.RootPath, file)})
+		default:
+			mtlog.Errorf("Unknown metric exporter %v, ignored", ec.Kind)
+		}
+	}
+	return exporters
+}
+
+// writes the report as one JSON line to mtlog.
+type logExporter struct {
+	level mtlog.LogLevel
+}
+
+func (le *logExporter) Name() string {
+	return "log"
+}
+
+func (le *logExporter) Export(report *MetricReport) error {
+	body, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	if le.level == mtlog.DebugLevel {
+		mtlog.Tracef("%s", body)
+	} else {
+		mtlog.Infof("%s", body)
+	}
+	return nil
+}
+
+// appends the report as one JSON line to a file.
+type fileExporter struct {
+	sync.Mutex
+	path string
+}
+
+func (fe *fileExporter) Name() string {
+	return "file:" + fe.path
+}
+
+func (fe *fileExporter) Export(report *MetricReport) error {
+	body, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	return fe.appendLine(body)
+}
+
+func (fe *fileExporter) appendLine(body []byte) error {
+	fe.Lock()
+	defer fe.Unlock()
+	if err := os.MkdirAll(filepath.Dir(fe.path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(fe.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(body, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// MetricsHandler serves the current MetricReport as JSON.
+func (s *Server) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(s.CollectMetrics()); err != nil {
+			mtlog.Errorf("Failed to write metrics: %v", err)
+		}
+	})
+}
+
+// serve MetricsHandler on Metrics.HttpAddr.
+func (s *Server) startMetricsListener(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", s.MetricsHandler())
+	httpSrv := &http.Server{Addr: addr, Handler: mux}
+
+	s.OnShutdown("metrics listener", func(ctx context.Context) error {
+		return httpSrv.Shutdown(ctx)
+	})
+
+	go func() {
+		mtlog.Infof("Serving metrics on %v", addr)
+		if err := httpSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			mtlog.Errorf("Metrics listener on %v failed: %v", addr, err)
+		}
+	}()
+}
+
 //
 // systemServicePeridoic
+// exports the metrics every SystemInterval seconds, one minute
+// by default.
 //
-func (s *Server) systemServicePeriodic() {
-	c := time.Tick(1 * time.Minute)
-	for now := range c {
-		mtlog.Tracef("%v %v", now, s.statusUpdate())
+func (s *Server) systemServicePeriodic(scCfg *ServiceCommonConfig) {
+	interval := time.Minute
+	if scCfg.SystemInterval != 0 {
+		interval = time.Duration(scCfg.SystemInterval) * time.Second
+	}
+	err := s.sched.Register(JobSpec{
+		Name:     "statusUpdate",
+		Interval: interval,
+		Timeout:  interval,
+		Overlap:  OverlapSkip,
+		Fn: func(ctx context.Context) error {
+			mtlog.Tracef("%v %v", time.Now(), s.statusUpdate())
+			return nil
+		},
+	})
+	if err != nil {
+		mtlog.Errorf("Failed to schedule status update: %v", err)
 	}
 }
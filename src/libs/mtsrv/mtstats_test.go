@@ -0,0 +1,61 @@
+package mtsrv
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testMetric struct {
+	sync.Mutex
+	locked bool
+	tx     uint64
+}
+
+func (tm *testMetric) Lock() {
+	tm.Mutex.Lock()
+	tm.locked = true
+}
+
+func (tm *testMetric) Unlock() {
+	tm.locked = false
+	tm.Mutex.Unlock()
+}
+
+func (tm *testMetric) Marshal() (*MetricCollect, error) {
+	mc := &MetricCollect{}
+	mc.AddCounter("TotalTx", tm.tx)
+	mc.AddGauge("Locked", tm.locked)
+	mc.AddState("Kafka", CONNECTED)
+	return mc, nil
+}
+
+func TestCollectMetrics(t *testing.T) {
+	s := NewServer(&ServiceCommonConfig{ServiceName: "helloworld", ServiceInst: 2})
+	s.RegisterMetric("kafka", &testMetric{tx: 7})
+
+	report := s.CollectMetrics()
+	assert.Equal(t, "helloworld", report.ServiceName)
+	assert.Equal(t, 1, len(report.Collections))
+	mc := report.Collections[0]
+	assert.Equal(t, "kafka", mc.CollectionName)
+	assert.Equal(t, report.Timestamp, mc.Timestamp)
+	assert.Equal(t, MetricEntry{Type: metGauge, Key: "Locked", Value: true}, mc.Metrics[1])
+	assert.Equal(t, MetricEntry{Type: metState, Key: "Kafka", Value: "CONNECTED"}, mc.Metrics[2])
+	assert.NotEmpty(t, report.Registry)
+
+	rec := httptest.NewRecorder()
+	s.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, 200, rec.Code)
+	var got struct {
+		Collections []struct {
+			Metrics []map[string]interface{}
+		}
+	}
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &got))
+	assert.Equal(t, "counter", got.Collections[0].Metrics[0]["Type"])
+	assert.Equal(t, float64(7), got.Collections[0].Metrics[0]["Value"])
+}
@@ -6,6 +6,7 @@ import (
 	"github.com/mtbox/metrics"
 	"github.com/mtbox/mtlog"
 	"runtime"
+	"sync"
 	"time"
 )
 
@@ -18,6 +19,21 @@ const (
 	ServiceHealthStatus_HEALTH_GREEN
 )
 
+func (st SrvHealthStatusType) String() string {
+	switch st {
+	case ServiceHealthStatus_HEALTH_UNK:
+		return "UNKNOWN"
+	case ServiceHealthStatus_HEALTH_RED:
+		return "RED"
+	case ServiceHealthStatus_HEALTH_YELLOW:
+		return "YELLOW"
+	case ServiceHealthStatus_HEALTH_GREEN:
+		return "GREEN"
+	default:
+		return fmt.Sprintf("SrvHealthStatusType(%d)", int(st))
+	}
+}
+
 type PeripheralStatusType int
 
 const (
@@ -26,6 +42,19 @@ const (
 	CONNECTING
 )
 
+func (st PeripheralStatusType) String() string {
+	switch st {
+	case FAILED:
+		return "FAILED"
+	case CONNECTED:
+		return "CONNECTED"
+	case CONNECTING:
+		return "CONNECTING"
+	default:
+		return fmt.Sprintf("PeripheralStatusType(%d)", int(st))
+	}
+}
+
 const (
 	FAILED_UPTIME        = "service is not up"
 	HEALTH_SEND_INTERVAL = "per min" //XXX
@@ -39,9 +68,21 @@ type SrvsComponentComposition struct {
 }
 
 type Health struct {
+	sync.Mutex
 	name       string
 	startTime  time.Time
 	processCtx *process.Process
+	alerts     *AlertEvaluator
+	crashed    func() int
+	failed     func() int
+	checks     map[string]StatusCheck
+	checkers   map[string]*cachedChecker
+	sched      *Scheduler
+	history    HealthHistoryConfig
+	states     map[string]*stateTracker
+
+	// observations of a peripheral counted once per interval
+	reportInterval time.Duration
 }
 
 //top level str for checking microservices health.
@@ -50,12 +91,13 @@ type MtsrvStatus struct {
 	DetailedStatus *DetailedStatusSummary
 }
 
-//brief summary of micoservice health.
-//XXX FIXME what do we need to report in
-//brief summary?
+//brief summary of micoservice health, the reasons of the
+//liveness and readiness states tell what is not GREEN.
 type BriefStatusSummary struct {
 	ServiceName string
 	Status      SrvHealthStatusType
+	Liveness    ProbeResult
+	Readiness   ProbeResult
 }
 
 type DetailedStatusSummary struct {
@@ -63,6 +105,9 @@ type DetailedStatusSummary struct {
 	ProcessStatus       *ProcessDetail
 	Security            []*SecurityStackDetail
 	WebHooks            *WebHooksList
+	Alerts              []AlertStatus
+	Checks              []CheckerStatus
+	States              []StateSummary
 }
 
 //list and status of peripherals connected
@@ -210,11 +255,22 @@ type NetworkStatDetail struct {
 type RuntimeDetail struct {
 	NumOfGoRoutines        int // Number of go-routines running inside a container.
 	NumOfCrashedGoRoutines int // Number go-routines crashed inside a container.
+	NumOfFailedRuns        int // Number of service runs which returned an error.
 	NumOfCpu               int // Number of logical CPUs usable by the current process.
 }
 
-//XXX his will contain aws connectivity, email send etc related info.
+//web hooks the service posts to, like alert notifications.
 type WebHooksList struct {
+	Hooks []*WebHookDetail
+}
+
+//delivery status of one web hook.
+type WebHookDetail struct {
+	Url         string
+	TotalSent   uint64    // Total events delivered.
+	TotalFailed uint64    // Total events which could not be delivered.
+	LastSent    time.Time // Time of the last attempt.
+	Error       string    // Error of the last attempt.
 }
 
 //Initialize a new health service.
@@ -271,6 +327,16 @@ func (hCtx *Health) CompleteSrvsStatus(srvsComponent *SrvsComponentComposition)
 		detailedSumm.Security = srvsComponent.SecurityStack
 	}
 
+	//fill web hooks and alerts.
+	detailedSumm.WebHooks = srvsComponent.WebHooks
+	if detailedSumm.WebHooks == nil {
+		detailedSumm.WebHooks = hCtx.alerts.WebHooks()
+	}
+	detailedSumm.Alerts = hCtx.alerts.Alerts()
+
+	//fill the registered checkers, see HealthChecker.
+	detailedSumm.Checks = hCtx.CheckerStatus()
+
 	//fill process detail.
 	processDetail, pErr := hCtx.ProcessDetail()
 	if pErr == nil {
@@ -283,6 +349,10 @@ func (hCtx *Health) CompleteSrvsStatus(srvsComponent *SrvsComponentComposition)
 		return nil, bErr
 	}
 
+	//the peripherals are filtered already, the status is only recorded.
+	hCtx.record(HISTORY_SERVICE, briefSrvsStatus.Status, time.Now())
+	detailedSumm.States = hCtx.StateSummaries()
+
 	if briefSrvsStatus.Status != ServiceHealthStatus_HEALTH_GREEN {
 		mtlog.Errorf("Health of microservice %v is %v", briefSrvsStatus.ServiceName, briefSrvsStatus.Status)
 	}
@@ -326,6 +396,10 @@ func (hCtx *Health) TransportHealthDetail(transportStat *metrics.TransportHealth
 	}
 
 	transDetail.Name = transportStat.TransportName
+	transDetail.Status = hCtx.observePeripheral("transport "+transDetail.Name, transDetail.Status)
+	if transDetail.Status == CONNECTED {
+		transDetail.UpTime = time.Since(transportStat.InitializationTime).String()
+	}
 
 	transDetail.TotalSuccessfulRequests = transportStat.TotalTx.Value().(uint64)
 	transDetail.TotalUnsuccessfulRequests = transportStat.TotalTxErr.Value().(uint64)
@@ -360,44 +434,51 @@ func (hCtx *Health) DatabaseHealthDetail(dbStat *metrics.DatabaseHealthStat) (*P
 	}
 	dbDetail := &PersistenceStatusDetail{}
 
+	//take one consistent copy, the stat is updated concurrently.
+	dbSnap := dbStat.Snapshot()
+
 	//check DB status of microservice.
 	//we will do this in two steps-
 	//1)check if DB client is connected.
 	//2)check unsuccessful R/W operation.
 	time_init := time.Time{}
-	if dbStat.IsConnected {
-		if dbStat.TotalUnsuccessfulReadOp == 0 && dbStat.TotalUnsuccessfulWriteOp == 0 {
-			dbDetail.UpTime = time.Since(dbStat.InitializationTime).String()
+	if dbSnap.IsConnected {
+		if dbSnap.TotalUnsuccessfulReadOp == 0 && dbSnap.TotalUnsuccessfulWriteOp == 0 {
+			dbDetail.UpTime = time.Since(dbSnap.InitializationTime).String()
 			dbDetail.Status = CONNECTED
 		} else {
 			dbDetail.UpTime = time_init.String()
 			dbDetail.Status = CONNECTING
 			errStr := fmt.Sprintf("Total Unsuccessful Read Operation Is %v, Total Unsuccessful Write Operation Is %v ",
-				dbStat.TotalUnsuccessfulReadOp, dbStat.TotalUnsuccessfulWriteOp)
+				dbSnap.TotalUnsuccessfulReadOp, dbSnap.TotalUnsuccessfulWriteOp)
 			dbDetail.Error = errStr
 		}
 	} else {
 		dbDetail.UpTime = time_init.String()
 		dbDetail.Status = FAILED
-		if dbStat.Error != nil {
-			dbDetail.Error = dbStat.Error.Error()
+		if dbSnap.Error != nil {
+			dbDetail.Error = dbSnap.Error.Error()
 		}
 	}
 
-	dbDetail.Name = dbStat.DatabaseName
-	dbDetail.TotalReadOperations = dbStat.TotalReadOp
-	dbDetail.TotalWriteOperations = dbStat.TotalWriteOp
+	dbDetail.Name = dbSnap.DatabaseName
+	dbDetail.Status = hCtx.observePeripheral("database "+dbDetail.Name, dbDetail.Status)
+	if dbDetail.Status == CONNECTED {
+		dbDetail.UpTime = time.Since(dbSnap.InitializationTime).String()
+	}
+	dbDetail.TotalReadOperations = dbSnap.TotalReadOp
+	dbDetail.TotalWriteOperations = dbSnap.TotalWriteOp
 
-	dbDetail.TotalUnsuccessfulReadOperations = dbStat.TotalUnsuccessfulReadOp
-	dbDetail.TotalUnsuccessfulWriteOperations = dbStat.TotalUnsuccessfulWriteOp
+	dbDetail.TotalUnsuccessfulReadOperations = dbSnap.TotalUnsuccessfulReadOp
+	dbDetail.TotalUnsuccessfulWriteOperations = dbSnap.TotalUnsuccessfulWriteOp
 
-	totalOp := dbStat.TotalReadOp + dbStat.TotalWriteOp
+	totalOp := dbSnap.TotalReadOp + dbSnap.TotalWriteOp
 	dbDetail.RequestRate = fmt.Sprintf("%v %v", totalOp, HEALTH_SEND_INTERVAL)
-	if dbStat.TotalReadOp != 0 {
-		dbDetail.AvgExecutionTimeOfReadOperations = dbStat.TotalLatencyReadOp / int64(dbStat.TotalReadOp)
+	if dbSnap.TotalReadOp != 0 {
+		dbDetail.AvgExecutionTimeOfReadOperations = int64(dbSnap.TotalLatencyReadOp) / int64(dbSnap.TotalReadOp)
 	}
-	if dbStat.TotalWriteOp != 0 {
-		dbDetail.AvgExecutionTimeOfWriteOperations = dbStat.TotalLatencyWriteOp / int64(dbStat.TotalWriteOp)
+	if dbSnap.TotalWriteOp != 0 {
+		dbDetail.AvgExecutionTimeOfWriteOperations = int64(dbSnap.TotalLatencyWriteOp) / int64(dbSnap.TotalWriteOp)
 	}
 
 	return dbDetail, nil
@@ -435,6 +516,10 @@ func (hCtx *Health) SecurityStackHealthDetail(securityStat *metrics.SecurityStac
 		}
 	}
 	securityDetail.Name = securityStat.SecuritySrvsName
+	securityDetail.Status = hCtx.observePeripheral("security "+securityDetail.Name, securityDetail.Status)
+	if securityDetail.Status == CONNECTED {
+		securityDetail.UpTime = time.Since(securityStat.InitializationTime).String()
+	}
 	securityDetail.TotalSuccessfulEncryption = securityStat.TotalSuccessfulEncryption.Value().(uint64)
 	securityDetail.TotalSuccessfulDecryption = securityStat.TotalSuccessfulDecryption.Value().(uint64)
 	securityDetail.TotalUnsuccessfulEncryption = securityStat.TotalUnsuccessfulEncryption.Value().(uint64)
@@ -442,7 +527,9 @@ func (hCtx *Health) SecurityStackHealthDetail(securityStat *metrics.SecurityStac
 	return securityDetail, nil
 }
 
-//Brief of microservice health status
+//Brief of microservice health status, the liveness and readiness of
+//the detailed status and of the registered checks, see StatusCheck.
+//Status is the readiness.
 func (hCtx *Health) BriefSrvsStatus(srvsStat *MtsrvStatus) (*BriefStatusSummary, error) {
 	if hCtx == nil {
 		return nil, fmt.Errorf("health context is nil")
@@ -456,81 +543,13 @@ func (hCtx *Health) BriefSrvsStatus(srvsStat *MtsrvStatus) (*BriefStatusSummary,
 		return nil, fmt.Errorf("DetailedStatus is nil")
 	}
 
-	connPeripheral := detailedStatus.ConnectedPeripheral
-	if connPeripheral != nil {
-
-		if len(connPeripheral.Databases) != 0 {
-			for _, db := range connPeripheral.Databases {
-				if db != nil {
-					if db.Status == CONNECTED {
-						briefStatus.Status = ServiceHealthStatus_HEALTH_GREEN
-					} else {
-						if db.Status == CONNECTING {
-							mtlog.Errorf("%v Database Detail: %v", db.Name, *db)
-							briefStatus.Status = ServiceHealthStatus_HEALTH_YELLOW
-							return briefStatus, nil
-						}
-						mtlog.Errorf("%v Database Detail: %v", db.Name, *db)
-						briefStatus.Status = ServiceHealthStatus_HEALTH_RED
-						return briefStatus, nil
-					}
-				}
-			}
-		}
-
-		if len(connPeripheral.Transports) != 0 {
-			for _, trans := range connPeripheral.Transports {
-				if trans != nil {
-					if trans.Status == CONNECTED {
-						briefStatus.Status = ServiceHealthStatus_HEALTH_GREEN
-					} else {
-						if trans.Status == CONNECTING {
-							mtlog.Errorf("%v Transport Detail: %v", trans.Name, *trans)
-							briefStatus.Status = ServiceHealthStatus_HEALTH_YELLOW
-							return briefStatus, nil
-						}
-						mtlog.Errorf("%v Transport Detail: %v", trans.Name, *trans)
-						briefStatus.Status = ServiceHealthStatus_HEALTH_RED
-						return briefStatus, nil
-					}
-				}
-			}
-		}
+	results := append(statusChecks(detailedStatus), hCtx.runChecks()...)
+	briefStatus.Liveness = probeState(results, PROBE_LIVENESS)
+	briefStatus.Readiness = probeState(results, PROBE_READINESS)
+	briefStatus.Status = briefStatus.Readiness.Status
+	for _, r := range briefStatus.Readiness.Reasons {
+		mtlog.Errorf("Health check %v is %v: %v", r.Check, r.Status, r.Reason)
 	}
-
-	//check security service status.
-	if len(detailedStatus.Security) != 0 {
-		for _, security := range detailedStatus.Security {
-			if security != nil {
-				if security.Status == CONNECTED {
-					briefStatus.Status = ServiceHealthStatus_HEALTH_GREEN
-				} else {
-					if security.Status == CONNECTING {
-						mtlog.Errorf("%v Security Service Detail: %v", security.Name, *security)
-						briefStatus.Status = ServiceHealthStatus_HEALTH_YELLOW
-						return briefStatus, nil
-					}
-					mtlog.Errorf("%v Security Service Detail: %v", security.Name, *security)
-					briefStatus.Status = ServiceHealthStatus_HEALTH_RED
-					return briefStatus, nil
-				}
-			}
-		}
-	}
-
-	//check for process status and mark health
-	//accordingly.
-	processStatus := detailedStatus.ProcessStatus
-	if processStatus == nil {
-		briefStatus.Status = ServiceHealthStatus_HEALTH_RED
-		return briefStatus, nil
-	}
-	if processStatus.State == "T" || processStatus.State == "I" || processStatus.State == "W" ||
-		processStatus.State == "Z" || processStatus.State == "L" {
-		briefStatus.Status = ServiceHealthStatus_HEALTH_RED
-		return briefStatus, nil
-	}
-	briefStatus.Status = ServiceHealthStatus_HEALTH_GREEN
 	return briefStatus, nil
 }
 
@@ -554,7 +573,7 @@ func (hCtx *Health) ProcessDetail() (*ProcessDetail, error) {
 
 	noThreads, tErr := pCtx.NumThreads()
 	if tErr != nil {
-		mtlog.Errorf("Unable to fetch number of threads:", tErr)
+		mtlog.Errorf("Unable to fetch number of threads: %v", tErr)
 	} else {
 		processDetail.NumThreads = noThreads
 	}
@@ -657,6 +676,12 @@ func (hCtx *Health) ProcessDetail() (*ProcessDetail, error) {
 	runtimeDetail := &RuntimeDetail{}
 	runtimeDetail.NumOfGoRoutines = runtime.NumGoroutine()
 	runtimeDetail.NumOfCpu = runtime.NumCPU()
+	if hCtx.crashed != nil {
+		runtimeDetail.NumOfCrashedGoRoutines = hCtx.crashed()
+	}
+	if hCtx.failed != nil {
+		runtimeDetail.NumOfFailedRuns = hCtx.failed()
+	}
 
 	processDetail.Runtime = runtimeDetail
 
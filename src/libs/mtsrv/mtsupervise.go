@@ -0,0 +1,152 @@
+package mtsrv
+
+import (
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/mtbox/mtlog"
+)
+
+// Restart policies of a service, when its dispatch function returns.
+const (
+	RESTART_ALWAYS     = "always"     // restart it whatever it returned
+	RESTART_ON_FAILURE = "on-failure" // restart it when it failed or panicked (the default)
+	RESTART_NEVER      = "never"      // leave it stopped
+
+	defaultRestartBackoff    = time.Second
+	defaultRestartMaxBackoff = time.Minute
+	defaultMaxRestarts       = 5
+)
+
+// RestartPolicy tells the supervisor what to do when the dispatch
+// function of a service returns. Restarts wait Backoff, doubled after
+// every failure up to MaxBackoff. After MaxRestarts failures in a row
+// the circuit opens and the service stays stopped, -1 means no limit
+// and 0, or leaving it out, means 5.
+// A run lasting MaxBackoff or more resets the count and the backoff.
+type RestartPolicy struct {
+	Policy      string `json:"Policy" validate:"oneof=always on-failure never"`
+	MaxRestarts int    `json:"MaxRestarts" validate:"min=-1"`
+	Backoff     string `json:"Backoff" validate:"duration"`
+	MaxBackoff  string `json:"MaxBackoff" validate:"duration"`
+}
+
+func (rp RestartPolicy) policy() string {
+	if rp.Policy == "" {
+		return RESTART_ON_FAILURE
+	}
+	return rp.Policy
+}
+
+func (rp RestartPolicy) maxRestarts() int {
+	if rp.MaxRestarts == 0 {
+		return defaultMaxRestarts
+	}
+	return rp.MaxRestarts
+}
+
+func (rp RestartPolicy) backoff() (time.Duration, time.Duration) {
+	backoff, _ := ParseRetention(rp.Backoff)
+	if backoff == 0 {
+		backoff = defaultRestartBackoff
+	}
+	maxBackoff, _ := ParseRetention(rp.MaxBackoff)
+	if maxBackoff == 0 {
+		maxBackoff = defaultRestartMaxBackoff
+	}
+	if maxBackoff < backoff {
+		maxBackoff = backoff
+	}
+	return backoff, maxBackoff
+}
+
+// supervise runs the dispatch function of run until its context is
+// cancelled or the restart policy leaves it stopped. A panic of the
+// dispatch function is a failure, panics in the goroutines it starts
+// still kill the process.
+func (s *Server) supervise(run *serviceRun, disp ServiceDispatchFunc, level int) {
+	name := run.cfg.Name
+	rp := run.cfg.Restart
+	backoff, maxBackoff := rp.backoff()
+	delay, failures := backoff, 0
+	for {
+		started := time.Now()
+		panicked, err := s.dispatch(run, disp, level)
+		if run.ctx.Err() != nil {
+			s.unready(run)
+			return
+		}
+		if time.Since(started) >= maxBackoff {
+			delay, failures = backoff, 0
+		}
+		if err == nil {
+			s.SetReady(name)
+			if rp.policy() != RESTART_ALWAYS {
+				return
+			}
+		} else {
+			mtlog.Errorf("Service %v failed: %v", name, err)
+			s.unready(run)
+			s.Lock()
+			if panicked {
+				s.crashed++
+			} else {
+				s.failed++
+			}
+			s.Unlock()
+			if rp.policy() == RESTART_NEVER {
+				return
+			}
+			failures++
+			if limit := rp.maxRestarts(); limit >= 0 && failures > limit {
+				mtlog.Errorf("Service %v failed %d times in a row, not restarting it anymore", name, failures)
+				return
+			}
+		}
+
+		mtlog.Warnf("Restarting service %v in %v", name, delay)
+		select {
+		case <-run.ctx.Done():
+			s.unready(run)
+			return
+		case <-time.After(delay):
+		}
+		// the new run tells when it is up again
+		s.unready(run)
+		if err != nil {
+			delay *= 2
+			if delay > maxBackoff {
+				delay = maxBackoff
+			}
+		}
+	}
+}
+
+// dispatch calls the dispatch function, a panic is returned as an
+// error.
+func (s *Server) dispatch(run *serviceRun, disp ServiceDispatchFunc, level int) (panicked bool, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			mtlog.Errorf("Service %v panicked: %v\n%s", run.cfg.Name, r, debug.Stack())
+			panicked, err = true, fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return false, disp(run.ctx, &run.cfg, level)
+}
+
+// CrashedServices is the number of service runs that panicked,
+// reported as RuntimeDetail.NumOfCrashedGoRoutines.
+func (s *Server) CrashedServices() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.crashed
+}
+
+// FailedServices is the number of service runs that returned an
+// error, reported as RuntimeDetail.NumOfFailedRuns.
+func (s *Server) FailedServices() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.failed
+}
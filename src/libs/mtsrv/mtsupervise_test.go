@@ -0,0 +1,100 @@
+package mtsrv
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServiceSupervisor(t *testing.T) {
+	restart := func(policy string, max int) RestartPolicy {
+		return RestartPolicy{Policy: policy, MaxRestarts: max, Backoff: "10ms", MaxBackoff: "40ms"}
+	}
+	cfg := &ServiceCommonConfig{ServiceName: "helloworld", RootPath: t.TempDir(), ShutdownTimeout: 1,
+		Services: []NetServices{
+			{Name: "panics", Restart: restart("", 2)},
+			{Name: "fails", Restart: restart(RESTART_NEVER, 0)},
+			{Name: "returns", Restart: restart(RESTART_ALWAYS, 0)},
+			{Name: "kafka", DependsOn: []string{"panics"}},
+		}}
+	srv := NewServer(cfg)
+
+	var mu sync.Mutex
+	runs := make(map[string]int)
+	disp := func(ctx context.Context, cp *NetServices, level int) error {
+		mu.Lock()
+		runs[cp.Name]++
+		mu.Unlock()
+		switch cp.Name {
+		case "panics":
+			panic("index out of range")
+		case "fails":
+			srv.SetReady(cp.Name)
+			return errors.New("connection refused")
+		case "returns":
+			return nil
+		}
+		<-ctx.Done()
+		return nil
+	}
+	codes := make(chan int)
+	go func() { codes <- srv.RunCommonLoop(cfg, disp) }()
+
+	// the supervisor of a service left stopped returns
+	stopped := func(name string) bool {
+		srv.Lock()
+		run, ok := srv.services[name]
+		srv.Unlock()
+		if !ok {
+			return false
+		}
+		select {
+		case <-run.done:
+			return true
+		default:
+			return false
+		}
+	}
+	assert.Eventually(t, func() bool { return stopped("panics") && stopped("fails") }, 5*time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return runs["returns"] > 3
+	}, 5*time.Second, 10*time.Millisecond)
+
+	mu.Lock()
+	// the first run and 2 restarts, 10ms, 20ms then 40ms apart
+	assert.Equal(t, 3, runs["panics"])
+	assert.Equal(t, 1, runs["fails"])
+	assert.True(t, runs["returns"] > 3)
+	assert.Equal(t, 0, runs["kafka"])
+	mu.Unlock()
+	// only the panics are crashes
+	assert.Equal(t, 3, srv.CrashedServices())
+	assert.Equal(t, 1, srv.FailedServices())
+	assert.False(t, srv.IsReady("panics"))
+	// ready until its run failed
+	assert.False(t, srv.IsReady("fails"))
+	assert.Eventually(t, func() bool { return srv.IsReady("returns") }, time.Second, time.Millisecond)
+
+	assert.Equal(t, EXIT_OK, srv.Shutdown())
+	assert.Equal(t, EXIT_OK, <-codes)
+
+	file := writeTestConfig(t, "helloworld.json", `{
+    "ServiceCommonConfig": {
+        "Services": [
+            {"Name": "kafka", "Restart": {"Policy": "sometimes", "MaxRestarts": -2, "Backoff": "soon"}}
+        ]
+    }
+}`)
+	err := (&ConfigLoader{}).Load(file, &testServiceConfig{})
+	assert.Equal(t, ConfigErrors{
+		{"$.ServiceCommonConfig.Services[0].Restart.Backoff", "invalid duration \"soon\", use a duration like \"12h\", \"7d\", \"2w\" or \"INF\""},
+		{"$.ServiceCommonConfig.Services[0].Restart.MaxRestarts", "value -2 is below the minimum -1"},
+		{"$.ServiceCommonConfig.Services[0].Restart.Policy", "\"sometimes\" is not one of always, on-failure, never"},
+	}, err)
+}
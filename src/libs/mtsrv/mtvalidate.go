@@ -0,0 +1,345 @@
+package mtsrv
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Configuration fields are checked with a validate struct tag, a comma
+// separated list of rules:
+//
+//   required     the value must not be empty or zero
+//   min=N,max=N  range of a number, or of the length of a string or list
+//   unique=F     the field F of the list elements must be unique
+//   oneof=A B    the string must be empty or one of the space separated values
+//   duration     a retention duration, see ParseRetention
+//
+// Besides the rules, every key of the JSON file must name a field
+// exactly and hold a value of the field type.
+
+// ConfigError is one violation, Path is a JSON path like
+// $.ServiceCommonConfig.Services[1].Port.
+type ConfigError struct {
+	Path string
+	Msg  string
+}
+
+func (ce ConfigError) Error() string {
+	return ce.Path + ": " + ce.Msg
+}
+
+// ConfigErrors are all the violations found in a configuration.
+type ConfigErrors []ConfigError
+
+func (ce ConfigErrors) Error() string {
+	msgs := make([]string, 0, len(ce))
+	for _, e := range ce {
+		msgs = append(msgs, e.Error())
+	}
+	return fmt.Sprintf("%d configuration error(s):\n  %s", len(ce), strings.Join(msgs, "\n  "))
+}
+
+func (ce *ConfigErrors) add(path, format string, args ...interface{}) {
+	*ce = append(*ce, ConfigError{Path: path, Msg: fmt.Sprintf(format, args...)})
+}
+
+func (ce ConfigErrors) sorted() ConfigErrors {
+	sort.SliceStable(ce, func(a, b int) bool { return ce[a].Path < ce[b].Path })
+	return ce
+}
+
+// ValidateConfig checks the validate rules of srvCfg, a configuration
+// struct or a pointer to one. It returns ConfigErrors.
+func ValidateConfig(srvCfg interface{}) error {
+	var errs ConfigErrors
+	validateConfigValue(reflect.Indirect(reflect.ValueOf(srvCfg)), "$", &errs)
+	if len(errs) != 0 {
+		return errs.sorted()
+	}
+	return nil
+}
+
+// ParseRetention parses a retention duration, a Go duration with the
+// extra units d (day) and w (week), e.g. "7d" or "1w12h". Empty and
+// "INF" mean keep forever and return 0.
+func ParseRetention(s string) (time.Duration, error) {
+	if s == "" || strings.EqualFold(s, "INF") {
+		return 0, nil
+	}
+	var total time.Duration
+	rest := s
+	for rest != "" {
+		i := 0
+		for i < len(rest) && (rest[i] == '.' || (rest[i] >= '0' && rest[i] <= '9')) {
+			i++
+		}
+		j := i
+		for j < len(rest) && (rest[j] < '0' || rest[j] > '9') && rest[j] != '.' {
+			j++
+		}
+		if i == 0 || j == i {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		num, unit := rest[:i], rest[i:j]
+		switch unit {
+		case "d", "w":
+			n, err := strconv.ParseFloat(num, 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid duration %q", s)
+			}
+			day := 24 * time.Hour
+			if unit == "w" {
+				day *= 7
+			}
+			total += time.Duration(n * float64(day))
+		default:
+			d, err := time.ParseDuration(num + unit)
+			if err != nil {
+				return 0, fmt.Errorf("invalid duration %q", s)
+			}
+			total += d
+		}
+		rest = rest[j:]
+	}
+	return total, nil
+}
+
+func validateConfigValue(rv reflect.Value, path string, errs *ConfigErrors) {
+	switch rv.Kind() {
+	case reflect.Ptr:
+		if !rv.IsNil() {
+			validateConfigValue(rv.Elem(), path, errs)
+		}
+	case reflect.Struct:
+		rt := rv.Type()
+		for i := 0; i < rt.NumField(); i++ {
+			name := configFieldName(rt.Field(i))
+			if name == "" {
+				continue
+			}
+			fpath := path + "." + name
+			if rules := rt.Field(i).Tag.Get("validate"); rules != "" {
+				checkConfigRules(rv.Field(i), fpath, rules, errs)
+			}
+			validateConfigValue(rv.Field(i), fpath, errs)
+		}
+		if rt == commonConfigType {
+			scCfg := rv.Interface().(ServiceCommonConfig)
+			validateServiceDeps(scCfg.Services, path+".Services", errs)
+			validateAlertRules(scCfg.Alerts.Rules, path+".Alerts.Rules", errs)
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < rv.Len(); i++ {
+			validateConfigValue(rv.Index(i), fmt.Sprintf("%s[%d]", path, i), errs)
+		}
+	}
+}
+
+func checkConfigRules(fv reflect.Value, path, rules string, errs *ConfigErrors) {
+	for _, rule := range strings.Split(rules, ",") {
+		name, arg := rule, ""
+		if i := strings.Index(rule, "="); i >= 0 {
+			name, arg = rule[:i], rule[i+1:]
+		}
+		switch name {
+		case "required":
+			if fv.IsZero() {
+				errs.add(path, "is required")
+			}
+		case "min", "max":
+			limit, err := strconv.ParseFloat(arg, 64)
+			if err != nil {
+				errs.add(path, "bad %v rule %q", name, arg)
+				continue
+			}
+			v, what, ok := configMeasure(fv)
+			if !ok {
+				continue
+			}
+			if name == "min" && v < limit {
+				errs.add(path, "%v %v is below the minimum %v", what, v, arg)
+			}
+			if name == "max" && v > limit {
+				errs.add(path, "%v %v is above the maximum %v", what, v, arg)
+			}
+		case "unique":
+			seen := make(map[string]int)
+			for i := 0; i < fv.Len(); i++ {
+				ef := reflect.Indirect(fv.Index(i)).FieldByName(arg)
+				if !ef.IsValid() {
+					continue
+				}
+				key := fmt.Sprint(ef.Interface())
+				if first, ok := seen[key]; ok {
+					errs.add(fmt.Sprintf("%s[%d].%s", path, i, arg), "duplicate %v %q, already used by %s[%d]",
+						arg, key, path, first)
+					continue
+				}
+				seen[key] = i
+			}
+		case "oneof":
+			v, ok := fv.String(), fv.String() == ""
+			for _, allowed := range strings.Fields(arg) {
+				ok = ok || v == allowed
+			}
+			if !ok {
+				errs.add(path, "%q is not one of %v", v, strings.Join(strings.Fields(arg), ", "))
+			}
+		case "duration":
+			if _, err := ParseRetention(fv.String()); err != nil {
+				errs.add(path, "%v, use a duration like \"12h\", \"7d\", \"2w\" or \"INF\"", err)
+			}
+		default:
+			errs.add(path, "unknown validate rule %q", name)
+		}
+	}
+}
+
+func configMeasure(fv reflect.Value) (float64, string, bool) {
+	switch fv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(fv.Int()), "value", true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(fv.Uint()), "value", true
+	case reflect.Float32, reflect.Float64:
+		return fv.Float(), "value", true
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		return float64(fv.Len()), "length", true
+	}
+	return 0, "", false
+}
+
+var (
+	jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// checkConfigFields walks the decoded JSON along rt and reports the
+// keys that do not name a field and the values of the wrong type.
+func checkConfigFields(rt reflect.Type, generic interface{}, path string, errs *ConfigErrors) {
+	if generic == nil {
+		return
+	}
+	for rt.Kind() == reflect.Ptr {
+		rt = rt.Elem()
+	}
+	if reflect.PtrTo(rt).Implements(jsonUnmarshalerType) || reflect.PtrTo(rt).Implements(textUnmarshalerType) {
+		return
+	}
+
+	switch rt.Kind() {
+	case reflect.Struct:
+		obj, ok := generic.(map[string]interface{})
+		if !ok {
+			errs.add(path, "expected an object, got %v", jsonKind(generic))
+			return
+		}
+		keys := make([]string, 0, len(obj))
+		for key := range obj {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			sf, ok, hint := lookupConfigField(rt, key)
+			if !ok {
+				if hint != "" {
+					errs.add(path+"."+key, "unknown field, did you mean %q?", hint)
+				} else {
+					errs.add(path+"."+key, "unknown field")
+				}
+				continue
+			}
+			checkConfigFields(sf.Type, obj[key], path+"."+key, errs)
+		}
+
+	case reflect.Slice, reflect.Array:
+		list, ok := generic.([]interface{})
+		if !ok {
+			errs.add(path, "expected a list, got %v", jsonKind(generic))
+			return
+		}
+		for i, gv := range list {
+			checkConfigFields(rt.Elem(), gv, fmt.Sprintf("%s[%d]", path, i), errs)
+		}
+
+	case reflect.Map:
+		obj, ok := generic.(map[string]interface{})
+		if !ok {
+			errs.add(path, "expected an object, got %v", jsonKind(generic))
+			return
+		}
+		for key, gv := range obj {
+			checkConfigFields(rt.Elem(), gv, path+"."+key, errs)
+		}
+
+	case reflect.String:
+		if _, ok := generic.(string); !ok {
+			errs.add(path, "expected a string, got %v", jsonKind(generic))
+		}
+
+	case reflect.Bool:
+		if _, ok := generic.(bool); !ok {
+			errs.add(path, "expected true or false, got %v", jsonKind(generic))
+		}
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, ok := generic.(float64)
+		if !ok {
+			errs.add(path, "expected an integer, got %v", jsonKind(generic))
+			return
+		}
+		v := reflect.New(rt).Elem()
+		switch {
+		case n != float64(int64(n)):
+			errs.add(path, "expected an integer, got %v", n)
+		case v.Kind() >= reflect.Uint && v.Kind() <= reflect.Uint64 && (n < 0 || v.OverflowUint(uint64(n))):
+			errs.add(path, "%v does not fit in %v", n, rt)
+		case v.Kind() >= reflect.Int && v.Kind() <= reflect.Int64 && v.OverflowInt(int64(n)):
+			errs.add(path, "%v does not fit in %v", n, rt)
+		}
+
+	case reflect.Float32, reflect.Float64:
+		if _, ok := generic.(float64); !ok {
+			errs.add(path, "expected a number, got %v", jsonKind(generic))
+		}
+	}
+}
+
+// lookupConfigField finds the field named key, encoding/json would
+// also accept a different case, that is returned as a hint.
+func lookupConfigField(rt reflect.Type, key string) (reflect.StructField, bool, string) {
+	hint := ""
+	for i := 0; i < rt.NumField(); i++ {
+		name := configFieldName(rt.Field(i))
+		if name == key {
+			return rt.Field(i), true, ""
+		}
+		if name != "" && strings.EqualFold(name, key) {
+			hint = name
+		}
+	}
+	return reflect.StructField{}, false, hint
+}
+
+func jsonKind(generic interface{}) string {
+	switch generic.(type) {
+	case map[string]interface{}:
+		return "an object"
+	case []interface{}:
+		return "a list"
+	case string:
+		return "a string"
+	case float64:
+		return "a number"
+	case bool:
+		return "a boolean"
+	}
+	return "null"
+}
@@ -0,0 +1,72 @@
+package mtsrv
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigValidation(t *testing.T) {
+	file := writeTestConfig(t, "helloworld.json", `{
+    "ServiceCommonConfig": {
+        "Logging": 0,
+        "Threads": 4096,
+        "DebugMode": "yes",
+        "Services": [
+            {"Name": "cassandra", "Port": 9042},
+            {"name": "kafka", "Port": 70000},
+            {"Name": "cassandra", "Port": 9043, "Retention": {"Duration": "7 days"}},
+            {"Port": 9044}
+        ]
+    }
+}`)
+	cl := &ConfigLoader{EnvPrefix: ConfigEnvPrefix}
+	err := cl.Load(file, &testServiceConfig{})
+	errs, ok := err.(ConfigErrors)
+	assert.True(t, ok, "%v", err)
+
+	assert.Equal(t, ConfigErrors{
+		{"$.ServiceCommonConfig.DebugMode", "expected true or false, got a string"},
+		{"$.ServiceCommonConfig.Logging", "unknown field"},
+		{"$.ServiceCommonConfig.Services[1].Port", "value 70000 is above the maximum 65535"},
+		{"$.ServiceCommonConfig.Services[1].name", `unknown field, did you mean "Name"?`},
+		{"$.ServiceCommonConfig.Services[2].Name", `duplicate Name "cassandra", already used by $.ServiceCommonConfig.Services[0]`},
+		{"$.ServiceCommonConfig.Services[2].Retention.Duration", `invalid duration "7 days", use a duration like "12h", "7d", "2w" or "INF"`},
+		{"$.ServiceCommonConfig.Services[3].Name", "is required"},
+		{"$.ServiceCommonConfig.Threads", "value 4096 is above the maximum 1024"},
+	}, errs)
+	assert.Contains(t, err.Error(), "8 configuration error(s)")
+
+	file = writeTestConfig(t, "helloworld.json", testConfigJson)
+	assert.Nil(t, cl.Load(file, &testServiceConfig{}))
+
+	cl.Overrides = []string{"Threads=-1"}
+	err = cl.Load(file, &testServiceConfig{})
+	assert.Equal(t, ConfigErrors{{"$.ServiceCommonConfig.Threads", "value -1 is below the minimum 0"}}, err)
+
+	file = writeTestConfig(t, "helloworld.json", "{\n  \"ServiceCommonConfig\": {,\n}")
+	err = cl.Load(file, &testServiceConfig{})
+	assert.Contains(t, err.Error(), "line 2")
+}
+
+func TestParseRetention(t *testing.T) {
+	for s, d := range map[string]time.Duration{
+		"":      0,
+		"INF":   0,
+		"90m":   90 * time.Minute,
+		"7d":    7 * 24 * time.Hour,
+		"1w12h": 180 * time.Hour,
+		"1.5d":  36 * time.Hour,
+	} {
+		got, err := ParseRetention(s)
+		assert.Nil(t, err, s)
+		assert.Equal(t, d, got, s)
+	}
+	for _, s := range []string{"7", "d", "7days", "-1h"} {
+		_, err := ParseRetention(s)
+		assert.NotNil(t, err, s)
+	}
+	assert.Nil(t, ValidateConfig(ServiceCommonConfig{}))
+	assert.NotNil(t, ValidateConfig(&ServiceCommonConfig{Services: []NetServices{{}}}))
+}
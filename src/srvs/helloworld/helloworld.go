@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"os"
 	"sync"
 	"time"
 
+	"github.com/mtbox/metrics"
 	"github.com/mtbox/mtlog"
 	"github.com/mtbox/mtsrv"
 )
@@ -34,18 +38,15 @@ const (
 
 var (
 	healthRep              *HealthReport
+	fleet                  *mtsrv.FleetAggregator
+	kafkaStat              metrics.TransportHealthStat
+	kafkaStatMu            sync.Mutex //guards the fields of kafkaStat that are not counters.
 	cdConfig               CfgLocalServices
-	healthCtx              *mtsrv.Health
+	srv                    *mtsrv.Server
 	vaultClientCreated     bool = false
 	startVaultTokenRenewal bool = false
 )
 
-// this is collective all the basic setup is done and we
-// are ready for receiving the kakfa messages
-func systemReady() bool {
-	return true
-}
-
 type VaultConfig struct {
 	RoleId   string
 	SecretId string
@@ -73,13 +74,20 @@ func main() {
 	cfgFile := mtsrv.InitFlags(serviceName, VERSION)
 
 	err := mtsrv.ParseConfig(cfgFile, &cdConfig)
-	if err != nil {
+	if err == mtsrv.ErrConfigHandled {
+		os.Exit(0)
+	} else if err != nil {
 		mtlog.Errorf("Critical: Configuration file parsing failed")
-		return
+		os.Exit(1)
 	}
 	mtlog.InitLogging(cdConfig.ScCfg.LogCfg)
 
-	s := mtsrv.NewServer(&cdConfig.ScCfg)
+	srv = mtsrv.NewServer(&cdConfig.ScCfg)
+	srv.Registry().Register("http", &httpOps)
+	srv.SetStatusComponents(fillhealthReport)
+	if err := srv.WatchConfig(cfgFile, &cdConfig); err != nil {
+		mtlog.Errorf("Configuration changes will need a restart: %v", err)
+	}
 
 	serviceMain(cdConfig.SpCfg)
 	mtlog.Tracef("Setting Log level to ", mtlog.LogLevel(cdConfig.ScCfg.LogCfg.Level).String())
@@ -90,74 +98,239 @@ func main() {
 	healthRep.SrvsHealthReport = make(map[string]ReportStatusAndCounter)
 	healthRep.FullHealthReport = make(map[string]ReportStatusAndCounter)
 
-	s.RunCommonLoop(&cdConfig.ScCfg, ListenAndServe)
+	//follow the health reports of the instances on SrvsHealthTopic.
+	fleet = mtsrv.NewFleetAggregator(time.Duration(REPORT_PREPARE_INTERVAL)*time.Second, DECLARE_DEAD_AFTER)
+	fleet.Subscribe(func(e mtsrv.FleetEvent) {
+		mtlog.Infof("Instance %v of %v on %v %v, status %v", e.Member.ServiceInstance, e.Member.ServiceName,
+			e.Member.HostName, e.Event, e.Member.Status)
+	})
+	srv.SetFleet(fleet)
+
+	mtsrv.RegisterServiceHandler("kafka", newKafkaHandler)
+	mtsrv.RegisterServiceHandler("cassandra", newCassandraHandler)
+	mtsrv.RegisterServiceHandler("healthreport", newHealthReportHandler)
+	mtsrv.RegisterServiceHandler("vault", newVaultHandler)
+	os.Exit(srv.RunCommonLoop(&cdConfig.ScCfg, nil))
 }
 
+//SrvsHealthReport keeps the instances alive, FullHealthReport
+//every instance, Counter is the number of reports missed. The
+//fleet is swept by the scheduler of srv.
 func Report() {
 	healthRep.Lock()
 	defer healthRep.Unlock()
+	healthRep.SrvsHealthReport = make(map[string]ReportStatusAndCounter)
+	healthRep.FullHealthReport = make(map[string]ReportStatusAndCounter)
+	for _, m := range fleet.Members() {
+		report := ReportStatusAndCounter{
+			Status:          m.Status.String(),
+			HostName:        m.HostName,
+			EnvName:         m.EnvName,
+			ServiceName:     m.ServiceName,
+			ServiceInstance: m.ServiceInstance,
+			Counter:         m.Missed,
+		}
+		key := m.ServiceName + "-" + m.ServiceInstance
+		if m.Dead {
+			report.Status = "DEAD"
+		} else {
+			healthRep.SrvsHealthReport[key] = report
+		}
+		healthRep.FullHealthReport[key] = report
+	}
 }
 
-func PrepareHealthReport() {
+// the health loops return when the health service is restarted
+// by a configuration reload.
+func PrepareHealthReport(ctx context.Context) {
 	ticker := time.NewTicker(time.Duration(REPORT_PREPARE_INTERVAL) * time.Second)
-	for range ticker.C {
-		Report()
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			Report()
+		}
 	}
 }
 
-func fillhealthReport() {
+//peripherals of the health report mtsrv publishes
+//every Frequency seconds of the health service.
+func fillhealthReport(hCtx *mtsrv.Health) *mtsrv.SrvsComponentComposition {
+	srvsComponent := &mtsrv.SrvsComponentComposition{}
+	kafkaStatMu.Lock()
+	defer kafkaStatMu.Unlock()
+	if kafkaStat.TransportName == "" {
+		return srvsComponent
+	}
+	transDetail, err := hCtx.TransportHealthDetail(&kafkaStat)
+	if err != nil {
+		mtlog.Errorf("Unable to fill kafka health detail: %v", err)
+		return srvsComponent
+	}
+	srvsComponent.Transports = append(srvsComponent.Transports, transDetail)
+
+	//start the next interval.
+	kafkaStat.TotalTxInOneInterval.Reset()
+	kafkaStat.TotalTxErrInOneInterval.Reset()
+	kafkaStat.TotalRxInOneInterval.Reset()
+	kafkaStat.TotalRxErrInOneInterval.Reset()
+	return srvsComponent
 }
 
-func sendMicroserviceHealthReport(healtStatusSendInterval uint64) {
-	ticker := time.NewTicker(time.Duration(healtStatusSendInterval) * time.Second)
-	for range ticker.C {
-		fillhealthReport()
-	}
+type kafkaMessage struct {
+	topic string
+	value []byte
 }
 
-func KafkaMessageReceiver(kafkaMessgaeChan chan []byte) {
+func KafkaMessageReceiver(kafkaMessgaeChan chan kafkaMessage) {
 	mtlog.Info("Starting KafkaMessageReceiver for helloworld...")
-	for {
-		select {
-		case msg := <-kafkaMessgaeChan:
-			mtlog.Info("Received...%v", msg)
+	for msg := range kafkaMessgaeChan {
+		kafkaStat.TotalRx.Inc()
+		kafkaStat.TotalRxInOneInterval.Inc()
+		if msg.topic == mtsrv.HEALTH_TOPIC {
+			if err := fleet.Consume(msg.value); err != nil {
+				kafkaStat.TotalRxErr.Inc()
+				kafkaStat.TotalRxErrInOneInterval.Inc()
+				mtlog.Errorf("Dropping health report: %v", err)
+			}
+			continue
 		}
+		mtlog.Info("Received...%v", msg.value)
 	}
 	mtlog.Info("Exiting KafkaMessageReceiver for helloworld...")
 }
 
-//create a vault client for helloworld service.
-//we will use this client for vault api call.
-func vaultMain(cp *mtsrv.NetServices) {
-	for {
-		time.Sleep(time.Minute)
+// the kafka kind receives the messages of the service topics. There is
+// no broker client yet, the messages produced to one of the topics are
+// received by KafkaMessageReceiver.
+type kafkaHandler struct {
+	sync.Mutex
+	broker      string
+	topics      []string
+	messageChan chan kafkaMessage
+}
+
+func newKafkaHandler(srv *mtsrv.Server, cp *mtsrv.NetServices) (mtsrv.ServiceHandler, error) {
+	return &kafkaHandler{broker: cp.ServiceAddr(), topics: cp.Topics}, nil
+}
+
+func (h *kafkaHandler) Start(ctx context.Context) error {
+	mtlog.Tracef("Starting kafka endpoint at %s", h.broker)
+	// started once its DependsOn services are ready
+	kafkaStatMu.Lock()
+	kafkaStat.TransportName = "kafka"
+	kafkaStat.InitializationTime = time.Now()
+	kafkaStat.IsConnected = true
+	kafkaStatMu.Unlock()
+
+	h.Lock()
+	h.messageChan = make(chan kafkaMessage, 16)
+	go KafkaMessageReceiver(h.messageChan)
+	h.Unlock()
+	go func() {
+		<-ctx.Done()
+		h.Lock()
+		close(h.messageChan)
+		h.messageChan = nil
+		h.Unlock()
+	}()
+	return nil
+}
+
+// Produce sends the health reports of mtsrv, see mtsrv.KafkaProducer.
+func (h *kafkaHandler) Produce(topic string, key, value []byte) error {
+	h.Lock()
+	defer h.Unlock()
+	if h.messageChan == nil {
+		return fmt.Errorf("kafka endpoint %s is stopped", h.broker)
+	}
+	subscribed := false
+	for _, t := range h.topics {
+		subscribed = subscribed || t == topic
+	}
+	if !subscribed {
+		kafkaStat.TotalTxErr.Inc()
+		kafkaStat.TotalTxErrInOneInterval.Inc()
+		return fmt.Errorf("topic %s is not configured", topic)
+	}
+	select {
+	case h.messageChan <- kafkaMessage{topic: topic, value: value}:
+	default:
+		kafkaStat.TotalTxErr.Inc()
+		kafkaStat.TotalTxErrInOneInterval.Inc()
+		return fmt.Errorf("receiver of topic %s is busy", topic)
 	}
+	kafkaStat.TotalTx.Inc()
+	kafkaStat.TotalTxInOneInterval.Inc()
+	return nil
 }
 
-func ListenAndServe(cp *mtsrv.NetServices, logging int) error {
-	broker := cp.ServiceAddr()
+func (h *kafkaHandler) Stop(ctx context.Context) error { return nil }
+func (h *kafkaHandler) Ready() bool                    { return true }
+func (h *kafkaHandler) Health() error                  { return nil }
 
-	messageChan := make(chan []byte)
-	mtlog.Tracef("Starting network service endpoint %v at %s", cp.Name, broker)
-	switch cp.Name {
-	case "kafka":
-		// wait till system is ready before we start kafka subscribers
-		for !systemReady() {
-			time.Sleep(time.Minute)
-		}
-		go KafkaMessageReceiver(messageChan)
-
-	case "cassandra":
-	case "health":
-		var hErr error
-		healthCtx, hErr = mtsrv.NewHealthSrvs(serviceName)
-		if hErr == nil {
-			mtlog.Info("Starting health monitoring service")
-			go sendMicroserviceHealthReport(cp.Frequency)
-			go PrepareHealthReport()
-		}
-	case "zvault":
-		vaultMain(cp)
+// the cassandra kind.
+type cassandraHandler struct{}
+
+func newCassandraHandler(srv *mtsrv.Server, cp *mtsrv.NetServices) (mtsrv.ServiceHandler, error) {
+	return cassandraHandler{}, nil
+}
+
+func (cassandraHandler) Start(ctx context.Context) error { return nil }
+func (cassandraHandler) Stop(ctx context.Context) error  { return nil }
+func (cassandraHandler) Ready() bool                     { return true }
+func (cassandraHandler) Health() error                   { return nil }
+
+// the healthreport kind is the health kind of mtsrv, which publishes
+// the health report, plus the report loop of helloworld.
+type healthReportHandler struct {
+	mtsrv.ServiceHandler
+}
+
+func newHealthReportHandler(srv *mtsrv.Server, cp *mtsrv.NetServices) (mtsrv.ServiceHandler, error) {
+	h, err := mtsrv.NewHealthHandler(srv, cp)
+	if err != nil {
+		return nil, err
+	}
+	return &healthReportHandler{ServiceHandler: h}, nil
+}
+
+func (h *healthReportHandler) Start(ctx context.Context) error {
+	if err := h.ServiceHandler.Start(ctx); err != nil {
+		return err
 	}
+	go PrepareHealthReport(ctx)
 	return nil
 }
+
+// the vault kind.
+type vaultHandler struct{}
+
+// guards vaultClientCreated, Ready is polled by the readiness watch.
+var vaultClientMu sync.Mutex
+
+func newVaultHandler(srv *mtsrv.Server, cp *mtsrv.NetServices) (mtsrv.ServiceHandler, error) {
+	return vaultHandler{}, nil
+}
+
+//create a vault client for helloworld service.
+//we will use this client for vault api call.
+func (vaultHandler) Start(ctx context.Context) error {
+	vaultClientMu.Lock()
+	defer vaultClientMu.Unlock()
+	vaultClientCreated = true
+	return nil
+}
+
+func (vaultHandler) Stop(ctx context.Context) error { return nil }
+
+// the services depending on zvault start once the client exists
+func (vaultHandler) Ready() bool {
+	vaultClientMu.Lock()
+	defer vaultClientMu.Unlock()
+	return vaultClientCreated
+}
+
+func (vaultHandler) Health() error { return nil }
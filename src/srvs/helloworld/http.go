@@ -5,6 +5,7 @@ import (
 	"mime"
 	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
@@ -13,6 +14,7 @@ import (
 	"time"
 	"reflect"
 
+        "github.com/mtbox/metrics"
         "github.com/mtbox/mtlog"
 
 	"github.com/google/uuid"
@@ -27,6 +29,9 @@ const (
 	MaxRecordLoggerLimit int = 100
 )
 
+// latency and error counts of every route, keyed by "METHOD route"
+var httpOps metrics.OpSet
+
 const (
 	ContentTypeProtoText      = "application/x-proto-text"
 	ContentTypeProtoBinary    = "application/x-proto-binary"
@@ -251,7 +256,7 @@ func makeHttpHandler(h *HutilsConnect, localMethod string, localRoute string, ha
 		}
 		defer cancel() // Cancel ctx as soon as handleSearch returns.
 
-		now := time.Now()
+		span := httpOps.Start(localMethod + " " + localRoute)
 /*
 		ctx = context.WithValue(ctx, ClientIPKey, r.Header.Get("X-REAL-IP"))
 		ctx = context.WithValue(ctx, ServerHostKey, r.Header.Get("X-HOST"))
@@ -260,7 +265,11 @@ func makeHttpHandler(h *HutilsConnect, localMethod string, localRoute string, ha
 */
 		mctx := &Mcontext{ctx: ctx, w: w, r: r}
 		code, intf := handlerFunc.Fn(mctx)
-		traceHttpReqStatus(r, code, now, "")
+		var opErr error
+		if code >= http.StatusBadRequest {
+			opErr = errors.New(http.StatusText(code))
+		}
+		traceHttpReqStatus(r, code, span.End(opErr), "")
 		if intf != nil {
 			// Always work with pointers. If a struct is returned by the handler
 			// func, it will never resolve to proto.Message. Convert to a pointer
@@ -307,11 +316,11 @@ func (h *HutilsConnect) AppendRouter(m HttpRouteLayout) error {
 	return nil
 }
 
-func traceHttpReqStatus(r *http.Request, code int, opStartTime time.Time, errStr string) {
+func traceHttpReqStatus(r *http.Request, code int, elapsed time.Duration, errStr string) {
 	mtlog.Tracef("Request ID %v , proxy Request ID %v \"%s %s %s\" from IP %v \"%v\" returned %v (%v) after %v",
 		r.Header.Get("X-Request-Id"), r.Header.Get("X-Proxy-Request-Id"), r.Method,
 		r.URL.String(), r.Proto, r.Header.Get("X-REAL-IP"),
-		r.UserAgent(), code, errStr, time.Now().Sub(opStartTime))
+		r.UserAgent(), code, errStr, elapsed)
 }
 
 func setHeader(w http.ResponseWriter, key string, value string) {
@@ -332,7 +341,7 @@ func setCommonHeader(r *http.Request, w http.ResponseWriter) {
 
 // HTTP 401 "Unauthorized" handler function
 func zedUnauthorizedHandler(w http.ResponseWriter, r *http.Request, errStr string) {
-	now := time.Now()
+	timer := metrics.StartTimer(nil)
 	response := ZsrvUnauthorized()
 	respJSON, _ := json.Marshal(response)
 	setCommonHeader(r, w)
@@ -342,13 +351,13 @@ func zedUnauthorizedHandler(w http.ResponseWriter, r *http.Request, errStr strin
 	setHeader(w, "WWW-Authenticate", "Bearer")
 	w.WriteHeader(int(response.HttpStatusCode))
 	w.Write([]byte(respJSON))
-	traceHttpReqStatus(r, int(response.HttpStatusCode), now, errStr)
+	traceHttpReqStatus(r, int(response.HttpStatusCode), timer.ObserveDuration(), errStr)
 }
 
 // HTTP 403 "Forbidden" handler function
 func zedForbiddenHandler(w http.ResponseWriter, r *http.Request) {
 	var errStr string
-	now := time.Now()
+	timer := metrics.StartTimer(nil)
 	response := ZsrvForbidden()
 	if err := csrf.FailureReason(r); err != nil {
 		errStr = err.Error()
@@ -358,24 +367,24 @@ func zedForbiddenHandler(w http.ResponseWriter, r *http.Request) {
 	setHeader(w, "Content-Type", "application/json")
 	w.WriteHeader(int(response.HttpStatusCode))
 	w.Write([]byte(respJSON))
-	traceHttpReqStatus(r, int(response.HttpStatusCode), now, errStr)
+	traceHttpReqStatus(r, int(response.HttpStatusCode), timer.ObserveDuration(), errStr)
 }
 
 // HTTP 404 "Not Found" handler function
 func zedNotFoundHandler(w http.ResponseWriter, r *http.Request) {
-	now := time.Now()
+	timer := metrics.StartTimer(nil)
 	response := ZsrvObjNotFound()
 	respJSON, _ := json.Marshal(response)
 	setCommonHeader(r, w)
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(int(response.HttpStatusCode))
 	w.Write([]byte(respJSON))
-	traceHttpReqStatus(r, int(response.HttpStatusCode), now, response.HttpStatusMsg)
+	traceHttpReqStatus(r, int(response.HttpStatusCode), timer.ObserveDuration(), response.HttpStatusMsg)
 }
 
 // HTTP 405 "Method Not Allowed" handler function
 func zedMethodNotAllowedHandler(w http.ResponseWriter, r *http.Request) {
-	now := time.Now()
+	timer := metrics.StartTimer(nil)
 	response := ZsrvMethodNotAllowed()
 	respJSON, _ := json.Marshal(response)
 	/* To-Do: Find how to be compatible with RFC 7231
@@ -386,7 +395,7 @@ func zedMethodNotAllowedHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(int(response.HttpStatusCode))
 	w.Write([]byte(respJSON))
-	traceHttpReqStatus(r, int(response.HttpStatusCode), now, response.HttpStatusMsg)
+	traceHttpReqStatus(r, int(response.HttpStatusCode), timer.ObserveDuration(), response.HttpStatusMsg)
 }
 
 